@@ -0,0 +1,42 @@
+package swarm
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestBackoffJitter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := &DialBackoff{jitter: true, rand: rand.New(rand.NewSource(42))}
+	db.init(ctx)
+
+	a := mustAddr(t, "/ip4/127.0.0.1/tcp/1234")
+	p1, p2 := peer.ID("peer1"), peer.ID("peer2")
+
+	before := time.Now()
+	db.AddBackoff(p1, a)
+	db.AddBackoff(p2, a)
+	elapsed := time.Since(before)
+
+	until1 := db.entries[p1][string(a.Bytes())].until
+	until2 := db.entries[p2][string(a.Bytes())].until
+	for _, until := range []time.Time{until1, until2} {
+		if until.Sub(before) > BackoffBase+elapsed {
+			t.Fatalf("jittered backoff %s exceeds the base backoff %s", until.Sub(before), BackoffBase)
+		}
+	}
+
+	diff := until1.Sub(until2)
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff <= elapsed {
+		t.Fatalf("expected jittered backoffs to differ, got %s and %s", until1, until2)
+	}
+}
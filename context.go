@@ -0,0 +1,267 @@
+package swarm
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+type lowLatency struct{}
+
+// WithLowLatency constructs a new context hinting that streams opened with
+// it are latency sensitive. The swarm disables Nagle's algorithm on the
+// underlying connection when the transport supports it (see NoDelayConn).
+func WithLowLatency(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lowLatency{}, true)
+}
+
+// GetLowLatency returns true if the low latency hint is set on the context.
+func GetLowLatency(ctx context.Context) bool {
+	v, _ := ctx.Value(lowLatency{}).(bool)
+	return v
+}
+
+type securityPreference struct{}
+
+// WithSecurityPreference constructs a new context carrying the order in which
+// security protocols should be offered when upgrading outbound connections.
+//
+// The swarm attaches its preference (see Swarm.SetSecurityPreference) to the
+// context passed to Transport.Dial; security transports that support it read
+// it with GetSecurityPreference.
+func WithSecurityPreference(ctx context.Context, order []protocol.ID) context.Context {
+	return context.WithValue(ctx, securityPreference{}, order)
+}
+
+// GetSecurityPreference returns the security protocol preference set on the
+// context, if any.
+func GetSecurityPreference(ctx context.Context) []protocol.ID {
+	order, _ := ctx.Value(securityPreference{}).([]protocol.ID)
+	return order
+}
+
+type connHint struct{}
+
+// WithConn constructs a new context hinting that streams opened with it must
+// use the given connection. Swarm.NewStream opens the stream on exactly that
+// connection, failing instead of dialing or using another connection.
+func WithConn(ctx context.Context, c network.Conn) context.Context {
+	return context.WithValue(ctx, connHint{}, c)
+}
+
+// GetConn returns the connection hinted on the context, if any.
+func GetConn(ctx context.Context) network.Conn {
+	c, _ := ctx.Value(connHint{}).(network.Conn)
+	return c
+}
+
+// ConnSelector picks the connection to open a stream on among the usable
+// connections to the peer. It may return nil to leave the choice to the
+// swarm's policy.
+type ConnSelector func([]network.Conn) network.Conn
+
+type connSelector struct{}
+
+// WithConnSelector constructs a new context asking Swarm.NewStream to open
+// streams made with it on the connection chosen by the given selector,
+// overriding the swarm's stream load balancing (see WithStreamLoadBalancing)
+// for that call. The selector is only consulted when the peer is connected;
+// otherwise the peer is dialed first.
+func WithConnSelector(ctx context.Context, sel ConnSelector) context.Context {
+	return context.WithValue(ctx, connSelector{}, sel)
+}
+
+// GetConnSelector returns the connection selector set on the context, if any.
+func GetConnSelector(ctx context.Context) ConnSelector {
+	sel, _ := ctx.Value(connSelector{}).(ConnSelector)
+	return sel
+}
+
+type additionalConn struct{}
+
+// WithAdditionalConn constructs a new context hinting that a dial should
+// establish a new connection even if the peer is already connected. It's
+// honored by Swarm.DialPeerBestEffort.
+func WithAdditionalConn(ctx context.Context) context.Context {
+	return context.WithValue(ctx, additionalConn{}, true)
+}
+
+// GetAdditionalConn returns true if the additional connection hint is set on
+// the context.
+func GetAdditionalConn(ctx context.Context) bool {
+	v, _ := ctx.Value(additionalConn{}).(bool)
+	return v
+}
+
+type reuseListenPort struct{}
+
+// WithReuseListenPort constructs a new context asking for connections dialed
+// with it to originate from the transport's listen socket, e.g. for hole
+// punching. Transports honoring it implement ListenPortReuser.
+func WithReuseListenPort(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reuseListenPort{}, true)
+}
+
+// GetReuseListenPort returns true if the listen port reuse hint is set on the
+// context.
+func GetReuseListenPort(ctx context.Context) bool {
+	v, _ := ctx.Value(reuseListenPort{}).(bool)
+	return v
+}
+
+type simultaneousConnect struct{}
+
+// WithSimultaneousConnect constructs a new context telling the transport that
+// connections dialed with it are one side of a simultaneous open, coordinated
+// by a hole punching protocol (see Swarm.SimultaneousConnect). Exactly one of
+// the two sides must be the client, which takes the initiator role in the
+// security handshake if both dials end up on the same socket.
+func WithSimultaneousConnect(ctx context.Context, isClient bool) context.Context {
+	return context.WithValue(ctx, simultaneousConnect{}, isClient)
+}
+
+// GetSimultaneousConnect returns whether the simultaneous open hint is set on
+// the context, and if so, whether the dialing side is the client.
+func GetSimultaneousConnect(ctx context.Context) (isClient bool, ok bool) {
+	isClient, ok = ctx.Value(simultaneousConnect{}).(bool)
+	return isClient, ok
+}
+
+type trafficClass struct{}
+
+// WithConnTrafficClass constructs a new context asking for connections dialed
+// with it to be tagged with the given traffic class (DSCP value). Transports
+// that can't set it (see TrafficClassDialer) ignore it.
+func WithConnTrafficClass(ctx context.Context, tc int) context.Context {
+	return context.WithValue(ctx, trafficClass{}, tc)
+}
+
+// GetConnTrafficClass returns the traffic class set on the context, if any.
+func GetConnTrafficClass(ctx context.Context) (tc int, ok bool) {
+	tc, ok = ctx.Value(trafficClass{}).(int)
+	return tc, ok
+}
+
+type connLinger struct{}
+
+// WithConnLinger constructs a new context asking for connections dialed with
+// it to close with the given SO_LINGER timeout, overriding the swarm's default
+// (see WithDefaultConnLinger). A zero timeout resets the connection on close,
+// avoiding TIME_WAIT. Transports whose connections can't linger (see
+// LingerConn) ignore it.
+func WithConnLinger(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, connLinger{}, d)
+}
+
+// GetConnLinger returns the linger timeout set on the context, if any.
+func GetConnLinger(ctx context.Context) (d time.Duration, ok bool) {
+	d, ok = ctx.Value(connLinger{}).(time.Duration)
+	return d, ok
+}
+
+type preferredMuxer struct{}
+
+// WithPreferredMuxer constructs a new context hinting that connections dialed
+// with it should offer the given stream multiplexer first.
+//
+// The hint is passed on to Transport.Dial. Stream multiplexers aren't given a
+// context, so it's up to transports (or their upgraders) that support it to
+// read it with GetPreferredMuxer and offer the multiplexers accordingly.
+func WithPreferredMuxer(ctx context.Context, proto protocol.ID) context.Context {
+	return context.WithValue(ctx, preferredMuxer{}, proto)
+}
+
+// GetPreferredMuxer returns the preferred stream multiplexer set on the
+// context, if any.
+func GetPreferredMuxer(ctx context.Context) (proto protocol.ID, ok bool) {
+	proto, ok = ctx.Value(preferredMuxer{}).(protocol.ID)
+	return proto, ok
+}
+
+type happyEyeballsDelay struct{}
+
+// WithHappyEyeballsDelay constructs a new context overriding, for dials made
+// with it, the delay between starting the dials to successive addresses of a
+// peer (see WithDefaultHappyEyeballsDelay). A zero delay dials all the
+// addresses at once.
+func WithHappyEyeballsDelay(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, happyEyeballsDelay{}, d)
+}
+
+// GetHappyEyeballsDelay returns the happy eyeballs delay set on the context,
+// if any.
+func GetHappyEyeballsDelay(ctx context.Context) (d time.Duration, ok bool) {
+	d, ok = ctx.Value(happyEyeballsDelay{}).(time.Duration)
+	return d, ok
+}
+
+type resumptionTicket struct{}
+
+// WithResumptionTicket constructs a new context carrying a session resumption
+// ticket (e.g. a TLS 1.3 session ticket) to present when securing connections
+// dialed with it, overriding the ticket the swarm stored for the peer (see
+// Swarm.ResumptionTicket).
+//
+// The ticket is passed on to Transport.Dial; security transports supporting
+// session resumption read it with GetResumptionTicket and report the tickets
+// they receive with ReportResumptionTicket.
+func WithResumptionTicket(ctx context.Context, ticket []byte) context.Context {
+	return context.WithValue(ctx, resumptionTicket{}, ticket)
+}
+
+// GetResumptionTicket returns the session resumption ticket set on the
+// context, if any.
+func GetResumptionTicket(ctx context.Context) []byte {
+	ticket, _ := ctx.Value(resumptionTicket{}).([]byte)
+	return ticket
+}
+
+type ticketSink struct{}
+
+func withTicketSink(ctx context.Context, sink func([]byte)) context.Context {
+	return context.WithValue(ctx, ticketSink{}, sink)
+}
+
+// ReportResumptionTicket hands a session resumption ticket received while
+// securing a connection dialed by the swarm back to it, so that it's presented
+// on the next dials to the peer. It does nothing if the context isn't one the
+// swarm passed to Transport.Dial.
+func ReportResumptionTicket(ctx context.Context, ticket []byte) {
+	if sink, _ := ctx.Value(ticketSink{}).(func([]byte)); sink != nil {
+		sink(ticket)
+	}
+}
+
+// propagateDialHints copies the dial hints of the from context onto the to
+// context. Dials are shared between callers and outlive the context of the
+// caller that started them, so the hints that affect how they're performed
+// are carried over explicitly.
+func propagateDialHints(from, to context.Context) context.Context {
+	if tc, ok := GetConnTrafficClass(from); ok {
+		to = WithConnTrafficClass(to, tc)
+	}
+	if isClient, ok := GetSimultaneousConnect(from); ok {
+		to = WithSimultaneousConnect(to, isClient)
+	}
+	if d, ok := GetConnLinger(from); ok {
+		to = WithConnLinger(to, d)
+	}
+	if proto, ok := GetPreferredMuxer(from); ok {
+		to = WithPreferredMuxer(to, proto)
+	}
+	if d, ok := GetHappyEyeballsDelay(from); ok {
+		to = WithHappyEyeballsDelay(to, d)
+	}
+	if ticket := GetResumptionTicket(from); ticket != nil {
+		to = WithResumptionTicket(to, ticket)
+	}
+	if knownAddrsOnly(from) {
+		to = withKnownAddrsOnly(to)
+	}
+	if rec := getDialRecorder(from); rec != nil {
+		to = withDialRecorder(to, rec)
+	}
+	return to
+}
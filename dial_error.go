@@ -1,9 +1,13 @@
 package swarm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strings"
+	"syscall"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 
@@ -33,6 +37,7 @@ func (e *DialError) recordErr(addr ma.Multiaddr, err error) {
 	e.DialErrors = append(e.DialErrors, TransportError{
 		Address: addr,
 		Cause:   err,
+		Kind:    ClassifyDialError(err),
 	})
 }
 
@@ -62,6 +67,8 @@ var _ error = (*DialError)(nil)
 type TransportError struct {
 	Address ma.Multiaddr
 	Cause   error
+	// Kind classifies Cause, see ClassifyDialError.
+	Kind DialErrorKind
 }
 
 func (e *TransportError) Error() string {
@@ -69,3 +76,78 @@ func (e *TransportError) Error() string {
 }
 
 var _ error = (*TransportError)(nil)
+
+// DialErrorKind is a coarse classification of dial errors, suitable for
+// metrics.
+type DialErrorKind int
+
+const (
+	// DialErrorOther is any error not covered by the other kinds.
+	DialErrorOther DialErrorKind = iota
+	// DialErrorRefused means the remote actively refused the connection.
+	DialErrorRefused
+	// DialErrorTimeout means the dial timed out.
+	DialErrorTimeout
+	// DialErrorNetUnreachable means there's no route to the remote network
+	// or host.
+	DialErrorNetUnreachable
+	// DialErrorReset means the connection was reset by the remote.
+	DialErrorReset
+	// DialErrorGated means the dial was refused locally, by the connection
+	// gater or the address filters.
+	DialErrorGated
+	// DialErrorBackoff means the dial wasn't attempted due to dial backoff.
+	DialErrorBackoff
+)
+
+func (k DialErrorKind) String() string {
+	switch k {
+	case DialErrorRefused:
+		return "refused"
+	case DialErrorTimeout:
+		return "timeout"
+	case DialErrorNetUnreachable:
+		return "unreachable"
+	case DialErrorReset:
+		return "reset"
+	case DialErrorGated:
+		return "gated"
+	case DialErrorBackoff:
+		return "backoff"
+	default:
+		return "other"
+	}
+}
+
+// ClassifyDialError classifies the given dial error. It looks through wrapped
+// errors, down to the system call errors where the platform provides them.
+func ClassifyDialError(err error) DialErrorKind {
+	switch {
+	case err == nil:
+		return DialErrorOther
+	case errors.Is(err, ErrDialBackoff):
+		return DialErrorBackoff
+	case errors.Is(err, ErrGaterDisallowedPeer),
+		errors.Is(err, ErrGaterDisallowedAddr),
+		errors.Is(err, ErrGaterDisallowedConn),
+		errors.Is(err, ErrAddrFiltered):
+		return DialErrorGated
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialErrorRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return DialErrorReset
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return DialErrorNetUnreachable
+	case errors.Is(err, context.DeadlineExceeded), os.IsTimeout(err):
+		return DialErrorTimeout
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return DialErrorTimeout
+	}
+	// The upgrader flattens the errors of the handshakes into strings.
+	if strings.HasSuffix(err.Error(), context.DeadlineExceeded.Error()) {
+		return DialErrorTimeout
+	}
+	return DialErrorOther
+}
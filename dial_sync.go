@@ -28,6 +28,13 @@ type DialSync struct {
 	dials    map[peer.ID]*activeDial
 	dialsLk  sync.Mutex
 	dialFunc DialFunc
+
+	// dedupObserver, if set, is called whenever a dial attaches to an
+	// already in-flight dial instead of starting a new one.
+	dedupObserver func(peer.ID)
+
+	// maxPending limits the number of dials in progress, 0 for no limit.
+	maxPending int
 }
 
 type activeDial struct {
@@ -96,13 +103,26 @@ func (ad *activeDial) start(ctx context.Context) {
 	ad.cancel()
 }
 
-func (ds *DialSync) getActiveDial(p peer.ID) *activeDial {
+func (ds *DialSync) getActiveDial(ctx context.Context, p peer.ID) (*activeDial, error) {
+	actd, deduped, err := ds.getActiveDialLocked(ctx, p)
+	if deduped && ds.dedupObserver != nil {
+		ds.dedupObserver(p)
+	}
+	return actd, err
+}
+
+func (ds *DialSync) getActiveDialLocked(ctx context.Context, p peer.ID) (*activeDial, bool, error) {
 	ds.dialsLk.Lock()
 	defer ds.dialsLk.Unlock()
 
 	actd, ok := ds.dials[p]
 	if !ok {
-		adctx, cancel := context.WithCancel(context.Background())
+		if ds.maxPending > 0 && len(ds.dials) >= ds.maxPending {
+			return nil, false, ErrDialQueueFull
+		}
+
+		// The dial outlives the caller's context but keeps its dial hints.
+		adctx, cancel := context.WithCancel(propagateDialHints(ctx, context.Background()))
 		actd = &activeDial{
 			id:     p,
 			cancel: cancel,
@@ -117,13 +137,20 @@ func (ds *DialSync) getActiveDial(p peer.ID) *activeDial {
 	// increase ref count before dropping dialsLk
 	actd.incref()
 
-	return actd
+	return actd, ok, nil
 }
 
 // DialLock initiates a dial to the given peer if there are none in progress
 // then waits for the dial to that peer to complete.
+//
+// If starting a dial would exceed the limit on dials in progress, DialLock
+// fails with ErrDialQueueFull. Joining a dial in progress always succeeds.
 func (ds *DialSync) DialLock(ctx context.Context, p peer.ID) (*Conn, error) {
-	return ds.getActiveDial(p).wait(ctx)
+	actd, err := ds.getActiveDial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return actd.wait(ctx)
 }
 
 // CancelDial cancels all in-progress dials to the given peer.
@@ -2,13 +2,18 @@ package swarm_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	addrutil "github.com/libp2p/go-addr-util"
 
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/transport"
@@ -16,8 +21,11 @@ import (
 	testutil "github.com/libp2p/go-libp2p-core/test"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	"github.com/libp2p/go-libp2p-testing/ci"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+	"github.com/libp2p/go-tcp-transport"
 
 	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
 	manet "github.com/multiformats/go-multiaddr-net"
 
 	. "github.com/libp2p/go-libp2p-swarm"
@@ -524,3 +532,1931 @@ func TestDialPeerFailed(t *testing.T) {
 		t.Errorf("expected %d errors, got %d", expectedErrorsCount, len(dialErr.DialErrors))
 	}
 }
+
+// stallingUpgradeTransport connects instantly to the given listener but never
+// finishes upgrading the connection.
+type stallingUpgradeTransport struct{}
+
+func (t *stallingUpgradeTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	raw, err := t.DialRaw(ctx, raddr, p)
+	if err != nil {
+		return nil, err
+	}
+	return t.UpgradeOutbound(ctx, raw, p)
+}
+
+func (t *stallingUpgradeTransport) DialRaw(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (manet.Conn, error) {
+	var d manet.Dialer
+	return d.DialContext(ctx, raddr)
+}
+
+func (t *stallingUpgradeTransport) UpgradeOutbound(ctx context.Context, conn manet.Conn, p peer.ID) (transport.CapableConn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (t *stallingUpgradeTransport) CanDial(addr ma.Multiaddr) bool {
+	return true
+}
+
+func (t *stallingUpgradeTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	panic("unimplemented")
+}
+
+func (t *stallingUpgradeTransport) Proxy() bool {
+	return false
+}
+
+func (t *stallingUpgradeTransport) Protocols() []int {
+	return []int{ma.P_TCP}
+}
+
+func TestDialUpgradeTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	upgradeTimeout := 100 * time.Millisecond
+	s1 := makeBareSwarm(ctx, t, WithUpgradeTimeout(upgradeTimeout))
+	defer s1.Close()
+	if err := s1.AddTransport(new(stallingUpgradeTransport)); err != nil {
+		t.Fatal(err)
+	}
+
+	s2p, s2addr, s2l := newSilentPeer(t)
+	go acceptAndHang(s2l)
+	defer s2l.Close()
+	s1.Peerstore().AddAddr(s2p, s2addr, peerstore.PermanentAddrTTL)
+
+	before := time.Now()
+	_, err := s1.DialPeer(ctx, s2p)
+	if err == nil {
+		t.Fatal("expected dial to fail")
+	}
+	duration := time.Since(before)
+
+	// The connect succeeds immediately so the dial timeout never fires.
+	if duration > transport.DialTimeout/2 {
+		t.Errorf("dial took %s, upgrade timeout of %s not respected", duration, upgradeTimeout)
+	}
+
+	dialErr, ok := err.(*DialError)
+	if !ok {
+		t.Fatalf("expected *DialError, got %T", err)
+	}
+	if len(dialErr.DialErrors) != 1 || dialErr.DialErrors[0].Cause != ErrUpgradeTimeout {
+		t.Fatalf("expected a single upgrade timeout error, got: %s", dialErr)
+	}
+}
+
+// stallingTrafficClassTransport is a stallingUpgradeTransport recording the
+// traffic classes it's asked to dial with, in one step or raw.
+type stallingTrafficClassTransport struct {
+	stallingUpgradeTransport
+	classes chan int
+}
+
+func (t *stallingTrafficClassTransport) DialWithTrafficClass(ctx context.Context, raddr ma.Multiaddr, p peer.ID, tc int) (transport.CapableConn, error) {
+	t.classes <- tc
+	return t.Dial(ctx, raddr, p)
+}
+
+// stallingRawTrafficClassTransport also dials raw connections with a traffic
+// class.
+type stallingRawTrafficClassTransport struct {
+	stallingTrafficClassTransport
+}
+
+func (t *stallingRawTrafficClassTransport) DialRawWithTrafficClass(ctx context.Context, raddr ma.Multiaddr, p peer.ID, tc int) (manet.Conn, error) {
+	t.classes <- tc
+	return t.DialRaw(ctx, raddr, p)
+}
+
+func TestDialUpgradeTimeoutWithTrafficClass(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name string
+		tpt  func(classes chan int) transport.Transport
+	}{
+		{"one step", func(classes chan int) transport.Transport {
+			return &stallingTrafficClassTransport{classes: classes}
+		}},
+		{"raw", func(classes chan int) transport.Transport {
+			return &stallingRawTrafficClassTransport{stallingTrafficClassTransport{classes: classes}}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upgradeTimeout := 100 * time.Millisecond
+			s1 := makeBareSwarm(ctx, t, WithUpgradeTimeout(upgradeTimeout))
+			defer s1.Close()
+			classes := make(chan int, 1)
+			if err := s1.AddTransport(tc.tpt(classes)); err != nil {
+				t.Fatal(err)
+			}
+
+			s2p, s2addr, s2l := newSilentPeer(t)
+			go acceptAndHang(s2l)
+			defer s2l.Close()
+			s1.Peerstore().AddAddr(s2p, s2addr, peerstore.PermanentAddrTTL)
+
+			before := time.Now()
+			_, err := s1.DialPeer(WithConnTrafficClass(ctx, 46), s2p)
+			if err == nil {
+				t.Fatal("expected dial to fail")
+			}
+			if duration := time.Since(before); duration > transport.DialTimeout/2 {
+				t.Errorf("dial took %s, upgrade timeout of %s not respected", duration, upgradeTimeout)
+			}
+			dialErr, ok := err.(*DialError)
+			if !ok {
+				t.Fatalf("expected *DialError, got %T", err)
+			}
+			if len(dialErr.DialErrors) != 1 || dialErr.DialErrors[0].Cause != ErrUpgradeTimeout {
+				t.Fatalf("expected a single upgrade timeout error, got: %s", dialErr)
+			}
+			select {
+			case class := <-classes:
+				if class != 46 {
+					t.Fatalf("expected traffic class 46, got %d", class)
+				}
+			default:
+				t.Fatal("expected the transport to dial with the traffic class")
+			}
+		})
+	}
+}
+
+func TestDialDedupObserver(t *testing.T) {
+	ctx := context.Background()
+
+	var deduped int32
+	s1 := makeDialOnlySwarmWithOpts(ctx, t, WithDialDedupObserver(func(peer.ID) {
+		atomic.AddInt32(&deduped, 1)
+	}))
+	defer s1.Close()
+
+	// dial to a non-existent peer so the dial hangs until it times out.
+	s2p, s2addr, s2l := newSilentPeer(t)
+	go acceptAndHang(s2l)
+	defer s2l.Close()
+	s1.Peerstore().AddAddr(s2p, s2addr, peerstore.PermanentAddrTTL)
+
+	// Start one dial and wait for it to be in flight before joining it.
+	errs := make(chan error, 5)
+	dial := func() {
+		_, err := s1.DialPeer(ctx, s2p)
+		errs <- err
+	}
+	go dial()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		go dial()
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err == nil {
+			t.Fatal("expected dial to fail")
+		}
+	}
+
+	if n := atomic.LoadInt32(&deduped); n != 4 {
+		t.Fatalf("expected 4 deduplicated dials, got %d", n)
+	}
+}
+
+// countingDNSBackend resolves every name to the loopback address, counting
+// lookups.
+type countingDNSBackend struct {
+	lookups int32
+}
+
+func (b *countingDNSBackend) LookupIPAddr(ctx context.Context, name string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&b.lookups, 1)
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func (b *countingDNSBackend) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, nil
+}
+
+func TestDialDNSResolutionCache(t *testing.T) {
+	ctx := context.Background()
+
+	backend := new(countingDNSBackend)
+	s1 := makeDialOnlySwarmWithOpts(ctx, t,
+		WithMultiaddrResolver(&madns.Resolver{Backend: backend}),
+		WithResolutionCacheTTL(time.Minute),
+	)
+	defer s1.Close()
+	s2 := makeSwarms(ctx, t, 1)[0]
+	defer s2.Close()
+
+	port, err := s2.ListenAddresses()[0].ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsAddr := ma.StringCast("/dns4/example.com/tcp/" + port)
+	s1.Peerstore().AddAddr(s2.LocalPeer(), dnsAddr, peerstore.PermanentAddrTTL)
+
+	for i := 0; i < 3; i++ {
+		if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s1.ClosePeer(s2.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&backend.lookups); n != 1 {
+		t.Fatalf("expected a single DNS lookup, got %d", n)
+	}
+}
+
+func TestFlushResolutionCache(t *testing.T) {
+	ctx := context.Background()
+
+	backend := new(countingDNSBackend)
+	s := makeBareSwarm(ctx, t,
+		WithMultiaddrResolver(&madns.Resolver{Backend: backend}),
+		WithResolutionCacheTTL(time.Minute),
+	)
+	defer s.Close()
+
+	dnsAddr := ma.StringCast("/dns4/example.com/tcp/1234")
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := s.ResolveAddr(ctx, dnsAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&backend.lookups); n != 1 {
+		t.Fatalf("expected a single DNS lookup, got %d", n)
+	}
+
+	entries := s.ResolutionCacheEntries()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 cache entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if !e.Addr.Equal(dnsAddr) {
+		t.Fatalf("expected an entry for %s, got %s", dnsAddr, e.Addr)
+	}
+	if len(e.Resolved) != 1 || !e.Resolved[0].Equal(ma.StringCast("/ip4/127.0.0.1/tcp/1234")) {
+		t.Fatalf("expected the entry to resolve to the loopback address, got %v", e.Resolved)
+	}
+	if e.Expires.Before(start.Add(time.Minute)) || e.Expires.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("expected the entry to expire in a minute, got %s", e.Expires)
+	}
+
+	s.FlushResolutionCache()
+	if entries := s.ResolutionCacheEntries(); len(entries) != 0 {
+		t.Fatalf("expected an empty cache, got %v", entries)
+	}
+	if _, err := s.ResolveAddr(ctx, dnsAddr); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&backend.lookups); n != 2 {
+		t.Fatalf("expected a fresh DNS lookup after flushing, got %d lookups", n)
+	}
+}
+
+// closedAddr returns the address of a TCP listener that has been closed.
+func closedAddr(t *testing.T) ma.Multiaddr {
+	_, addr, l := newSilentPeer(t)
+	l.Close()
+	return addr
+}
+
+func TestDialPeerBestEffort(t *testing.T) {
+	ctx := context.Background()
+
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	good := s2.ListenAddresses()[0]
+	bad := []ma.Multiaddr{closedAddr(t), closedAddr(t)}
+	s1.Peerstore().AddAddr(s2.LocalPeer(), good, peerstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), bad, peerstore.PermanentAddrTTL)
+
+	report := s1.DialPeerBestEffort(ctx, s2.LocalPeer())
+	if report.Err != nil {
+		t.Fatal(report.Err)
+	}
+	if report.Conn == nil {
+		t.Fatal("expected a connection")
+	}
+	if len(report.Attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(report.Attempts))
+	}
+	for _, a := range report.Attempts {
+		if a.Addr.Equal(good) {
+			if a.Err != nil {
+				t.Errorf("expected dial to %s to succeed, got %s", a.Addr, a.Err)
+			}
+		} else if a.Err == nil {
+			t.Errorf("expected dial to %s to fail", a.Addr)
+		}
+	}
+	if !report.Conn.RemoteMultiaddr().Equal(good) {
+		t.Errorf("expected conn to %s, got %s", good, report.Conn.RemoteMultiaddr())
+	}
+}
+
+func TestDialPeerBestEffortExpired(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s1.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	var addrs []ma.Multiaddr
+	for i := 0; i < 3; i++ {
+		_, addr, l := newSilentPeer(t)
+		go acceptAndHang(l)
+		defer l.Close()
+		addrs = append(addrs, addr)
+	}
+	s1.Peerstore().AddAddrs(p, addrs, peerstore.PermanentAddrTTL)
+
+	// Every address still being dialed is reported.
+	bctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	report := s1.DialPeerBestEffort(bctx, p)
+	if report.Err != context.DeadlineExceeded {
+		t.Fatalf("expected the dial to time out, got %v", report.Err)
+	}
+	if len(report.Attempts) != len(addrs) {
+		t.Fatalf("expected %d attempts, got %d", len(addrs), len(report.Attempts))
+	}
+	for _, a := range report.Attempts {
+		if a.Err != context.DeadlineExceeded {
+			t.Errorf("expected the dial to %s to time out, got %v", a.Addr, a.Err)
+		}
+	}
+	if m := s1.Metrics(); m.DialsAttempted != 1 || m.DialsFailed != 1 {
+		t.Fatalf("expected one failed dial, got %d attempted and %d failed", m.DialsAttempted, m.DialsFailed)
+	}
+}
+
+func TestDialPeerBestEffortAlongsideDialPeer(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s1.Close()
+
+	// More hanging addresses than the per-peer limit, so some of the dials
+	// of both calls wait on it.
+	p := testutil.RandPeerIDFatal(t)
+	for i := 0; i < DefaultPerPeerRateLimit+2; i++ {
+		_, addr, l := newSilentPeer(t)
+		go acceptAndHang(l)
+		defer l.Close()
+		s1.Peerstore().AddAddr(p, addr, peerstore.PermanentAddrTTL)
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s1.DialPeer(dctx, p)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Giving up mustn't drop the dials DialPeer queued.
+	bctx, bcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer bcancel()
+	if report := s1.DialPeerBestEffort(bctx, p); report.Err != context.DeadlineExceeded {
+		t.Fatalf("expected the best effort dial to time out, got %v", report.Err)
+	}
+
+	select {
+	case err := <-done:
+		if _, ok := err.(*DialError); !ok {
+			t.Fatalf("expected DialPeer to fail dialing every address, got %v", err)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("DialPeer never finished dialing its queued addresses")
+	}
+}
+
+func TestDialConnWarmup(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	var warmed int32
+	s1.SetConnWarmupFunc(func(ctx context.Context, c network.Conn) error {
+		if n := len(s1.Conns()); n != 0 {
+			return fmt.Errorf("conn visible during warmup (%d conns)", n)
+		}
+		str, err := c.NewStream()
+		if err != nil {
+			return err
+		}
+		defer str.Close()
+		if _, err := str.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(str, buf); err != nil {
+			return err
+		}
+		atomic.AddInt32(&warmed, 1)
+		return nil
+	})
+
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&warmed) != 1 {
+		t.Fatal("expected the warmup to run once")
+	}
+	if cs := s1.Conns(); len(cs) != 1 || cs[0] != c {
+		t.Fatalf("expected the warmed up conn to be registered, got %v", cs)
+	}
+	c.Close()
+
+	// A failing warmup fails the dial and never registers the conn.
+	warmupErr := errors.New("warmup failed")
+	s1.SetConnWarmupFunc(func(ctx context.Context, c network.Conn) error {
+		if _, err := c.NewStream(); err != nil {
+			return err
+		}
+		return warmupErr
+	})
+	s1.Backoff().Clear(s2.LocalPeer())
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err == nil {
+		t.Fatal("expected dial to fail")
+	}
+	if cs := s1.ConnsToPeer(s2.LocalPeer()); len(cs) != 0 {
+		t.Fatalf("expected no registered conns, got %v", cs)
+	}
+}
+
+func TestDialAddrDiscovery(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+
+	// Without discovery, there's nothing to dial.
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err == nil {
+		t.Fatal("expected dial without addresses to fail")
+	}
+	s1.Backoff().Clear(s2.LocalPeer())
+
+	var calls int32
+	s1.SetAddrDiscoveryFunc(func(ctx context.Context, p peer.ID) []ma.Multiaddr {
+		atomic.AddInt32(&calls, 1)
+		if p != s2.LocalPeer() {
+			return nil
+		}
+		return s2.ListenAddresses()
+	})
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected discovery to be called once, got %d", n)
+	}
+	if len(s1.Peerstore().Addrs(s2.LocalPeer())) == 0 {
+		t.Fatal("expected discovered addresses to be added to the peerstore")
+	}
+}
+
+func TestDialRerankAfterDisconnect(t *testing.T) {
+	ctx := context.Background()
+
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	if err := s2.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	addrs := s2.ListenAddresses()
+	if len(addrs) != 2 {
+		t.Fatalf("expected two listen addresses, got %v", addrs)
+	}
+
+	// The ranker only dials the address with the best reputation.
+	var mu sync.Mutex
+	reputation := map[string]int{addrs[0].String(): 10, addrs[1].String(): 5}
+	ranker := func(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+		mu.Lock()
+		defer mu.Unlock()
+		best := addrs[0]
+		for _, a := range addrs[1:] {
+			if reputation[a.String()] > reputation[best.String()] {
+				best = a
+			}
+		}
+		return []ma.Multiaddr{best}
+	}
+
+	s1 := makeDialOnlySwarmWithOpts(ctx, t, WithAddrRanker(ranker))
+	defer s1.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), addrs, peerstore.PermanentAddrTTL)
+
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.RemoteMultiaddr().Equal(addrs[0]) {
+		t.Fatalf("expected to dial %s, dialed %s", addrs[0], c.RemoteMultiaddr())
+	}
+
+	// Drop the conn and degrade the address it used.
+	c.Close()
+	mu.Lock()
+	reputation[addrs[0].String()] = 0
+	mu.Unlock()
+
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+	if !str.Conn().RemoteMultiaddr().Equal(addrs[1]) {
+		t.Fatalf("expected redial to %s, dialed %s", addrs[1], str.Conn().RemoteMultiaddr())
+	}
+}
+
+func TestDialGaterErrors(t *testing.T) {
+	ctx := context.Background()
+
+	gater := swarmt.DefaultMockConnectionGater()
+	s1 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly, swarmt.OptConnGater(gater))
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	gater.PeerDial = func(peer.ID) bool { return false }
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); !errors.Is(err, ErrGaterDisallowedPeer) {
+		t.Fatalf("expected ErrGaterDisallowedPeer, got %v", err)
+	}
+	if report := s1.DialPeerBestEffort(ctx, s2.LocalPeer()); report.Err != ErrGaterDisallowedPeer {
+		t.Fatalf("expected ErrGaterDisallowedPeer from best effort dial, got %v", report.Err)
+	}
+
+	gater.PeerDial = func(peer.ID) bool { return true }
+	gater.Dial = func(peer.ID, ma.Multiaddr) bool { return false }
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); !errors.Is(err, ErrGaterDisallowedAddr) {
+		t.Fatalf("expected ErrGaterDisallowedAddr, got %v", err)
+	}
+	if report := s1.DialPeerBestEffort(ctx, s2.LocalPeer()); report.Err != ErrGaterDisallowedAddr {
+		t.Fatalf("expected ErrGaterDisallowedAddr from best effort dial, got %v", report.Err)
+	}
+
+	gater.Dial = func(peer.ID, ma.Multiaddr) bool { return true }
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialExtendsAddrTTL(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := makeDialOnlySwarmWithOpts(ctx, t, WithSuccessfulDialAddrTTL(time.Hour))
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+
+	// Learn the address with a TTL that expires shortly after the dial.
+	addr := s2.ListenAddresses()[0]
+	s1.Peerstore().AddAddr(s2.LocalPeer(), addr, 200*time.Millisecond)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	addrs := s1.Peerstore().Addrs(s2.LocalPeer())
+	if len(addrs) != 1 || !addrs[0].Equal(addr) {
+		t.Fatalf("expected the dialed address to outlive its original TTL, have %v", addrs)
+	}
+}
+
+func TestResolveAddr(t *testing.T) {
+	ctx := context.Background()
+
+	p1 := testutil.RandPeerIDFatal(t)
+	p2 := testutil.RandPeerIDFatal(t)
+	backend := &madns.MockBackend{
+		TXT: map[string][]string{
+			"_dnsaddr.example.com": {
+				"dnsaddr=/ip4/1.2.3.4/tcp/4001/p2p/" + p1.Pretty(),
+				"dnsaddr=/ip4/5.6.7.8/tcp/4001/p2p/" + p2.Pretty(),
+			},
+		},
+	}
+	s := makeBareSwarm(ctx, t, WithMultiaddrResolver(&madns.Resolver{Backend: backend}))
+	defer s.Close()
+
+	resolved, err := s.ResolveAddr(ctx, ma.StringCast("/dnsaddr/example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.4/tcp/4001/p2p/" + p1.Pretty()),
+		ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/" + p2.Pretty()),
+	}
+	if len(resolved) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, resolved)
+	}
+	for i := range expected {
+		if !resolved[i].Equal(expected[i]) {
+			t.Fatalf("expected %v, got %v", expected, resolved)
+		}
+	}
+
+	// Addresses that don't need resolving are returned as-is.
+	plain := ma.StringCast("/ip4/127.0.0.1/tcp/1234")
+	if resolved, err := s.ResolveAddr(ctx, plain); err != nil || len(resolved) != 1 || !resolved[0].Equal(plain) {
+		t.Fatalf("expected %s as-is, got %v (%v)", plain, resolved, err)
+	}
+}
+
+func TestDialDisableBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dialCount := func(opts ...Option) (int32, error) {
+		var dials int32
+		tpt := &recordingTransport{
+			dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}},
+			dialed:         func(ma.Multiaddr) { atomic.AddInt32(&dials, 1) },
+		}
+		s := makeBareSwarm(ctx, t, append(opts, WithTransports(tpt))...)
+		defer s.Close()
+
+		p := testutil.RandPeerIDFatal(t)
+		s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/udp/1234"), peerstore.PermanentAddrTTL)
+		var err error
+		for i := 0; i < 3; i++ {
+			_, err = s.DialPeer(ctx, p)
+		}
+		return atomic.LoadInt32(&dials), err
+	}
+
+	// By default, the failed address is put into backoff after the first dial.
+	if n, err := dialCount(); n != 1 || err != ErrDialBackoff {
+		t.Fatalf("expected one dial and a backoff error, got %d dials and %v", n, err)
+	}
+
+	n, err := dialCount(WithDisableBackoff())
+	if n != 3 {
+		t.Fatalf("expected every dial to be attempted, got %d dials", n)
+	}
+	if err == ErrDialBackoff {
+		t.Fatal("didn't expect a backoff error with backoffs disabled")
+	}
+}
+
+func TestDialErrorKinds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	swarms := makeSwarms(ctx, t, 1)
+	defer closeSwarms(swarms)
+	s := swarms[0]
+
+	dialErrKind := func(p peer.ID) DialErrorKind {
+		_, err := s.DialPeer(ctx, p)
+		var dialErr *DialError
+		if !errors.As(err, &dialErr) || len(dialErr.DialErrors) != 1 {
+			t.Fatalf("expected a dial error with a single transport error, got %v", err)
+		}
+		return dialErr.DialErrors[0].Kind
+	}
+
+	// Nothing listens on a closed listener's port.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := manet.FromNetAddr(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	refused := testutil.RandPeerIDFatal(t)
+	s.Peerstore().AddAddr(refused, addr, peerstore.PermanentAddrTTL)
+	if kind := dialErrKind(refused); kind != DialErrorRefused {
+		t.Errorf("expected a refused dial, got %s", kind)
+	}
+
+	// A silent peer never completes the handshake.
+	silent, silentAddr, sl := newSilentPeer(t)
+	go acceptAndHang(sl)
+	defer sl.Close()
+	s.Peerstore().AddAddr(silent, silentAddr, peerstore.PermanentAddrTTL)
+	if kind := dialErrKind(silent); kind != DialErrorTimeout {
+		t.Errorf("expected a timed out dial, got %s", kind)
+	}
+
+	if kind := ClassifyDialError(ErrDialBackoff); kind != DialErrorBackoff {
+		t.Errorf("expected a backoff, got %s", kind)
+	}
+	for _, err := range []error{ErrGaterDisallowedPeer, ErrGaterDisallowedAddr, ErrGaterDisallowedConn, ErrAddrFiltered} {
+		if kind := ClassifyDialError(fmt.Errorf("dialing: %w", err)); kind != DialErrorGated {
+			t.Errorf("expected %q to be gated, got %s", err, kind)
+		}
+	}
+}
+
+func TestDialPeerWithResult(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	// A closed port, followed by the real address.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr, err := manet.FromNetAddr(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	s1.Peerstore().AddAddr(s2.LocalPeer(), closedAddr, peerstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	c, diag, err := s1.DialPeerWithResult(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diag.Peer != s2.LocalPeer() || diag.Duration <= 0 {
+		t.Fatalf("unexpected diagnostics: %+v", diag)
+	}
+	if !diag.Addr.Equal(c.RemoteMultiaddr()) {
+		t.Errorf("expected address %s, got %s", c.RemoteMultiaddr(), diag.Addr)
+	}
+	if tpt := c.(*Conn).ConnState().Transport; diag.Transport != tpt {
+		t.Errorf("expected transport %s, got %s", tpt, diag.Transport)
+	}
+	var succeeded bool
+	for _, a := range diag.Attempts {
+		if a.Err == nil {
+			succeeded = a.Addr.Equal(c.RemoteMultiaddr())
+		}
+	}
+	if !succeeded {
+		t.Errorf("expected the successful attempt to be recorded, got %v", diag.Attempts)
+	}
+
+	// Failed dials are described too.
+	p := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddr(p, closedAddr, peerstore.PermanentAddrTTL)
+	_, diag, err = s1.DialPeerWithResult(ctx, p)
+	if err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if diag.Addr != nil || len(diag.Attempts) != 1 || !diag.Attempts[0].Addr.Equal(closedAddr) || diag.Attempts[0].Err == nil {
+		t.Fatalf("expected a single failed attempt, got %+v", diag)
+	}
+}
+
+func TestDialFailureThreshold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var dials int32
+	tpt := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}},
+		dialed:         func(ma.Multiaddr) { atomic.AddInt32(&dials, 1) },
+	}
+	const threshold = 2
+	s := makeBareSwarm(ctx, t, WithDialFailureThreshold(threshold), WithDisableBackoff(), WithTransports(tpt))
+	defer s.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/udp/1234"), peerstore.PermanentAddrTTL)
+	for i := 0; i < threshold; i++ {
+		if _, err := s.DialPeer(ctx, p); err == nil || err == ErrDialFailureThresholdExceeded {
+			t.Fatalf("dial %d: expected a dial failure, got %v", i, err)
+		}
+	}
+	if _, err := s.DialPeer(ctx, p); err != ErrDialFailureThresholdExceeded {
+		t.Fatalf("expected ErrDialFailureThresholdExceeded, got %v", err)
+	}
+	if n := atomic.LoadInt32(&dials); n != threshold {
+		t.Fatalf("expected %d dials, got %d", threshold, n)
+	}
+
+	s.ResetDialFailures(p)
+	if _, err := s.DialPeer(ctx, p); err == ErrDialFailureThresholdExceeded {
+		t.Fatal("expected dialing to resume after a reset")
+	}
+	if n := atomic.LoadInt32(&dials); n != threshold+1 {
+		t.Fatalf("expected %d dials, got %d", threshold+1, n)
+	}
+}
+
+func TestPendingConns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	swarms := makeSwarms(ctx, t, 1)
+	defer closeSwarms(swarms)
+	s := swarms[0]
+
+	// The silent peer accepts the connection but never upgrades it.
+	p, addr, l := newSilentPeer(t)
+	go acceptAndHang(l)
+	defer l.Close()
+	s.Peerstore().AddAddr(p, addr, peerstore.PermanentAddrTTL)
+
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := s.DialPeer(ctx, p)
+		dialed <- err
+	}()
+
+	var pending PendingConn
+	for i := 0; ; i++ {
+		if conns := s.PendingConns(); len(conns) == 1 {
+			pending = conns[0]
+			break
+		}
+		if i > 50 {
+			t.Fatal("the stalled connection never showed up as pending")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pending.Peer != p || !pending.RemoteAddr.Equal(addr) || pending.Direction != network.DirOutbound {
+		t.Fatalf("unexpected pending connection: %+v", pending)
+	}
+
+	if !s.CancelPendingConn(pending.ID) {
+		t.Fatal("expected to cancel the pending connection")
+	}
+	select {
+	case err := <-dialed:
+		if err == nil {
+			t.Fatal("expected the dial to fail")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("canceling the pending connection didn't abort the dial")
+	}
+	if conns := s.PendingConns(); len(conns) != 0 {
+		t.Fatalf("expected no pending connections, got %v", conns)
+	}
+	if s.CancelPendingConn(pending.ID) {
+		t.Fatal("didn't expect to cancel a pending connection twice")
+	}
+}
+
+func TestDialPeerIfKnown(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+
+	var calls int32
+	s1.SetAddrDiscoveryFunc(func(ctx context.Context, p peer.ID) []ma.Multiaddr {
+		atomic.AddInt32(&calls, 1)
+		return s2.ListenAddresses()
+	})
+
+	p := s2.LocalPeer()
+	s1.Peerstore().AddAddr(p, ma.StringCast("/dns4/example.com/tcp/1234"), peerstore.PermanentAddrTTL)
+	if _, err := s1.DialPeerIfKnown(ctx, p); err != ErrNoKnownDirectAddrs {
+		t.Fatalf("expected ErrNoKnownDirectAddrs, got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("expected discovery not to be consulted, got %d calls", n)
+	}
+
+	s1.Peerstore().AddAddrs(p, s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	if _, err := s1.DialPeerIfKnown(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("expected discovery not to be consulted, got %d calls", n)
+	}
+}
+
+func TestDialPeers(t *testing.T) {
+	ctx := context.Background()
+
+	s := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s.Close()
+
+	good := make(map[peer.ID]bool)
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		other := makeSwarmWithOpts(ctx, t)
+		defer other.Close()
+		s.Peerstore().AddAddrs(other.LocalPeer(), other.ListenAddresses(), peerstore.PermanentAddrTTL)
+		good[other.LocalPeer()] = true
+		peers = append(peers, other.LocalPeer())
+	}
+	for i := 0; i < 2; i++ {
+		// no known addresses, so the dial fails
+		peers = append(peers, testutil.RandPeerIDFatal(t))
+	}
+
+	seen := make(map[peer.ID]bool)
+	for res := range s.DialPeers(ctx, peers, 2) {
+		if seen[res.Peer] {
+			t.Fatalf("got two results for %s", res.Peer)
+		}
+		seen[res.Peer] = true
+		if good[res.Peer] {
+			if res.Err != nil || res.Conn == nil || res.Conn.RemotePeer() != res.Peer {
+				t.Fatalf("expected dialing %s to succeed, got %v", res.Peer, res.Err)
+			}
+		} else if res.Err == nil || res.Conn != nil {
+			t.Fatalf("expected dialing %s to fail", res.Peer)
+		}
+	}
+	if len(seen) != len(peers) {
+		t.Fatalf("expected %d results, got %d", len(peers), len(seen))
+	}
+}
+
+func TestDialConfig(t *testing.T) {
+	ctx := context.Background()
+
+	s := makeBareSwarm(ctx, t)
+	defer s.Close()
+	cfg := s.DialConfig()
+	if cfg.PerPeerLimit != DefaultPerPeerRateLimit || cfg.RateLimit != 0 || cfg.UpgradeTimeout != 0 {
+		t.Fatalf("unexpected default dial config: %+v", cfg)
+	}
+	if cfg.DialTimeout != transport.DialTimeout || cfg.DialPeerTimeout != network.DialPeerTimeout {
+		t.Fatalf("expected the global dial timeouts, got %+v", cfg)
+	}
+
+	s = makeBareSwarm(ctx, t,
+		WithDialLimits(17, 3),
+		WithDialRateLimit(20, 5),
+		WithUpgradeTimeout(2*time.Second),
+		WithDefaultHappyEyeballsDelay(250*time.Millisecond),
+	)
+	defer s.Close()
+	cfg = s.DialConfig()
+	want := DialConfig{
+		FdLimit:            17,
+		PerPeerLimit:       3,
+		RateLimit:          20,
+		RateBurst:          5,
+		DialTimeout:        transport.DialTimeout,
+		DialPeerTimeout:    network.DialPeerTimeout,
+		UpgradeTimeout:     2 * time.Second,
+		HappyEyeballsDelay: 250 * time.Millisecond,
+	}
+	if cfg != want {
+		t.Fatalf("expected dial config %+v, got %+v", want, cfg)
+	}
+}
+
+func TestMockTransportDialRetry(t *testing.T) {
+	ctx := context.Background()
+
+	mt := swarmt.NewMockTransport()
+	mt.DialLatency = 10 * time.Millisecond
+	mt.FailNextDials(1)
+	s1 := swarmt.GenSwarm(t, ctx, swarmt.OptTransport(mt), swarmt.OptDialOnly)
+	defer s1.Close()
+	s2 := swarmt.GenSwarmMem(t, ctx)
+	defer s2.Close()
+	swarmt.DivulgeAddresses(s2, s1)
+	p := s2.LocalPeer()
+
+	if _, err := s1.DialPeer(ctx, p); err == nil {
+		t.Fatal("expected the first dial to fail")
+	}
+	if n := mt.Dials(); n != 1 {
+		t.Fatalf("expected one dial, got %d", n)
+	}
+
+	// The failed address is backed off, so retrying right away doesn't dial.
+	if _, err := s1.DialPeer(ctx, p); err == nil {
+		t.Fatal("expected the retry to be backed off")
+	}
+	if n := mt.Dials(); n != 1 {
+		t.Fatalf("expected the backed off retry not to dial, got %d dials", n)
+	}
+
+	s1.Backoff().Clear(p)
+	if _, err := s1.DialPeer(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if n := mt.Dials(); n != 2 {
+		t.Fatalf("expected two dials, got %d", n)
+	}
+}
+
+func TestDialFromListenPort(t *testing.T) {
+	ctx := context.Background()
+
+	mt := swarmt.NewMockTransport()
+	mt.ReuseListenPort = true
+	s1 := swarmt.GenSwarm(t, ctx, swarmt.OptTransport(mt))
+	defer s1.Close()
+	s2 := swarmt.GenSwarmMem(t, ctx)
+	defer s2.Close()
+	p, addr := s2.LocalPeer(), s2.ListenAddresses()[0]
+
+	// A regular dial gets a fresh local port.
+	swarmt.DivulgeAddresses(s2, s1)
+	c, err := s1.DialPeer(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := s1.ListenAddresses()[0]
+	if c.LocalMultiaddr().Equal(listenAddr) {
+		t.Fatal("expected a regular dial not to use the listen port")
+	}
+
+	c, err = s1.DialFromListenPort(ctx, p, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.LocalMultiaddr().Equal(listenAddr) {
+		t.Fatalf("expected the dial to originate from %s, got %s", listenAddr, c.LocalMultiaddr())
+	}
+	if n := len(s1.ConnsToPeer(p)); n != 2 {
+		t.Fatalf("expected a second connection to the peer, got %d", n)
+	}
+
+	// Transports that can't reuse their listen port are refused.
+	if _, err := s2.DialFromListenPort(ctx, s1.LocalPeer(), listenAddr); err != ErrListenPortReuseUnsupported {
+		t.Fatalf("expected ErrListenPortReuseUnsupported, got %v", err)
+	}
+
+	// So are swarms that don't listen.
+	mt = swarmt.NewMockTransport()
+	mt.ReuseListenPort = true
+	s3 := swarmt.GenSwarm(t, ctx, swarmt.OptTransport(mt), swarmt.OptDialOnly)
+	defer s3.Close()
+	if _, err := s3.DialFromListenPort(ctx, p, addr); err != ErrNotListening {
+		t.Fatalf("expected ErrNotListening, got %v", err)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	ctx := context.Background()
+	defer func(d time.Duration) { WarmupRetryInterval = d }(WarmupRetryInterval)
+	WarmupRetryInterval = 10 * time.Millisecond
+
+	var dials int32
+	tpt := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}},
+		dialed:         func(ma.Multiaddr) { atomic.AddInt32(&dials, 1) },
+	}
+	s1 := makeSwarmWithOpts(ctx, t, WithDisableBackoff(), WithTransports(tpt))
+	defer s1.Close()
+
+	// A reachable peer gets connected.
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	w := s1.Warmup(ctx, []peer.ID{s2.LocalPeer()})
+	select {
+	case <-w.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("warmup never finished")
+	}
+	if s1.Connectedness(s2.LocalPeer()) != network.Connected {
+		t.Fatal("expected the warmed up peer to be connected")
+	}
+
+	// An unreachable one is retried until stopped.
+	p := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/udp/1"), peerstore.PermanentAddrTTL)
+	w = s1.Warmup(ctx, []peer.ID{p})
+	for i := 0; atomic.LoadInt32(&dials) < 3; i++ {
+		if i > 100 {
+			t.Fatalf("expected the peer to be retried, got %d dials", atomic.LoadInt32(&dials))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-w.Done():
+		t.Fatal("warmup gave up on an unreachable peer")
+	default:
+	}
+
+	w.Stop()
+	n := atomic.LoadInt32(&dials)
+	time.Sleep(5 * WarmupRetryInterval)
+	if atomic.LoadInt32(&dials) != n {
+		t.Fatal("expected no more dials once stopped")
+	}
+}
+
+func TestGaterUpgradedTags(t *testing.T) {
+	ctx := context.Background()
+
+	gater := swarmt.DefaultMockConnectionGater()
+	s1 := swarmt.GenSwarmMem(t, ctx, swarmt.OptConnGater(gater))
+	defer s1.Close()
+	gater.Upgraded = func(c network.Conn) GateResult {
+		if c.Stat().Direction == network.DirInbound {
+			return GateResult{Allow: true, Tags: []string{"untrusted"}}
+		}
+		return GateResult{Allow: true}
+	}
+
+	// Inbound conns are tagged.
+	s2 := swarmt.GenSwarmMem(t, ctx)
+	defer s2.Close()
+	swarmt.ConnectSwarms(t, s2, s1)
+	c := s1.ConnsToPeer(s2.LocalPeer())[0].(*Conn)
+	if !c.HasTag("untrusted") {
+		t.Fatalf("expected the inbound conn to be tagged untrusted, got tags %v", c.Tags())
+	}
+
+	// Outbound ones aren't, and may be refused.
+	s3 := swarmt.GenSwarmMem(t, ctx)
+	defer s3.Close()
+	swarmt.ConnectSwarms(t, s1, s3)
+	if tags := s1.ConnsToPeer(s3.LocalPeer())[0].(*Conn).Tags(); len(tags) != 0 {
+		t.Fatalf("expected the outbound conn not to be tagged, got %v", tags)
+	}
+
+	gater.Upgraded = func(network.Conn) GateResult { return GateResult{} }
+	s4 := swarmt.GenSwarmMem(t, ctx)
+	defer s4.Close()
+	swarmt.DivulgeAddresses(s4, s1)
+	if _, err := s1.DialPeer(ctx, s4.LocalPeer()); !errors.Is(err, ErrGaterDisallowedConn) {
+		t.Fatalf("expected ErrGaterDisallowedConn, got %v", err)
+	}
+	if len(s1.ConnsToPeer(s4.LocalPeer())) != 0 {
+		t.Fatal("expected the refused conn not to be added")
+	}
+}
+
+func TestSetConnGater(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := swarmt.GenSwarmMem(t, ctx, swarmt.OptConnGater(swarmt.DefaultMockConnectionGater()))
+	defer s1.Close()
+	s2 := swarmt.GenSwarmMem(t, ctx)
+	defer s2.Close()
+	swarmt.ConnectSwarms(t, s1, s2)
+
+	deny := &swarmt.MockConnectionGater{
+		PeerDial: func(peer.ID) bool { return false },
+		Dial:     func(peer.ID, ma.Multiaddr) bool { return false },
+		Upgraded: func(network.Conn) GateResult { return GateResult{} },
+	}
+	s1.SetConnGater(deny)
+	if s1.ConnGater() != deny {
+		t.Fatal("expected the new gater to be installed")
+	}
+
+	// New outbound dials are blocked.
+	s3 := swarmt.GenSwarmMem(t, ctx)
+	defer s3.Close()
+	swarmt.DivulgeAddresses(s3, s1)
+	if _, err := s1.DialPeer(ctx, s3.LocalPeer()); !errors.Is(err, ErrGaterDisallowedPeer) {
+		t.Fatalf("expected ErrGaterDisallowedPeer, got %v", err)
+	}
+
+	// So are new inbound ones.
+	s4 := swarmt.GenSwarmMem(t, ctx)
+	defer s4.Close()
+	swarmt.DivulgeAddresses(s1, s4)
+	s4.DialPeer(ctx, s1.LocalPeer())
+	time.Sleep(100 * time.Millisecond)
+	if len(s1.ConnsToPeer(s4.LocalPeer())) != 0 {
+		t.Fatal("expected the inbound conn to be refused")
+	}
+
+	// Existing conns persist.
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 1 {
+		t.Fatal("expected the existing conn to stay")
+	}
+
+	s1.SetConnGater(nil)
+	if _, err := s1.DialPeer(ctx, s3.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowFirstDialTransport is a MemTransport whose first dial hangs until
+// canceled.
+type slowFirstDialTransport struct {
+	*swarmt.MemTransport
+
+	dials    int32
+	firstErr chan error
+}
+
+func (t *slowFirstDialTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if atomic.AddInt32(&t.dials, 1) == 1 {
+		<-ctx.Done()
+		t.firstErr <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	return t.MemTransport.Dial(ctx, raddr, p)
+}
+
+func TestAddrHedging(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeBareSwarm(ctx, t, WithAddrHedging(1, 20*time.Millisecond))
+	defer s1.Close()
+	tpt := &slowFirstDialTransport{
+		MemTransport: swarmt.NewMemTransport(swarmt.GenUpgrader(s1)),
+		firstErr:     make(chan error, 1),
+	}
+	if err := s1.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	s2 := swarmt.GenSwarmMem(t, ctx)
+	defer s2.Close()
+	swarmt.DivulgeAddresses(s2, s1)
+
+	start := time.Now()
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > transport.DialTimeout/2 {
+		t.Fatalf("expected the hedged dial to win quickly, took %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&tpt.dials); n != 2 {
+		t.Fatalf("expected 2 dials to the address, got %d", n)
+	}
+	select {
+	case err := <-tpt.firstErr:
+		if err != context.Canceled {
+			t.Fatalf("expected the losing dial to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the losing dial to be canceled")
+	}
+}
+
+// slowDialTransport is a MemTransport counting its dials and delaying them.
+type slowDialTransport struct {
+	*swarmt.MemTransport
+
+	delay time.Duration
+	dials int32
+}
+
+func (t *slowDialTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	atomic.AddInt32(&t.dials, 1)
+	select {
+	case <-time.After(t.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return t.MemTransport.Dial(ctx, raddr, p)
+}
+
+func TestDialPeerOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeBareSwarm(ctx, t)
+	defer s1.Close()
+	tpt := &slowDialTransport{
+		MemTransport: swarmt.NewMemTransport(swarmt.GenUpgrader(s1)),
+		delay:        100 * time.Millisecond,
+	}
+	if err := s1.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	s2 := swarmt.GenSwarmMem(t, ctx)
+	defer s2.Close()
+	swarmt.DivulgeAddresses(s2, s1)
+
+	shared := make(chan network.Conn, 1)
+	go func() {
+		c, err := s1.DialPeer(ctx, s2.LocalPeer())
+		if err != nil {
+			t.Error(err)
+		}
+		shared <- c
+	}()
+	for atomic.LoadInt32(&tpt.dials) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The shared dial is in flight; DialPeerOnce doesn't wait for it.
+	once, err := s1.DialPeerOnce(ctx, s2.LocalPeer(), s2.ListenAddresses())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := <-shared; c == nil || c == once {
+		t.Fatal("expected DialPeerOnce to return its own connection")
+	}
+	if n := atomic.LoadInt32(&tpt.dials); n != 2 {
+		t.Fatalf("expected 2 dials, got %d", n)
+	}
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 2 {
+		t.Fatalf("expected 2 conns, got %d", n)
+	}
+
+	// It doesn't reuse existing connections either.
+	if _, err := s1.DialPeerOnce(ctx, s2.LocalPeer(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 3 {
+		t.Fatalf("expected 3 conns, got %d", n)
+	}
+}
+
+func TestSimultaneousConnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeSwarmWithOpts(ctx, t)
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	client, server := s1, s2
+	if s2.LocalPeer() < s1.LocalPeer() {
+		client, server = s2, s1
+	}
+
+	type outcome struct {
+		c   network.Conn
+		err error
+	}
+	results := make(chan outcome, 2)
+	connect := func(s, remote *Swarm) {
+		c, err := s.SimultaneousConnect(ctx, remote.LocalPeer(), remote.ListenAddresses()[0])
+		results <- outcome{c, err}
+	}
+	var clientConn, serverConn network.Conn
+	go connect(client, server)
+	go connect(server, client)
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.c.LocalPeer() == client.LocalPeer() {
+			clientConn = r.c
+		} else {
+			serverConn = r.c
+		}
+	}
+
+	// Both sides settled on the conn the client dialed.
+	if clientConn.Stat().Direction != network.DirOutbound || serverConn.Stat().Direction != network.DirInbound {
+		t.Fatal("expected both sides to settle on the conn dialed by the client")
+	}
+	if !clientConn.LocalMultiaddr().Equal(serverConn.RemoteMultiaddr()) ||
+		!clientConn.RemoteMultiaddr().Equal(serverConn.LocalMultiaddr()) {
+		t.Fatalf("expected both sides to return the same conn, got %s-%s and %s-%s",
+			clientConn.LocalMultiaddr(), clientConn.RemoteMultiaddr(),
+			serverConn.RemoteMultiaddr(), serverConn.LocalMultiaddr())
+	}
+
+	// The other conn gets closed.
+	for _, s := range []*Swarm{client, server} {
+		for i := 0; len(s.ConnsToPeer(s.Peers()[0])) != 1; i++ {
+			if i > 500 {
+				t.Fatalf("expected a single conn, got %d", len(s.ConnsToPeer(s.Peers()[0])))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if c := client.ConnsToPeer(server.LocalPeer())[0]; c != clientConn {
+		t.Fatal("expected the client to keep the agreed upon conn")
+	}
+	if c := server.ConnsToPeer(client.LocalPeer())[0]; c != serverConn {
+		t.Fatal("expected the server to keep the agreed upon conn")
+	}
+}
+
+func TestMaxPeerDialDuration(t *testing.T) {
+	const max = 200 * time.Millisecond
+	tpt := &hangingTransport{dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}}}
+	s := makeBareSwarm(context.Background(), t, WithMaxPeerDialDuration(max), WithTransports(tpt))
+	defer s.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/udp/1"), peerstore.PermanentAddrTTL)
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/udp/2"), peerstore.PermanentAddrTTL)
+
+	start := time.Now()
+	_, err := s.DialPeer(context.Background(), p)
+	elapsed := time.Since(start)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	// The per-address dial timeout is a second.
+	if elapsed < max || elapsed > transport.DialTimeout/2 {
+		t.Fatalf("expected the dial to give up after %s, took %s", max, elapsed)
+	}
+}
+
+func TestDialAddrTiers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var dialed []string
+	record := func(name string) {
+		mu.Lock()
+		dialed = append(dialed, name)
+		mu.Unlock()
+	}
+
+	// The TCP address plays the relay: it's only to be dialed once the
+	// (slowly failing) direct UDP address failed.
+	tierOf := func(a ma.Multiaddr) int {
+		if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			return 2
+		}
+		return 1
+	}
+	s1 := makeBareSwarm(ctx, t, WithAddrTierFunc(tierOf))
+	defer s1.Close()
+	tcpTpt := &wrapConnTransport{
+		TcpTransport: tcp.NewTCPTransport(swarmt.GenUpgrader(s1)),
+		wrap: func(c transport.CapableConn) transport.CapableConn {
+			record("relay")
+			return c
+		},
+	}
+	udpTpt := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}},
+		dialed: func(ma.Multiaddr) {
+			time.Sleep(100 * time.Millisecond)
+			record("direct failed")
+		},
+	}
+	for _, tpt := range []transport.Transport{tcpTpt, udpTpt} {
+		if err := s1.AddTransport(tpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s2 := swarmt.GenSwarm(t, ctx)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddr(s2.LocalPeer(), ma.StringCast("/ip4/127.0.0.1/udp/1234"), peerstore.PermanentAddrTTL)
+
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_TCP); err != nil {
+		t.Fatalf("expected to connect over the relay address, got %s", c.RemoteMultiaddr())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 2 || dialed[0] != "direct failed" || dialed[1] != "relay" {
+		t.Fatalf("expected the relay to be dialed after the direct address failed, got %v", dialed)
+	}
+}
+
+// hangingTransport records when addresses are dialed, and hangs until the
+// dial is canceled.
+type hangingTransport struct {
+	dummyTransport
+
+	mu     sync.Mutex
+	dialed []time.Time
+}
+
+func (ht *hangingTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	ht.mu.Lock()
+	ht.dialed = append(ht.dialed, time.Now())
+	ht.mu.Unlock()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (ht *hangingTransport) CanDial(addr ma.Multiaddr) bool {
+	return true
+}
+
+func TestHappyEyeballsDelayOverride(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tpt := &hangingTransport{dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}}}
+	s := makeBareSwarm(ctx, t, WithDefaultHappyEyeballsDelay(10*time.Millisecond), WithTransports(tpt))
+	defer s.Close()
+
+	p := tnet.RandPeerNetParamsOrFatal(t).ID
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/udp/1"), peerstore.PermanentAddrTTL)
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/udp/2"), peerstore.PermanentAddrTTL)
+
+	const delay = 300 * time.Millisecond
+	dctx, dcancel := context.WithTimeout(WithHappyEyeballsDelay(ctx, delay), 2*delay)
+	defer dcancel()
+	if _, err := s.DialPeer(dctx, p); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+
+	tpt.mu.Lock()
+	defer tpt.mu.Unlock()
+	if len(tpt.dialed) != 2 {
+		t.Fatalf("expected both addresses to be dialed, got %d dials", len(tpt.dialed))
+	}
+	if gap := tpt.dialed[1].Sub(tpt.dialed[0]); gap < delay {
+		t.Fatalf("expected the second address to be dialed after %s, was dialed after %s", delay, gap)
+	}
+}
+
+func TestNearTimeoutObserver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	observed := make(chan time.Duration, 2)
+	s1 := makeBareSwarm(ctx, t, WithNearTimeoutObserver(0.2, func(p peer.ID, remaining time.Duration) {
+		observed <- remaining
+	}))
+	defer s1.Close()
+	var slow int32
+	tpt := &wrapConnTransport{
+		TcpTransport: tcp.NewTCPTransport(swarmt.GenUpgrader(s1)),
+		wrap: func(c transport.CapableConn) transport.CapableConn {
+			if atomic.LoadInt32(&slow) == 1 {
+				time.Sleep(900 * time.Millisecond)
+			}
+			return c
+		},
+	}
+	if err := s1.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	for _, s := range swarms {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), peerstore.PermanentAddrTTL)
+	}
+
+	// A fast dial stays quiet.
+	dctx, dcancel := context.WithTimeout(ctx, time.Second)
+	defer dcancel()
+	if _, err := s1.DialPeer(dctx, swarms[0].LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case remaining := <-observed:
+		t.Fatalf("didn't expect the fast dial to be observed (%s remaining)", remaining)
+	default:
+	}
+
+	// A dial that barely makes it is observed.
+	atomic.StoreInt32(&slow, 1)
+	dctx, dcancel = context.WithTimeout(ctx, time.Second)
+	defer dcancel()
+	if _, err := s1.DialPeer(dctx, swarms[1].LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case remaining := <-observed:
+		if remaining <= 0 || remaining >= 200*time.Millisecond {
+			t.Fatalf("expected less than 200ms remaining, got %s", remaining)
+		}
+	default:
+		t.Fatal("expected the slow dial to be observed")
+	}
+}
+
+func TestNewAddrFilter(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s1.Close()
+	var udpDials int32
+	udpTpt := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}},
+		dialed:         func(ma.Multiaddr) { atomic.AddInt32(&udpDials, 1) },
+	}
+	if err := s1.AddTransport(udpTpt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Strip every UDP address.
+	s1.SetNewAddrFilter(func(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+		var out []ma.Multiaddr
+		for _, a := range addrs {
+			if _, err := a.ValueForProtocol(ma.P_UDP); err != nil {
+				out = append(out, a)
+			}
+		}
+		return out
+	})
+
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddr(s2.LocalPeer(), ma.StringCast("/ip4/127.0.0.1/udp/1234"), peerstore.PermanentAddrTTL)
+
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer with only UDP addresses has nothing left to dial.
+	p := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddr(p, ma.StringCast("/ip4/127.0.0.1/udp/1235"), peerstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, p); err == nil {
+		t.Fatal("expected dialing a peer with only stripped addresses to fail")
+	}
+
+	if n := atomic.LoadInt32(&udpDials); n != 0 {
+		t.Fatalf("expected stripped addresses never to be dialed, got %d dials", n)
+	}
+}
+
+func TestMaxPendingDials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tpt := &hangingTransport{dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}}}
+	s := makeBareSwarm(ctx, t, WithMaxPendingDials(2), WithTransports(tpt))
+	defer s.Close()
+
+	newPeer := func() peer.ID {
+		p := tnet.RandPeerNetParamsOrFatal(t).ID
+		s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/udp/1"), peerstore.PermanentAddrTTL)
+		return p
+	}
+
+	// Fill the queue with dials that hang until canceled.
+	dctx, dcancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		p := newPeer()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.DialPeer(dctx, p)
+		}()
+	}
+	for i := 0; ; i++ {
+		tpt.mu.Lock()
+		n := len(tpt.dialed)
+		tpt.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected two dials in progress, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p := newPeer()
+	start := time.Now()
+	if _, err := s.DialPeer(ctx, p); err != ErrDialQueueFull {
+		t.Fatalf("expected ErrDialQueueFull, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected the dial to fail fast, took %s", elapsed)
+	}
+
+	// Once the queue drains, dials go through again.
+	dcancel()
+	wg.Wait()
+	sctx, scancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer scancel()
+	if _, err := s.DialPeer(sctx, p); err == ErrDialQueueFull {
+		t.Fatal("expected the dial to start once the queue drained")
+	}
+}
+
+func TestStickyTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s2 := swarmt.GenSwarm(t, ctx)
+	defer s2.Close()
+	if err := s2.AddTransport(swarmt.NewMemTransport(swarmt.GenUpgrader(s2))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Listen(ma.StringCast("/memory/0")); err != nil {
+		t.Fatal(err)
+	}
+	var tcpAddrs, memAddrs []ma.Multiaddr
+	for _, a := range s2.ListenAddresses() {
+		if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			tcpAddrs = append(tcpAddrs, a)
+		} else {
+			memAddrs = append(memAddrs, a)
+		}
+	}
+
+	// Rank TCP ahead of the in-memory transport, and start dials one at a
+	// time so that the transport dialed first is the one connected over.
+	ranker := func(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+		var tcp, rest []ma.Multiaddr
+		for _, a := range addrs {
+			if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+				tcp = append(tcp, a)
+			} else {
+				rest = append(rest, a)
+			}
+		}
+		return append(tcp, rest...)
+	}
+
+	for _, sticky := range []bool{true, false} {
+		s1 := makeBareSwarm(ctx, t, WithAddrRanker(ranker), WithDialRateLimit(10, 1), WithStickyTransport(sticky))
+		defer s1.Close()
+		for _, tpt := range []transport.Transport{
+			tcp.NewTCPTransport(swarmt.GenUpgrader(s1)),
+			swarmt.NewMemTransport(swarmt.GenUpgrader(s1)),
+		} {
+			if err := s1.AddTransport(tpt); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Connect over the in-memory transport, the only one known yet.
+		p := s2.LocalPeer()
+		s1.Peerstore().AddAddrs(p, memAddrs, peerstore.PermanentAddrTTL)
+		c, err := s1.DialPeer(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := swarmt.DropConn(c); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; len(s1.ConnsToPeer(p)) != 0; i++ {
+			if i > 100 {
+				t.Fatal("dropped conn never went away")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		s1.Peerstore().AddAddrs(p, tcpAddrs, peerstore.PermanentAddrTTL)
+		c, err = s1.DialPeer(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.RemoteMultiaddr().ValueForProtocol(ma.P_TCP)
+		if overTCP := err == nil; overTCP == sticky {
+			t.Fatalf("sticky=%t: redialed over %s", sticky, c.RemoteMultiaddr())
+		}
+	}
+}
+
+func TestCurrentDialAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tpt := &hangingTransport{dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}}}
+	s := makeBareSwarm(ctx, t, WithDefaultHappyEyeballsDelay(0), WithDialLimits(0, 2), WithTransports(tpt))
+	defer s.Close()
+
+	p := tnet.RandPeerNetParamsOrFatal(t).ID
+	addrs := map[string]bool{}
+	for i := 1; i <= 3; i++ {
+		a := ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/udp/%d", i))
+		addrs[a.String()] = true
+		s.Peerstore().AddAddr(p, a, peerstore.PermanentAddrTTL)
+	}
+	if attempts := s.CurrentDialAttempts(p); len(attempts) != 0 {
+		t.Fatalf("expected no attempts before dialing, got %v", attempts)
+	}
+
+	dctx, dcancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.DialPeer(dctx, p)
+	}()
+
+	// Two dials hang, the third waits for the per peer limit.
+	var attempts []AddrDialState
+	for i := 0; ; i++ {
+		attempts = s.CurrentDialAttempts(p)
+		var dialing int
+		for _, a := range attempts {
+			if a.State == DialDialing {
+				dialing++
+			}
+		}
+		if len(attempts) == 3 && dialing == 2 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected 2 dialing and 1 queued attempts, got %v", attempts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if attempts[0].State != DialQueued {
+		t.Fatalf("expected the queued attempt first, got %v", attempts)
+	}
+	for _, a := range attempts {
+		if !addrs[a.Addr.String()] {
+			t.Fatalf("unexpected attempt for %s", a.Addr)
+		}
+		delete(addrs, a.Addr.String())
+	}
+
+	dcancel()
+	<-done
+	for i := 0; len(s.CurrentDialAttempts(p)) != 0; i++ {
+		if i > 100 {
+			t.Fatalf("expected no attempts after the dial, got %v", s.CurrentDialAttempts(p))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNetworkConditionRanking(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var dialed []ma.Multiaddr
+	tpt := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_TCP, ma.P_QUIC}},
+		dialed: func(a ma.Multiaddr) {
+			mu.Lock()
+			dialed = append(dialed, a)
+			mu.Unlock()
+		},
+	}
+	// Start dials one at a time so that their order is observable.
+	s := makeBareSwarm(ctx, t, WithDialRateLimit(10, 1), WithDisableBackoff(), WithTransports(tpt))
+	defer s.Close()
+	if c := s.NetworkCondition(); c != NetworkNormal {
+		t.Fatalf("expected the normal network condition by default, got %s", c)
+	}
+
+	p := tnet.RandPeerNetParamsOrFatal(t).ID
+	quic := ma.StringCast("/ip4/1.2.3.4/udp/1/quic")
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/tcp/1"), peerstore.PermanentAddrTTL)
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/tcp/2"), peerstore.PermanentAddrTTL)
+	s.Peerstore().AddAddr(p, quic, peerstore.PermanentAddrTTL)
+
+	s.SetNetworkCondition(NetworkMobile)
+	for i := 0; i < 3; i++ {
+		mu.Lock()
+		dialed = nil
+		mu.Unlock()
+		if _, err := s.DialPeer(ctx, p); err == nil {
+			t.Fatal("expected the dial to fail")
+		}
+		mu.Lock()
+		if len(dialed) != 3 || !dialed[0].Equal(quic) {
+			t.Fatalf("expected the QUIC address to be dialed first, got %v", dialed)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestReachabilityRanking(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var dialed []ma.Multiaddr
+	tpt := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_TCP, ma.P_CIRCUIT}},
+		dialed: func(a ma.Multiaddr) {
+			mu.Lock()
+			dialed = append(dialed, a)
+			mu.Unlock()
+		},
+	}
+	// Start dials one at a time so that their order is observable.
+	s := makeBareSwarm(ctx, t, WithDialRateLimit(10, 1), WithDisableBackoff(), WithTransports(tpt))
+	defer s.Close()
+	if r := s.Reachability(); r != network.ReachabilityUnknown {
+		t.Fatalf("expected unknown reachability by default, got %d", r)
+	}
+
+	p := tnet.RandPeerNetParamsOrFatal(t).ID
+	relay := tnet.RandPeerNetParamsOrFatal(t).ID
+	circuit := ma.StringCast("/ip4/1.2.3.4/tcp/3/p2p/" + relay.Pretty() + "/p2p-circuit")
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/tcp/1"), peerstore.PermanentAddrTTL)
+	s.Peerstore().AddAddr(p, ma.StringCast("/ip4/1.2.3.4/tcp/2"), peerstore.PermanentAddrTTL)
+	s.Peerstore().AddAddr(p, circuit, peerstore.PermanentAddrTTL)
+
+	s.SetReachability(network.ReachabilityPrivate)
+	for i := 0; i < 3; i++ {
+		mu.Lock()
+		dialed = nil
+		mu.Unlock()
+		if _, err := s.DialPeer(ctx, p); err == nil {
+			t.Fatal("expected the dial to fail")
+		}
+		mu.Lock()
+		if len(dialed) != 3 || !dialed[0].Equal(circuit) {
+			t.Fatalf("expected the relay address to be dialed first, got %v", dialed)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,135 @@
+package swarm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// RecentDisconnectsSize is the number of closed connections the swarm
+// remembers (see Swarm.RecentDisconnects).
+var RecentDisconnectsSize = 64
+
+// DisconnectReason is why a connection was closed. Applications closing
+// connections with Conn.CloseWithReason may use their own values from
+// DisconnectApplication on.
+type DisconnectReason int
+
+const (
+	// DisconnectUnspecified is the reason of connections closed with
+	// Conn.Close, or as the swarm shut down.
+	DisconnectUnspecified DisconnectReason = iota
+	// DisconnectRemote is the reason of connections closed by the remote
+	// side, or that failed.
+	DisconnectRemote
+	// DisconnectEvicted is the reason of connections closed in favor of
+	// newer ones to the same peer (see WithMaxConnsPerPeer and
+	// WithInboundDuplicateConnPolicy).
+	DisconnectEvicted
+	// DisconnectLifetimeExceeded is the reason of connections closed for
+	// outliving their maximum lifetime (see WithMaxConnLifetime).
+	DisconnectLifetimeExceeded
+
+	// DisconnectApplication is the first reason reserved for applications.
+	DisconnectApplication DisconnectReason = 1000
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectUnspecified:
+		return "unspecified"
+	case DisconnectRemote:
+		return "remote"
+	case DisconnectEvicted:
+		return "evicted"
+	case DisconnectLifetimeExceeded:
+		return "lifetime exceeded"
+	default:
+		return fmt.Sprintf("DisconnectReason(%d)", int(r))
+	}
+}
+
+// Disconnect describes a closed connection.
+type Disconnect struct {
+	Peer   peer.ID
+	Reason DisconnectReason
+	// Summary describes the connection: its addresses, direction and how
+	// long it was open.
+	Summary string
+	Closed  time.Time
+}
+
+// CloseWithReason closes the connection like Close, recording the given reason
+// (see Swarm.LastDisconnectReason). If the connection is already closing, the
+// first reason sticks.
+func (c *Conn) CloseWithReason(reason DisconnectReason) error {
+	c.setCloseReason(reason)
+	return c.Close()
+}
+
+// setCloseReason records why the connection is closing, unless a reason was
+// already recorded.
+func (c *Conn) setCloseReason(reason DisconnectReason) {
+	c.closeReason.Lock()
+	defer c.closeReason.Unlock()
+	if !c.closeReason.set {
+		c.closeReason.set = true
+		c.closeReason.reason = reason
+	}
+}
+
+// recordDisconnect remembers the closed connection. It's called when the
+// connection closes.
+func (s *Swarm) recordDisconnect(c *Conn) {
+	c.closeReason.Lock()
+	reason := c.closeReason.reason
+	c.closeReason.Unlock()
+
+	dir := "outbound"
+	if c.stat.Direction == network.DirInbound {
+		dir = "inbound"
+	}
+	now := time.Now()
+	d := Disconnect{
+		Peer:   c.RemotePeer(),
+		Reason: reason,
+		Summary: fmt.Sprintf("%s conn %s <-> %s, open for %s",
+			dir, c.LocalMultiaddr(), c.RemoteMultiaddr(), now.Sub(c.opened)),
+		Closed: now,
+	}
+
+	s.disconnects.Lock()
+	defer s.disconnects.Unlock()
+	s.disconnects.list = append(s.disconnects.list, d)
+	if n := len(s.disconnects.list) - RecentDisconnectsSize; n > 0 {
+		s.disconnects.list = append(s.disconnects.list[:0], s.disconnects.list[n:]...)
+	}
+}
+
+// LastDisconnectReason returns why the last connection to the peer closed, if
+// it's among the recently closed connections the swarm remembers (see
+// RecentDisconnects).
+func (s *Swarm) LastDisconnectReason(p peer.ID) (DisconnectReason, bool) {
+	s.disconnects.Lock()
+	defer s.disconnects.Unlock()
+	for i := len(s.disconnects.list) - 1; i >= 0; i-- {
+		if d := s.disconnects.list[i]; d.Peer == p {
+			return d.Reason, true
+		}
+	}
+	return DisconnectUnspecified, false
+}
+
+// RecentDisconnects returns the last RecentDisconnectsSize closed connections,
+// newest first.
+func (s *Swarm) RecentDisconnects() []Disconnect {
+	s.disconnects.Lock()
+	defer s.disconnects.Unlock()
+	out := make([]Disconnect, len(s.disconnects.list))
+	for i, d := range s.disconnects.list {
+		out[len(out)-1-i] = d
+	}
+	return out
+}
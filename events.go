@@ -0,0 +1,149 @@
+package swarm
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultEventBufferSize is the default number of events buffered for
+// Swarm.Events.
+const DefaultEventBufferSize = 256
+
+// EventType is the type of a swarm lifecycle event.
+type EventType int
+
+const (
+	// EventConnected is emitted when a connection is added to the swarm.
+	EventConnected EventType = iota
+	// EventDisconnected is emitted when a connection closes.
+	EventDisconnected
+	// EventListen is emitted when the swarm starts listening on an address.
+	EventListen
+	// EventListenClose is emitted when the swarm stops listening on an
+	// address.
+	EventListenClose
+	// EventDropped is emitted when events were dropped, see
+	// WithDroppedEventReports.
+	EventDropped
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventListen:
+		return "listen"
+	case EventListenClose:
+		return "listen close"
+	case EventDropped:
+		return "dropped"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a swarm lifecycle event. Peer and Conn are set for connection
+// events; Addr is the connection's remote address for connection events and
+// the listen address for listen events. Dropped is set for EventDropped
+// events.
+type Event struct {
+	Type    EventType
+	Peer    peer.ID
+	Conn    network.Conn
+	Addr    ma.Multiaddr
+	Dropped map[EventType]uint64
+}
+
+// eventBus buffers the swarm's lifecycle events. When the buffer is full, the
+// oldest event is dropped to make room.
+type eventBus struct {
+	mu      sync.Mutex
+	ch      chan Event
+	dropped uint64
+
+	// drops by event type, in total and since the last EventDropped event.
+	// Protected by mu.
+	byType     map[EventType]uint64
+	unreported map[EventType]uint64
+	report     bool
+}
+
+func newEventBus(size int, report bool) *eventBus {
+	return &eventBus{
+		ch:     make(chan Event, size),
+		byType: make(map[EventType]uint64),
+		report: report,
+	}
+}
+
+func (eb *eventBus) publish(evt Event) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	// The consumer caught up: tell it what it missed, if there's room for
+	// both the report and the event.
+	if eb.report && len(eb.unreported) > 0 && len(eb.ch) == 0 && cap(eb.ch) > 1 {
+		eb.ch <- Event{Type: EventDropped, Dropped: eb.unreported}
+		eb.unreported = nil
+	}
+	for {
+		select {
+		case eb.ch <- evt:
+			return
+		default:
+		}
+		select {
+		case old := <-eb.ch:
+			atomic.AddUint64(&eb.dropped, 1)
+			eb.byType[old.Type]++
+			if eb.report {
+				if eb.unreported == nil {
+					eb.unreported = make(map[EventType]uint64)
+				}
+				eb.unreported[old.Type]++
+			}
+		default:
+		}
+	}
+}
+
+func (s *Swarm) publishConnEvent(t EventType, c *Conn) {
+	s.events.publish(Event{
+		Type: t,
+		Peer: c.RemotePeer(),
+		Conn: c,
+		Addr: c.RemoteMultiaddr(),
+	})
+}
+
+// Events returns the channel the swarm delivers its lifecycle events on, in
+// the order they happened. The channel is shared by all callers and buffered
+// (see WithEventBufferSize); when the buffer is full, the oldest events are
+// dropped and counted (see DroppedEvents).
+func (s *Swarm) Events() <-chan Event {
+	return s.events.ch
+}
+
+// DroppedEvents returns the number of events dropped because the events buffer
+// was full.
+func (s *Swarm) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&s.events.dropped)
+}
+
+// EventDropStats returns the number of events dropped because the events
+// buffer was full, by event type. The counts never decrease.
+func (s *Swarm) EventDropStats() map[EventType]uint64 {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	stats := make(map[EventType]uint64, len(s.events.byType))
+	for t, n := range s.events.byType {
+		stats[t] = n
+	}
+	return stats
+}
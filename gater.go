@@ -0,0 +1,88 @@
+package swarm
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ConnectionGater decides which outbound connections the swarm may attempt.
+// Dials it refuses fail with ErrGaterDisallowedPeer or ErrGaterDisallowedAddr.
+type ConnectionGater interface {
+	// InterceptPeerDial tests whether we may dial the given peer at all.
+	InterceptPeerDial(p peer.ID) (allow bool)
+
+	// InterceptAddrDial tests whether we may dial the given peer on the given
+	// address.
+	InterceptAddrDial(p peer.ID, addr ma.Multiaddr) (allow bool)
+}
+
+// UpgradedConnGater is implemented by connection gaters that also vet
+// connections, inbound and outbound, once they're secured and multiplexed but
+// before they're added to the swarm. Connections it refuses are closed, and
+// fail to be dialed with ErrGaterDisallowedConn.
+type UpgradedConnGater interface {
+	ConnectionGater
+
+	// InterceptUpgraded decides whether the swarm may add the connection.
+	InterceptUpgraded(c network.Conn) GateResult
+}
+
+// GateResult is the decision of UpgradedConnGater.InterceptUpgraded.
+type GateResult struct {
+	Allow bool
+	// Tags are attached to the connection when it's allowed, for later
+	// policy decisions (see Conn.Tags).
+	Tags []string
+}
+
+// SetConnGater replaces the connection gater (see WithConnectionGater), nil
+// to allow everything. The new gater applies to the dials and connections
+// gated from then on; dials and connections that already passed the gate
+// aren't affected.
+func (s *Swarm) SetConnGater(g ConnectionGater) {
+	s.gater.Lock()
+	defer s.gater.Unlock()
+	s.gater.g = g
+}
+
+// ConnGater returns the connection gater, nil if there's none.
+func (s *Swarm) ConnGater() ConnectionGater {
+	s.gater.RLock()
+	defer s.gater.RUnlock()
+	return s.gater.g
+}
+
+// gateUpgraded returns the gater's (if any) decision on the connection.
+func (s *Swarm) gateUpgraded(c *Conn) GateResult {
+	g, ok := s.ConnGater().(UpgradedConnGater)
+	if !ok {
+		return GateResult{Allow: true}
+	}
+	return g.InterceptUpgraded(c)
+}
+
+// gatePeer returns true if the gater (if any) allows dialing the peer.
+func (s *Swarm) gatePeer(p peer.ID) bool {
+	g := s.ConnGater()
+	return g == nil || g.InterceptPeerDial(p)
+}
+
+// gateAddrs returns the addresses the gater (if any) allows dialing the peer
+// on.
+func (s *Swarm) gateAddrs(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	g := s.ConnGater()
+	if g == nil {
+		return addrs
+	}
+	allowed := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if g.InterceptAddrDial(p, a) {
+			allowed = append(allowed, a)
+		} else {
+			log.Debugf("gater disallowed outbound connection to %s on %s", p, a)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,147 @@
+package swarm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// WithConnIdleCallback sets a callback called when a connection has had no
+// streams for the given duration. It's called once per idle period: a
+// connection only becomes idle again after it got a stream (see
+// WithConnActiveCallback). Connections aren't closed when idle.
+//
+// Callbacks are called from their own goroutine, one at a time and in order
+// for a given connection.
+func WithConnIdleCallback(d time.Duration, idle func(network.Conn)) Option {
+	return func(s *Swarm) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout must be positive, got %s", d)
+		}
+		s.idleTimeout = d
+		s.onConnIdle = idle
+		return nil
+	}
+}
+
+// WithConnActiveCallback sets a callback called when a connection reported
+// idle (see WithConnIdleCallback) gets a stream again.
+func WithConnActiveCallback(active func(network.Conn)) Option {
+	return func(s *Swarm) error {
+		s.onConnActive = active
+		return nil
+	}
+}
+
+// connIdleState tracks whether a connection is idle.
+type connIdleState struct {
+	sync.Mutex
+
+	// incremented whenever the idle timer is armed or disarmed, so that a
+	// timer firing late can tell it's stale.
+	gen    uint64
+	timer  *time.Timer
+	idle   bool
+	closed bool
+
+	// idle transitions (true for idle, false for active) waiting for their
+	// callback, and whether a goroutine is calling them.
+	pending     []bool
+	dispatching bool
+}
+
+// streamsIdle arms the idle timer. It's called when the connection is left
+// without streams.
+func (c *Conn) streamsIdle() {
+	if c.swarm.idleTimeout <= 0 {
+		return
+	}
+	c.idle.Lock()
+	defer c.idle.Unlock()
+	if c.idle.closed || c.idle.idle {
+		return
+	}
+	c.idle.gen++
+	gen := c.idle.gen
+	if c.idle.timer != nil {
+		c.idle.timer.Stop()
+	}
+	c.idle.timer = time.AfterFunc(c.swarm.idleTimeout, func() {
+		c.idleTimerFired(gen)
+	})
+}
+
+// streamsActive disarms the idle timer, reporting the connection active if it
+// was idle. It's called when the connection gets its first stream.
+func (c *Conn) streamsActive() {
+	if c.swarm.idleTimeout <= 0 {
+		return
+	}
+	c.idle.Lock()
+	defer c.idle.Unlock()
+	c.idle.gen++
+	if c.idle.timer != nil {
+		c.idle.timer.Stop()
+		c.idle.timer = nil
+	}
+	if c.idle.idle && !c.idle.closed {
+		c.idle.idle = false
+		c.queueIdleTransitionLocked(false)
+	}
+}
+
+func (c *Conn) idleTimerFired(gen uint64) {
+	c.idle.Lock()
+	defer c.idle.Unlock()
+	if gen != c.idle.gen || c.idle.closed || c.idle.idle {
+		return
+	}
+	c.idle.idle = true
+	c.idle.timer = nil
+	c.queueIdleTransitionLocked(true)
+}
+
+// stopIdleTracking stops reporting the connection idle or active. It's called
+// when the connection closes.
+func (c *Conn) stopIdleTracking() {
+	c.idle.Lock()
+	defer c.idle.Unlock()
+	c.idle.closed = true
+	c.idle.gen++
+	if c.idle.timer != nil {
+		c.idle.timer.Stop()
+		c.idle.timer = nil
+	}
+}
+
+func (c *Conn) queueIdleTransitionLocked(idle bool) {
+	c.idle.pending = append(c.idle.pending, idle)
+	if !c.idle.dispatching {
+		c.idle.dispatching = true
+		go c.dispatchIdleTransitions()
+	}
+}
+
+func (c *Conn) dispatchIdleTransitions() {
+	for {
+		c.idle.Lock()
+		if len(c.idle.pending) == 0 {
+			c.idle.dispatching = false
+			c.idle.Unlock()
+			return
+		}
+		idle := c.idle.pending[0]
+		c.idle.pending = c.idle.pending[1:]
+		c.idle.Unlock()
+
+		cb := c.swarm.onConnActive
+		if idle {
+			cb = c.swarm.onConnIdle
+		}
+		if cb != nil {
+			cb(c)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnLifetimeDrainTimeout is how long a connection that outlived its maximum
+// lifetime (see WithMaxConnLifetime) is given to drain its streams before it's
+// closed anyway.
+var ConnLifetimeDrainTimeout = time.Minute
+
+// WithMaxConnLifetime bounds how long connections live: once a connection has
+// been open for d, it's drained (see Conn.Drain) and closed, so the next
+// stream to the peer gets a fresh connection. Connections can be exempted with
+// Conn.SetLifetimeExempt.
+func WithMaxConnLifetime(d time.Duration) Option {
+	return func(s *Swarm) error {
+		if d <= 0 {
+			return fmt.Errorf("max conn lifetime must be positive, got %s", d)
+		}
+		s.maxConnLifetime = d
+		return nil
+	}
+}
+
+// connLifetimeState tracks whether a connection outlived its maximum lifetime.
+type connLifetimeState struct {
+	sync.Mutex
+
+	timer   *time.Timer
+	expired bool
+	exempt  bool
+	closed  bool
+}
+
+// SetLifetimeExempt exempts the connection from the swarm's maximum connection
+// lifetime (see WithMaxConnLifetime), or lifts the exemption. A connection
+// that already outlived its lifetime is drained as soon as the exemption is
+// lifted.
+func (c *Conn) SetLifetimeExempt(exempt bool) {
+	c.lifetime.Lock()
+	c.lifetime.exempt = exempt
+	expire := !exempt && c.lifetime.expired && !c.lifetime.closed
+	c.lifetime.Unlock()
+	if expire {
+		go c.drainExpired()
+	}
+}
+
+// startLifetime arms the lifetime timer. It's called once the connection is
+// registered.
+func (c *Conn) startLifetime() {
+	if c.swarm.maxConnLifetime <= 0 {
+		return
+	}
+	c.lifetime.Lock()
+	defer c.lifetime.Unlock()
+	if c.lifetime.closed {
+		return
+	}
+	c.lifetime.timer = time.AfterFunc(c.swarm.maxConnLifetime, c.lifetimeExpired)
+}
+
+func (c *Conn) lifetimeExpired() {
+	c.lifetime.Lock()
+	c.lifetime.expired = true
+	expire := !c.lifetime.exempt && !c.lifetime.closed
+	c.lifetime.Unlock()
+	if expire {
+		c.drainExpired()
+	}
+}
+
+func (c *Conn) drainExpired() {
+	log.Debugf("closing %s: max lifetime of %s reached", c, c.swarm.maxConnLifetime)
+	ctx, cancel := context.WithTimeout(c.swarm.ctx, ConnLifetimeDrainTimeout)
+	defer cancel()
+	c.setCloseReason(DisconnectLifetimeExceeded)
+	c.Drain(ctx)
+}
+
+// stopLifetime disarms the lifetime timer. It's called when the connection
+// closes.
+func (c *Conn) stopLifetime() {
+	c.lifetime.Lock()
+	defer c.lifetime.Unlock()
+	c.lifetime.closed = true
+	if c.lifetime.timer != nil {
+		c.lifetime.timer.Stop()
+		c.lifetime.timer = nil
+	}
+}
@@ -3,6 +3,7 @@ package swarm
 import (
 	"context"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -18,6 +19,8 @@ type dialResult struct {
 	Conn transport.CapableConn
 	Addr ma.Multiaddr
 	Err  error
+	// time spent waiting in the limiter before dialing
+	Wait time.Duration
 }
 
 type dialJob struct {
@@ -25,6 +28,12 @@ type dialJob struct {
 	peer peer.ID
 	ctx  context.Context
 	resp chan dialResult
+
+	// when the job was handed to the limiter
+	queued time.Time
+
+	// set once the dial function is called, under the limiter lock.
+	dialing bool
 }
 
 func (dj *dialJob) cancelled() bool {
@@ -52,6 +61,106 @@ type dialLimiter struct {
 	activePerPeer      map[peer.ID]int
 	perPeerLimit       int
 	waitingOnPeerLimit map[peer.ID][]*dialJob
+
+	// dials per exact address (across peers), 0 for no limit. Keyed by the
+	// address bytes.
+	activePerAddr      map[string]int
+	perAddrLimit       int
+	waitingOnAddrLimit map[string][]*dialJob
+
+	// started jobs, until they're finished.
+	running map[peer.ID]map[*dialJob]struct{}
+
+	// limits how fast dials start, nil for no limit. Jobs wait out their
+	// delay in waitingOnRate, before taking any of the other tokens.
+	rate          *dialRateLimiter
+	waitingOnRate map[*dialJob]struct{}
+
+	// overrides the per address dial timeout, 0 for the default.
+	dialTimeout time.Duration
+
+	// reports whether dialing an address consumes a file descriptor.
+	fdCostly func(ma.Multiaddr) bool
+}
+
+// dialRateLimiter limits the rate at which new dials start, swarm-wide. It's
+// a token bucket (implemented as a GCRA) allowing bursts of up to burst dials.
+type dialRateLimiter struct {
+	mu        sync.Mutex
+	perSecond int
+	interval  time.Duration
+	burst     int
+	// theoretical arrival time of the next dial
+	tat time.Time
+}
+
+func newDialRateLimiter(perSecond, burst int) *dialRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &dialRateLimiter{
+		perSecond: perSecond,
+		interval:  time.Second / time.Duration(perSecond),
+		burst:     burst,
+	}
+}
+
+// reserve takes a token, returning how long the caller must wait before
+// using it.
+func (r *dialRateLimiter) reserve() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	tat := r.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	r.tat = tat.Add(r.interval)
+
+	wait := tat.Sub(now) - time.Duration(r.burst-1)*r.interval
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// refund gives back a token reserved but never used.
+func (r *dialRateLimiter) refund() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tat = r.tat.Add(-r.interval)
+}
+
+// startDial starts the dial job, once it holds all its tokens.
+func (dl *dialLimiter) startDial(dj *dialJob) {
+	jobs := dl.running[dj.peer]
+	if jobs == nil {
+		jobs = make(map[*dialJob]struct{})
+		dl.running[dj.peer] = jobs
+	}
+	jobs[dj] = struct{}{}
+	go dl.executeDial(dj)
+}
+
+// waitRate waits out the dial job's rate limiter delay before handing it to
+// the other limits. If the job is canceled first, its rate token is refunded.
+func (dl *dialLimiter) waitRate(dj *dialJob, delay time.Duration) {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-dj.ctx.Done():
+		dl.rate.refund()
+	}
+
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+	delete(dl.waitingOnRate, dj)
+	if dj.cancelled() {
+		return
+	}
+	dl.addCheckPeerLimit(dj)
 }
 
 type dialfunc func(context.Context, peer.ID, ma.Multiaddr) (transport.CapableConn, error)
@@ -72,7 +181,12 @@ func newDialLimiterWithParams(df dialfunc, fdLimit, perPeerLimit int) *dialLimit
 		perPeerLimit:       perPeerLimit,
 		waitingOnPeerLimit: make(map[peer.ID][]*dialJob),
 		activePerPeer:      make(map[peer.ID]int),
+		waitingOnAddrLimit: make(map[string][]*dialJob),
+		activePerAddr:      make(map[string]int),
+		running:            make(map[peer.ID]map[*dialJob]struct{}),
+		waitingOnRate:      make(map[*dialJob]struct{}),
 		dialFunc:           df,
+		fdCostly:           addrutil.IsFDCostlyTransport,
 	}
 }
 
@@ -94,13 +208,14 @@ func (dl *dialLimiter) freeFDToken() {
 
 		// Skip over canceled dials instead of queuing up a goroutine.
 		if next.cancelled() {
+			dl.freeAddrToken(next)
 			dl.freePeerToken(next)
 			continue
 		}
 		dl.fdConsuming++
 
 		// we already have activePerPeer token at this point so we can just dial
-		go dl.executeDial(next)
+		dl.startDial(next)
 		return
 	}
 }
@@ -132,6 +247,41 @@ func (dl *dialLimiter) freePeerToken(dj *dialJob) {
 
 		dl.activePerPeer[next.peer]++ // just kidding, we still want this token
 
+		dl.addCheckAddrLimit(next)
+		return
+	}
+}
+
+func (dl *dialLimiter) freeAddrToken(dj *dialJob) {
+	if dl.perAddrLimit <= 0 {
+		return
+	}
+	key := string(dj.addr.Bytes())
+	dl.activePerAddr[key]--
+	if dl.activePerAddr[key] == 0 {
+		delete(dl.activePerAddr, key)
+	}
+
+	waitlist := dl.waitingOnAddrLimit[key]
+	for len(waitlist) > 0 {
+		next := waitlist[0]
+		waitlist[0] = nil // clear out memory
+		waitlist = waitlist[1:]
+
+		if len(waitlist) == 0 {
+			delete(dl.waitingOnAddrLimit, key)
+		} else {
+			dl.waitingOnAddrLimit[key] = waitlist
+		}
+
+		// Canceled dials hold a peer token, give it back.
+		if next.cancelled() {
+			dl.freePeerToken(next)
+			continue
+		}
+
+		dl.activePerAddr[key]++
+
 		dl.addCheckFdLimit(next)
 		return
 	}
@@ -141,15 +291,23 @@ func (dl *dialLimiter) finishedDial(dj *dialJob) {
 	dl.lk.Lock()
 	defer dl.lk.Unlock()
 
-	if addrutil.IsFDCostlyTransport(dj.addr) {
+	if jobs := dl.running[dj.peer]; jobs != nil {
+		delete(jobs, dj)
+		if len(jobs) == 0 {
+			delete(dl.running, dj.peer)
+		}
+	}
+
+	if dl.fdCostly(dj.addr) {
 		dl.freeFDToken()
 	}
 
+	dl.freeAddrToken(dj)
 	dl.freePeerToken(dj)
 }
 
 func (dl *dialLimiter) addCheckFdLimit(dj *dialJob) {
-	if addrutil.IsFDCostlyTransport(dj.addr) {
+	if dl.fdCostly(dj.addr) {
 		if dl.fdConsuming >= dl.fdLimit {
 			log.Debugf("[limiter] blocked dial waiting on FD token; peer: %s; addr: %s; consuming: %d; "+
 				"limit: %d; waiting: %d", dj.peer, dj.addr, dl.fdConsuming, dl.fdLimit, len(dl.waitingOnFd))
@@ -165,7 +323,7 @@ func (dl *dialLimiter) addCheckFdLimit(dj *dialJob) {
 
 	log.Debugf("[limiter] executing dial; peer: %s; addr: %s; FD consuming: %d; waiting: %d",
 		dj.peer, dj.addr, dl.fdConsuming, len(dl.waitingOnFd))
-	go dl.executeDial(dj)
+	dl.startDial(dj)
 }
 
 func (dl *dialLimiter) addCheckPeerLimit(dj *dialJob) {
@@ -179,30 +337,127 @@ func (dl *dialLimiter) addCheckPeerLimit(dj *dialJob) {
 	}
 	dl.activePerPeer[dj.peer]++
 
+	dl.addCheckAddrLimit(dj)
+}
+
+func (dl *dialLimiter) addCheckAddrLimit(dj *dialJob) {
+	if dl.perAddrLimit > 0 {
+		key := string(dj.addr.Bytes())
+		if dl.activePerAddr[key] >= dl.perAddrLimit {
+			log.Debugf("[limiter] blocked dial waiting on address limit; peer: %s; addr: %s; active: %d; "+
+				"addr limit: %d; waiting: %d", dj.peer, dj.addr, dl.activePerAddr[key], dl.perAddrLimit,
+				len(dl.waitingOnAddrLimit[key]))
+			dl.waitingOnAddrLimit[key] = append(dl.waitingOnAddrLimit[key], dj)
+			return
+		}
+		dl.activePerAddr[key]++
+	}
+
 	dl.addCheckFdLimit(dj)
 }
 
 // AddDialJob tries to take the needed tokens for starting the given dial job.
 // If it acquires all needed tokens, it immediately starts the dial, otherwise
 // it will put it on the waitlist for the requested token.
+//
+// When rate limited, the job first waits for its rate token, without holding
+// any of the others. Rate tokens are reserved under the limiter lock so jobs
+// get them in the order they're added.
 func (dl *dialLimiter) AddDialJob(dj *dialJob) {
 	dl.lk.Lock()
 	defer dl.lk.Unlock()
 
 	log.Debugf("[limiter] adding a dial job through limiter: %v", dj.addr)
+	dj.queued = time.Now()
+	if dl.rate != nil {
+		if delay := dl.rate.reserve(); delay > 0 {
+			log.Debugf("[limiter] delaying dial by %s for the rate limit; peer: %s; addr: %s", delay, dj.peer, dj.addr)
+			dl.waitingOnRate[dj] = struct{}{}
+			go dl.waitRate(dj, delay)
+			return
+		}
+	}
 	dl.addCheckPeerLimit(dj)
 }
 
-func (dl *dialLimiter) clearAllPeerDials(p peer.ID) {
+// clearPeerDials drops the dial jobs to the peer waiting on the peer limit
+// that report to resp. Other dials to the peer may be queued alongside them
+// (e.g. by DialPeerBestEffort), so they're left alone.
+func (dl *dialLimiter) clearPeerDials(p peer.ID, resp chan dialResult) {
 	dl.lk.Lock()
 	defer dl.lk.Unlock()
-	delete(dl.waitingOnPeerLimit, p)
-	log.Debugf("[limiter] clearing all peer dials: %v", p)
+	log.Debugf("[limiter] clearing peer dials: %v", p)
+	waitlist := dl.waitingOnPeerLimit[p][:0]
+	for _, dj := range dl.waitingOnPeerLimit[p] {
+		if dj.resp != resp {
+			waitlist = append(waitlist, dj)
+		}
+	}
+	if len(waitlist) == 0 {
+		delete(dl.waitingOnPeerLimit, p)
+	} else {
+		dl.waitingOnPeerLimit[p] = waitlist
+	}
 	// NB: the waitingOnFd list doesn't need to be cleaned out here, we will
 	// remove them as we encounter them because they are 'cancelled' at this
 	// point
 }
 
+// dialStates returns the state of the dials to the peer the limiter is
+// handling: queued ones first, in the order they'd start, then started ones.
+func (dl *dialLimiter) dialStates(p peer.ID) []AddrDialState {
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+
+	var states []AddrDialState
+	add := func(dj *dialJob, state DialState) {
+		if !dj.cancelled() {
+			states = append(states, AddrDialState{Addr: dj.addr, State: state, Queued: dj.queued})
+		}
+	}
+	for _, dj := range dl.waitingOnPeerLimit[p] {
+		add(dj, DialQueued)
+	}
+	for _, waitlist := range dl.waitingOnAddrLimit {
+		for _, dj := range waitlist {
+			if dj.peer == p {
+				add(dj, DialQueued)
+			}
+		}
+	}
+	for _, dj := range dl.waitingOnFd {
+		if dj.peer == p {
+			add(dj, DialQueued)
+		}
+	}
+	// Jobs waiting on the rate limit go behind the others, in the order they
+	// were added.
+	delayed := len(states)
+	for dj := range dl.waitingOnRate {
+		if dj.peer == p {
+			add(dj, DialQueued)
+		}
+	}
+	sortDialStates(states[delayed:])
+	queued := len(states)
+	for dj := range dl.running[p] {
+		state := DialQueued
+		if dj.dialing {
+			state = DialDialing
+		}
+		add(dj, state)
+	}
+	// Report started dials in a stable order.
+	sortDialStates(states[queued:])
+	return states
+}
+
+func sortDialStates(states []AddrDialState) {
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Queued.Before(states[j].Queued)
+	})
+}
+
 // executeDial calls the dialFunc, and reports the result through the response
 // channel when finished. Once the response is sent it also releases all tokens
 // it held during the dial.
@@ -211,13 +466,21 @@ func (dl *dialLimiter) executeDial(j *dialJob) {
 	if j.cancelled() {
 		return
 	}
+	wait := time.Since(j.queued)
 
-	dctx, cancel := context.WithTimeout(j.ctx, j.dialTimeout())
+	timeout := j.dialTimeout()
+	if dl.dialTimeout > 0 {
+		timeout = dl.dialTimeout
+	}
+	dctx, cancel := context.WithTimeout(j.ctx, timeout)
 	defer cancel()
 
+	dl.lk.Lock()
+	j.dialing = true
+	dl.lk.Unlock()
 	con, err := dl.dialFunc(dctx, j.peer, j.addr)
 	select {
-	case j.resp <- dialResult{Conn: con, Addr: j.addr, Err: err}:
+	case j.resp <- dialResult{Conn: con, Addr: j.addr, Err: err, Wait: wait}:
 	case <-j.ctx.Done():
 		if err == nil {
 			con.Close()
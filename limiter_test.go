@@ -386,3 +386,230 @@ func TestFDLimitUnderflow(t *testing.T) {
 		t.Fatalf("l.fdConsuming < 0")
 	}
 }
+
+func TestDialRateLimit(t *testing.T) {
+	var mu sync.Mutex
+	var dials []time.Time
+	df := func(ctx context.Context, p peer.ID, a ma.Multiaddr) (transport.CapableConn, error) {
+		mu.Lock()
+		dials = append(dials, time.Now())
+		mu.Unlock()
+		return nil, fmt.Errorf("test bad dial")
+	}
+
+	const (
+		rate  = 20
+		burst = 5
+		n     = 25
+	)
+	l := newDialLimiterWithParams(df, n, n)
+	l.rate = newDialRateLimiter(rate, burst)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := make(chan dialResult, n)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		tryDialAddrs(ctx, l, peer.ID(fmt.Sprintf("testpeer%d", i)), []ma.Multiaddr{addrWithPort(t, i+1)}, res)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-res:
+		case <-time.After(5 * time.Second):
+			t.Fatal("dials took too long")
+		}
+	}
+
+	// The burst goes out immediately, the rest at the configured rate.
+	mu.Lock()
+	defer mu.Unlock()
+	expected := time.Duration(n-burst) * time.Second / rate
+	if elapsed := time.Since(start); elapsed < expected*9/10 || elapsed > 2*expected {
+		t.Fatalf("expected dials to take about %s, took %s", expected, elapsed)
+	}
+	immediate := 0
+	for _, d := range dials {
+		if d.Sub(start) < time.Second/rate/2 {
+			immediate++
+		}
+	}
+	if immediate != burst {
+		t.Fatalf("expected %d immediate dials, got %d", burst, immediate)
+	}
+}
+
+func TestDialRateLimitCanceled(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []ma.Multiaddr
+	df := func(ctx context.Context, p peer.ID, a ma.Multiaddr) (transport.CapableConn, error) {
+		mu.Lock()
+		dialed = append(dialed, a)
+		mu.Unlock()
+		return nil, fmt.Errorf("test bad dial")
+	}
+
+	const interval = 200 * time.Millisecond
+	l := newDialLimiterWithParams(df, 1, 1)
+	l.rate = newDialRateLimiter(int(time.Second/interval), 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := make(chan dialResult, 3)
+	// The first dial takes the only rate token, the second has to wait for
+	// the next one.
+	tryDialAddrs(ctx, l, peer.ID("testpeer1"), []ma.Multiaddr{addrWithPort(t, 1)}, res)
+	cctx, ccancel := context.WithCancel(ctx)
+	tryDialAddrs(cctx, l, peer.ID("testpeer2"), []ma.Multiaddr{addrWithPort(t, 2)}, res)
+
+	// It doesn't hold any other token in the meantime.
+	l.lk.Lock()
+	waiting, active := len(l.waitingOnRate), l.activePerPeer[peer.ID("testpeer2")]
+	l.lk.Unlock()
+	if waiting != 1 || active != 0 {
+		t.Fatalf("expected the delayed dial to only wait on the rate limit, %d waiting, %d active", waiting, active)
+	}
+
+	// Canceling it gives its rate token back: the next dial gets it.
+	ccancel()
+	<-res
+	time.Sleep(20 * time.Millisecond)
+	tryDialAddrs(ctx, l, peer.ID("testpeer3"), []ma.Multiaddr{addrWithPort(t, 3)}, res)
+	select {
+	case r := <-res:
+		if !r.Addr.Equal(addrWithPort(t, 3)) {
+			t.Fatalf("unexpected dial to %s", r.Addr)
+		}
+		if r.Wait > interval*3/2 {
+			t.Fatalf("expected the dial to wait at most %s, waited %s", interval, r.Wait)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial took too long")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, a := range dialed {
+		if a.Equal(addrWithPort(t, 2)) {
+			t.Fatal("expected the canceled dial not to happen")
+		}
+	}
+}
+
+func TestDialLimiterWait(t *testing.T) {
+	release := make(chan struct{})
+	df := func(ctx context.Context, p peer.ID, a ma.Multiaddr) (transport.CapableConn, error) {
+		if a.Equal(addrWithPort(t, 1)) {
+			<-release
+		}
+		return nil, fmt.Errorf("test bad dial")
+	}
+	l := newDialLimiterWithParams(df, 10, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := make(chan dialResult, 2)
+	p := peer.ID("testpeer")
+	// The first dial takes the only peer token; the second waits for it.
+	tryDialAddrs(ctx, l, p, []ma.Multiaddr{addrWithPort(t, 1), addrWithPort(t, 2)}, res)
+
+	const blocked = 100 * time.Millisecond
+	time.Sleep(blocked)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-res:
+			if r.Addr.Equal(addrWithPort(t, 1)) {
+				if r.Wait >= blocked {
+					t.Fatalf("expected the first dial not to wait, waited %s", r.Wait)
+				}
+				continue
+			}
+			if r.Wait < blocked || r.Wait > 5*blocked {
+				t.Fatalf("expected the second dial to wait about %s, waited %s", blocked, r.Wait)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("dials took too long")
+		}
+	}
+}
+
+func TestPerAddrDialLimit(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive int
+	hang := make(chan struct{})
+	df := func(ctx context.Context, p peer.ID, a ma.Multiaddr) (transport.CapableConn, error) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		select {
+		case <-hang:
+		case <-ctx.Done():
+		}
+		return nil, fmt.Errorf("test bad dial")
+	}
+	l := newDialLimiterWithParams(df, ConcurrentFdDials, 4)
+	l.perAddrLimit = 2
+
+	addr := addrWithPort(t, 1)
+	ctx := context.Background()
+	resch := make(chan dialResult)
+
+	// A canceled dial waiting on the address limit must give its tokens back.
+	cctx, cancel := context.WithCancel(ctx)
+	for i := 0; i < 5; i++ {
+		dctx := ctx
+		if i == 2 {
+			dctx = cctx
+		}
+		l.AddDialJob(&dialJob{ctx: dctx, peer: peer.ID(fmt.Sprintf("testpeer%d", i)), addr: addr, resp: resch})
+	}
+	cancel()
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	if active != 2 {
+		t.Fatalf("expected 2 dials to the address to be running, got %d", active)
+	}
+	mu.Unlock()
+
+	for i := 0; i < 4; i++ {
+		hang <- struct{}{}
+		select {
+		case r := <-resch:
+			if r.Err == nil {
+				t.Fatal("expected the dial to fail")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for dial completion")
+		}
+	}
+
+	mu.Lock()
+	if maxActive != 2 {
+		t.Fatalf("expected at most 2 concurrent dials to the address, got %d", maxActive)
+	}
+	mu.Unlock()
+
+	// Tokens are released right after the results are sent.
+	for i := 0; ; i++ {
+		l.lk.Lock()
+		released := len(l.activePerAddr) == 0 && len(l.activePerPeer) == 0
+		l.lk.Unlock()
+		if released {
+			break
+		}
+		if i > 100 {
+			t.Fatal("expected all tokens to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,11 +2,16 @@ package swarm_test
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/transport"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	"github.com/libp2p/go-tcp-transport"
 
 	ma "github.com/multiformats/go-multiaddr"
 
@@ -70,3 +75,608 @@ func TestPeers(t *testing.T) {
 	test(s1)
 	test(s2)
 }
+
+func TestMaxConnsPerPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeSwarmWithOpts(ctx, t, WithMaxConnsPerPeer(3))
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+
+	// Dial directly over the transport so that s1 sees several distinct
+	// inbound connections from s2.
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+	waitForConns := func(n int) {
+		for i := 0; len(s1.ConnsToPeer(s2.LocalPeer())) != n; i++ {
+			if i > 100 {
+				t.Fatalf("expected %d conns, have %d", n, len(s1.ConnsToPeer(s2.LocalPeer())))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	var oldest network.Conn
+	for i := 0; i < 4; i++ {
+		c, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if i < 3 {
+			waitForConns(i + 1)
+		}
+		if i == 0 {
+			oldest = s1.ConnsToPeer(s2.LocalPeer())[0]
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	waitForConns(3)
+	for _, c := range s1.ConnsToPeer(s2.LocalPeer()) {
+		if c == oldest {
+			t.Fatal("expected the oldest conn to be closed")
+		}
+	}
+}
+
+func TestMaxConnsPerPeerEvictsLRU(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeSwarmWithOpts(ctx, t, WithMaxConnsPerPeer(3))
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+	var dialed []transport.CapableConn
+	defer func() {
+		for _, c := range dialed {
+			c.Close()
+		}
+	}()
+	dial := func() {
+		c, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialed = append(dialed, c)
+	}
+	for i := 0; i < 3; i++ {
+		dial()
+		for j := 0; len(s1.ConnsToPeer(s2.LocalPeer())) != i+1; j++ {
+			if j > 100 {
+				t.Fatalf("expected %d conns, have %d", i+1, len(s1.ConnsToPeer(s2.LocalPeer())))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	conns := s1.ConnsToPeer(s2.LocalPeer())
+
+	// The oldest conn was used last and the next one is acquired, so the
+	// newest is evicted.
+	time.Sleep(10 * time.Millisecond)
+	str, err := conns[0].NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	str.Reset()
+	release := conns[1].(*Conn).Acquire()
+	defer release()
+
+	dial()
+	for i := 0; ; i++ {
+		current := s1.ConnsToPeer(s2.LocalPeer())
+		if len(current) == 3 && current[0] == conns[0] && current[1] == conns[1] {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected the least recently used conn to be evicted, have %v", current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInboundDuplicateConnPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy InboundDuplicateConnPolicy
+		// indexes of the dialed conns s1 should keep.
+		keep []int
+	}{
+		{"keep", KeepDuplicates, []int{0, 1}},
+		{"reject new", RejectNew, []int{0}},
+		{"replace old", ReplaceOld, []int{1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s1 := makeSwarmWithOpts(ctx, t, WithInboundDuplicateConnPolicy(tc.policy))
+			defer s1.Close()
+			s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+			defer s2.Close()
+
+			tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+			var dialed []transport.CapableConn
+			for i := 0; i < 2; i++ {
+				c, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				dialed = append(dialed, c)
+				// Give s1 time to handle the conn.
+				for j := 0; len(s1.ConnsToPeer(s2.LocalPeer())) == 0 || j < 10; j++ {
+					if j > 100 {
+						t.Fatal("s1 didn't register the first conn")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			conns := s1.ConnsToPeer(s2.LocalPeer())
+			if len(conns) != len(tc.keep) {
+				t.Fatalf("expected %d conns, have %d", len(tc.keep), len(conns))
+			}
+			for i, idx := range tc.keep {
+				if !conns[i].RemoteMultiaddr().Equal(dialed[idx].LocalMultiaddr()) {
+					t.Errorf("expected conn %d to be dialed conn %d", i, idx)
+				}
+			}
+		})
+	}
+}
+
+func TestGenSwarmOptMaxConns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := swarmt.GenSwarm(t, ctx, swarmt.OptMaxConns(1), swarmt.OptDialTimeout(3*time.Second))
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+
+	if d := s1.DialConfig().DialTimeout; d != 3*time.Second {
+		t.Fatalf("expected a 3s dial timeout, got %s", d)
+	}
+
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+	var last ma.Multiaddr
+	for i := 0; i < 2; i++ {
+		c, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		last = c.LocalMultiaddr()
+	}
+
+	// The first connection is evicted once the second one shows up.
+	for i := 0; ; i++ {
+		conns := s1.ConnsToPeer(s2.LocalPeer())
+		if len(conns) == 1 && conns[0].RemoteMultiaddr().Equal(last) {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected only the newest conn to remain, have %d conns", len(conns))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamLoadBalancing(t *testing.T) {
+	for _, tc := range []struct {
+		mode StreamLoadBalancing
+		// streams opened on the first conn before balancing
+		preload int
+		// expected streams per conn, fewest first
+		want [2]int
+	}{
+		{BestConn, 0, [2]int{0, 4}},
+		{RoundRobin, 0, [2]int{2, 2}},
+		{LeastStreams, 2, [2]int{3, 3}},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s1 := makeSwarmWithOpts(ctx, t, WithStreamLoadBalancing(tc.mode))
+		defer s1.Close()
+		s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+		defer s2.Close()
+
+		// Dial directly over the transport so that s1 has two connections
+		// to s2.
+		tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+		for i := 0; i < 2; i++ {
+			c, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+		}
+		for i := 0; len(s1.ConnsToPeer(s2.LocalPeer())) != 2; i++ {
+			if i > 100 {
+				t.Fatal("expected two conns")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		conns := s1.ConnsToPeer(s2.LocalPeer())
+		for i := 0; i < tc.preload; i++ {
+			if _, err := conns[0].NewStream(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 4; i++ {
+			if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		counts := [2]int{len(conns[0].GetStreams()), len(conns[1].GetStreams())}
+		if counts[0] > counts[1] {
+			counts[0], counts[1] = counts[1], counts[0]
+		}
+		if counts != tc.want {
+			t.Fatalf("mode %d: expected %v streams per conn, got %v", tc.mode, tc.want, counts)
+		}
+	}
+}
+
+func TestConnSelector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeSwarmWithOpts(ctx, t)
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+
+	// Dial directly over the transport so that s1 has two connections to s2.
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+	for i := 0; i < 2; i++ {
+		c, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	for i := 0; len(s1.ConnsToPeer(s2.LocalPeer())) != 2; i++ {
+		if i > 100 {
+			t.Fatal("expected two conns")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Pick the conn the default policy doesn't.
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var target network.Conn
+	for _, c := range s1.ConnsToPeer(s2.LocalPeer()) {
+		if c != str.Conn() {
+			target = c
+		}
+	}
+
+	var candidates int
+	sctx := WithConnSelector(ctx, func(conns []network.Conn) network.Conn {
+		candidates = len(conns)
+		for _, c := range conns {
+			if c == target {
+				return c
+			}
+		}
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		str, err := s1.NewStream(sctx, s2.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str.Conn() != target {
+			t.Fatal("expected the stream to be opened on the selected conn")
+		}
+	}
+	if candidates != 2 {
+		t.Fatalf("expected the selector to be offered 2 conns, got %d", candidates)
+	}
+
+	// The selector must pick one of the candidates, not, say, a conn to
+	// another peer.
+	s3 := makeSwarmWithOpts(ctx, t)
+	defer s3.Close()
+	s1.Peerstore().AddAddrs(s3.LocalPeer(), s3.ListenAddresses(), peerstore.PermanentAddrTTL)
+	other, err := s1.DialPeer(ctx, s3.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sctx = WithConnSelector(ctx, func([]network.Conn) network.Conn { return other })
+	if _, err := s1.NewStream(sctx, s2.LocalPeer()); err != ErrConnHintMismatch {
+		t.Fatalf("expected ErrConnHintMismatch, got %v", err)
+	}
+}
+
+func TestForEachConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const n = 5
+	swarms := makeSwarms(ctx, t, n+1)
+	defer closeSwarms(swarms)
+	s := swarms[0]
+
+	// Iterate while connections are being opened.
+	var wg sync.WaitGroup
+	for _, other := range swarms[1:] {
+		wg.Add(1)
+		go func(other *Swarm) {
+			defer wg.Done()
+			s.Peerstore().AddAddrs(other.LocalPeer(), other.ListenAddresses(), peerstore.PermanentAddrTTL)
+			if _, err := s.DialPeer(ctx, other.LocalPeer()); err != nil {
+				t.Error(err)
+			}
+		}(other)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		s.ForEachConn(func(c network.Conn) bool {
+			if c.LocalPeer() != s.LocalPeer() {
+				t.Errorf("unexpected conn %s", c)
+			}
+			return true
+		})
+	}
+
+	seen := 0
+	s.ForEachConn(func(network.Conn) bool {
+		seen++
+		return true
+	})
+	if seen != n {
+		t.Fatalf("expected %d conns, saw %d", n, seen)
+	}
+
+	// Returning false stops the iteration.
+	seen = 0
+	s.ForEachConn(func(network.Conn) bool {
+		seen++
+		return false
+	})
+	if seen != 1 {
+		t.Fatalf("expected iteration to stop after one conn, saw %d", seen)
+	}
+}
+
+func TestMaxStreamsPerPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeSwarmWithOpts(ctx, t, WithMaxStreamsPerPeer(3))
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+
+	// Dial directly over the transport so that s1 has two connections to s2.
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+	var raw []transport.CapableConn
+	for i := 0; i < 2; i++ {
+		c, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		raw = append(raw, c)
+	}
+	for i := 0; len(s1.ConnsToPeer(s2.LocalPeer())) != 2; i++ {
+		if i > 100 {
+			t.Fatal("expected two conns")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conns := s1.ConnsToPeer(s2.LocalPeer())
+
+	var streams []network.Stream
+	for _, c := range []network.Conn{conns[0], conns[0], conns[1]} {
+		str, err := c.NewStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, str)
+	}
+	if n := s1.OpenStreamCountForPeer(s2.LocalPeer()); n != 3 {
+		t.Fatalf("expected 3 streams open to the peer, got %d", n)
+	}
+
+	// The cap holds across connections, for both directions.
+	if _, err := conns[1].NewStream(); err != ErrResourceLimitExceeded {
+		t.Fatalf("expected ErrResourceLimitExceeded, got %v", err)
+	}
+	if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != ErrResourceLimitExceeded {
+		t.Fatalf("expected ErrResourceLimitExceeded, got %v", err)
+	}
+	in, err := raw[1].OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Write([]byte("ping"))
+	if _, err := in.Read(make([]byte, 4)); err == nil {
+		t.Fatal("expected an inbound stream over the cap to be reset")
+	}
+
+	streams[0].Reset()
+	if n := s1.OpenStreamCountForPeer(s2.LocalPeer()); n != 2 {
+		t.Fatalf("expected 2 streams open to the peer, got %d", n)
+	}
+	if _, err := conns[1].NewStream(); err != nil {
+		t.Fatalf("expected a stream once another was closed, got %v", err)
+	}
+}
+
+func TestBestConnChangeObserver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type change struct{ old, new network.Conn }
+	changes := make(chan change, 10)
+	s1 := makeSwarmWithOpts(ctx, t, WithBestConnChangeObserver(func(p peer.ID, old, new network.Conn) {
+		changes <- change{old, new}
+	}))
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+
+	expect := func(old, new network.Conn) {
+		t.Helper()
+		select {
+		case c := <-changes:
+			if c.old != old || c.new != new {
+				t.Fatalf("expected the best conn to change from %v to %v, got %v to %v", old, new, c.old, c.new)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the best conn to change")
+		}
+	}
+	waitConns := func(n int) []network.Conn {
+		t.Helper()
+		for i := 0; len(s1.ConnsToPeer(s2.LocalPeer())) != n; i++ {
+			if i > 100 {
+				t.Fatalf("expected %d conns", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return s1.ConnsToPeer(s2.LocalPeer())
+	}
+
+	// Dial directly over the transport to get several connections to s2.
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+
+	c1, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	first := waitConns(1)[0]
+	expect(nil, first)
+
+	// A newer conn is preferred as long as it has as many streams.
+	c2, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	second := waitConns(2)[1]
+	expect(first, second)
+
+	// A stream on the old conn makes it the best again.
+	str, err := first.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(second, first)
+	str.Reset()
+	expect(first, second)
+
+	// Closing the best conn falls back on the other one, then on none.
+	second.Close()
+	expect(second, first)
+	first.Close()
+	expect(first, nil)
+
+	select {
+	case c := <-changes:
+		t.Fatalf("unexpected change from %v to %v", c.old, c.new)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnsToPeerWithState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+	before := time.Now()
+	connectSwarms(t, ctx, swarms)
+
+	// Churn streams while taking snapshots.
+	const workers = 4
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 4)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				str, err := s1.NewStream(ctx, s2.LocalPeer())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := str.Write([]byte("ping")); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := str.Read(buf); err != nil {
+					t.Error(err)
+					return
+				}
+				str.Reset()
+			}
+		}()
+	}
+
+	var sent, recv uint64
+	for i := 0; i < 100; i++ {
+		states := s1.ConnsToPeerWithState(s2.LocalPeer())
+		if len(states) != 1 {
+			t.Fatalf("expected 1 conn, got %d", len(states))
+		}
+		st := states[0]
+		if conns := s1.ConnsToPeer(s2.LocalPeer()); len(conns) != 1 || conns[0] != st.Conn {
+			t.Fatal("expected the snapshot of the conn to the peer")
+		}
+		if st.Direction != st.Conn.Stat().Direction || st.Direction != network.DirOutbound {
+			t.Fatalf("expected an outbound conn, got %v", st.Direction)
+		}
+		if st.Streams < 0 || st.Streams > workers {
+			t.Fatalf("expected at most %d streams, got %d", workers, st.Streams)
+		}
+		if st.BytesSent < sent || st.BytesRecv < recv {
+			t.Fatal("expected the byte counters never to go back")
+		}
+		sent, recv = st.BytesSent, st.BytesRecv
+		if st.Opened.Before(before) || st.Opened.After(time.Now()) {
+			t.Fatalf("expected the conn to be opened after %s, got %s", before, st.Opened)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	if sent == 0 || recv == 0 {
+		t.Fatal("expected the snapshots to count the streams' bytes")
+	}
+	if states := s1.ConnsToPeerWithState(s2.LocalPeer()); states[0].BytesSent < sent {
+		t.Fatal("expected the byte counters never to go back")
+	}
+}
@@ -0,0 +1,93 @@
+package swarm
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// PendingConn describes a connection being set up: dialed, secured and
+// multiplexed, but not yet added to the swarm.
+//
+// Inbound connections are upgraded inside the transport's listener, before the
+// swarm sees them, so only outbound connections are tracked.
+type PendingConn struct {
+	// ID identifies the pending connection, see CancelPendingConn.
+	ID uint64
+
+	Peer       peer.ID
+	RemoteAddr ma.Multiaddr
+	Direction  network.Direction
+
+	// Started is when the connection attempt started.
+	Started time.Time
+}
+
+// Elapsed returns how long the connection has been pending for.
+func (pc PendingConn) Elapsed() time.Duration {
+	return time.Since(pc.Started)
+}
+
+// pendingConns tracks the connections being set up.
+type pendingConns struct {
+	mu     sync.Mutex
+	nextID uint64
+	m      map[uint64]*pendingConn
+}
+
+type pendingConn struct {
+	PendingConn
+	cancel context.CancelFunc
+}
+
+func (pc *pendingConns) add(c PendingConn, cancel context.CancelFunc) uint64 {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.m == nil {
+		pc.m = make(map[uint64]*pendingConn)
+	}
+	pc.nextID++
+	c.ID = pc.nextID
+	c.Started = time.Now()
+	pc.m[c.ID] = &pendingConn{PendingConn: c, cancel: cancel}
+	return c.ID
+}
+
+func (pc *pendingConns) remove(id uint64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.m, id)
+}
+
+// PendingConns returns the connections currently being set up, oldest first.
+func (s *Swarm) PendingConns() []PendingConn {
+	s.pending.mu.Lock()
+	defer s.pending.mu.Unlock()
+	conns := make([]PendingConn, 0, len(s.pending.m))
+	for _, c := range s.pending.m {
+		conns = append(conns, c.PendingConn)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// CancelPendingConn aborts setting up the pending connection with the given
+// ID; the dial it's part of sees it fail. It returns false if there's no such
+// pending connection (anymore).
+func (s *Swarm) CancelPendingConn(id uint64) bool {
+	s.pending.mu.Lock()
+	c, ok := s.pending.m[id]
+	delete(s.pending.m, id)
+	s.pending.mu.Unlock()
+	if ok {
+		log.Debugf("canceling pending connection to %s at %s", c.Peer, c.RemoteAddr)
+		c.cancel()
+	}
+	return ok
+}
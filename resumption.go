@@ -0,0 +1,44 @@
+package swarm
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ResumptionTicket returns the latest session resumption ticket a security
+// transport reported for the peer (see ReportResumptionTicket), if any. It's
+// presented on dials to the peer that don't carry a ticket of their own (see
+// WithResumptionTicket).
+func (s *Swarm) ResumptionTicket(p peer.ID) []byte {
+	s.tickets.Lock()
+	defer s.tickets.Unlock()
+	return s.tickets.m[p]
+}
+
+// ForgetResumptionTicket drops the session resumption ticket stored for the
+// peer, e.g. after resumption failed.
+func (s *Swarm) ForgetResumptionTicket(p peer.ID) {
+	s.tickets.Lock()
+	defer s.tickets.Unlock()
+	delete(s.tickets.m, p)
+}
+
+// withResumption prepares the context of a dial to the peer: it carries the
+// ticket to present, unless the caller set one, and collects the tickets the
+// security transport reports.
+func (s *Swarm) withResumption(ctx context.Context, p peer.ID) context.Context {
+	if GetResumptionTicket(ctx) == nil {
+		if ticket := s.ResumptionTicket(p); ticket != nil {
+			ctx = WithResumptionTicket(ctx, ticket)
+		}
+	}
+	return withTicketSink(ctx, func(ticket []byte) {
+		s.tickets.Lock()
+		defer s.tickets.Unlock()
+		if s.tickets.m == nil {
+			s.tickets.m = make(map[peer.ID][]byte)
+		}
+		s.tickets.m[p] = append([]byte(nil), ticket...)
+	})
+}
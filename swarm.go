@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -13,6 +15,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/transport"
 
 	logging "github.com/ipfs/go-log"
@@ -21,6 +24,8 @@ import (
 
 	filter "github.com/libp2p/go-maddr-filter"
 	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+	mss "github.com/multiformats/go-multistream"
 	mafilter "github.com/whyrusleeping/multiaddr-filter"
 )
 
@@ -43,11 +48,31 @@ var ErrAddrFiltered = errors.New("address filtered")
 // ErrDialTimeout is returned when one a dial times out due to the global timeout
 var ErrDialTimeout = errors.New("dial timed out")
 
+// ErrConnHintMismatch is returned by NewStream when the connection hinted on
+// the context (see WithConn), or picked by the context's connection selector
+// (see WithConnSelector), isn't a usable connection of this swarm to the peer.
+var ErrConnHintMismatch = errors.New("hinted connection is not a connection to the peer")
+
 // Swarm is a connection muxer, allowing connections to other peers to
 // be opened and closed, while still using the same Chan for all
 // communication. The Chan sends/receives Messages, which note the
 // destination or source Peer.
 type Swarm struct {
+	// number of streams assigned to a connection by RoundRobin stream load
+	// balancing. Accessed atomically; keep first for 64-bit alignment.
+	streamPicks uint64
+
+	// swarm-wide counters reported by Metrics. Accessed atomically; keep
+	// near the top for 64-bit alignment.
+	counters struct {
+		dialsAttempted, dialsSucceeded, dialsFailed uint64
+		bytesIn, bytesOut                           uint64
+	}
+
+	// estimated memory reserved by open streams, see WithMaxStreamMemory.
+	// Accessed atomically; keep near the top for 64-bit alignment.
+	streamMemory int64
+
 	// Close refcount. This allows us to fully wait for the swarm to be torn
 	// down before continuing.
 	refs sync.WaitGroup
@@ -66,7 +91,16 @@ type Swarm struct {
 		ifaceListenAddres []ma.Multiaddr
 		cacheEOL          time.Time
 
-		m map[transport.Listener]struct{}
+		m map[transport.Listener]*listenerState
+
+		// refuse to listen, see SetDialOnly.
+		dialOnly bool
+	}
+
+	// names of the network interfaces watched by ListenInterface.
+	ifaces struct {
+		sync.Mutex
+		m map[string]bool
 	}
 
 	notifs struct {
@@ -77,12 +111,46 @@ type Swarm struct {
 	transports struct {
 		sync.RWMutex
 		m map[int]transport.Transport
+
+		// dials what none of the registered transports can, see
+		// SetFallbackTransport.
+		fallback transport.Transport
 	}
 
+	// transports registered during construction (see WithTransports)
+	initialTransports []transport.Transport
+
 	// new connection and stream handlers
 	connh   atomic.Value
 	streamh atomic.Value
 
+	// initializes dialed connections before they're registered (ConnWarmupFunc)
+	warmup atomic.Value
+
+	// finds addresses for peers without usable ones (AddrDiscoveryFunc)
+	discovery atomic.Value
+
+	// rewrites peer addresses before they're dialed (NewAddrFilter)
+	addrFilter atomic.Value
+
+	// decides whether new streams may be opened (StreamGateFunc)
+	streamGate atomic.Value
+
+	// per-protocol stream handlers, see SetStreamHandlerForProtocol
+	protocols struct {
+		sync.RWMutex
+		m   map[protocol.ID]network.StreamHandler
+		mux *mss.MultistreamMuxer
+	}
+
+	// outbound connections being set up
+	pending pendingConns
+
+	// lifecycle events, see Events
+	events          *eventBus
+	eventBufferSize int
+	reportDropped   bool
+
 	// dialing helpers
 	dsync   *DialSync
 	backf   DialBackoff
@@ -91,27 +159,733 @@ type Swarm struct {
 	// filters for addresses that shouldnt be dialed (or accepted)
 	Filters *filter.Filters
 
+	// upgradeTimeout bounds the security/muxer upgrade of outbound
+	// connections on transports implementing UpgradableTransport.
+	upgradeTimeout time.Duration
+
+	// security protocol preference for outbound upgrades ([]protocol.ID)
+	secPreference atomic.Value
+
+	// resolver for DNS multiaddrs, nil to disable resolution.
+	maResolver *madns.Resolver
+	resolved   resolveCache
+
+	// maximum number of connections to a single peer, 0 for no limit.
+	maxConnsPerPeer int
+
+	// how NewStream picks between several connections to a peer.
+	streamBalancing StreamLoadBalancing
+
+	// what to do with inbound connections from connected peers.
+	inboundDupPolicy InboundDuplicateConnPolicy
+
+	// decides which peers and addresses may be dialed, nil to allow all.
+	gater struct {
+		sync.RWMutex
+		g ConnectionGater
+	}
+
+	// orders (and prunes) the addresses of a peer before dialing.
+	ranker AddrRanker
+	tierOf func(ma.Multiaddr) int
+
+	// the NetworkCondition and network.Reachability the default ranking
+	// adapts to. Accessed atomically.
+	netCondition int32
+	reachability int32
+
+	// prefer the transports of existing connections when dialing a peer.
+	reuseConnTransport bool
+
+	// connection idle and active callbacks, see WithConnIdleCallback.
+	idleTimeout  time.Duration
+	onConnIdle   func(network.Conn)
+	onConnActive func(network.Conn)
+
+	// how long connections live, 0 for ever, see WithMaxConnLifetime.
+	maxConnLifetime time.Duration
+
+	// linger timeout of connections not dialed with WithConnLinger.
+	connLinger    time.Duration
+	hasConnLinger bool
+
+	// called when a connection's muxer fails with a protocol error.
+	muxerErrorHandler func(network.Conn, error)
+
+	// redial with another muxer when muxer negotiation fails.
+	muxerFallback bool
+
+	// called when the best connection to a peer changes, and the last best
+	// connection reported for each peer.
+	bestConnObserver func(p peer.ID, old, new network.Conn)
+	bestConns        struct {
+		sync.Mutex
+		m map[peer.ID]*Conn
+	}
+
+	// the last RecentDisconnectsSize closed connections, oldest first.
+	disconnects struct {
+		sync.Mutex
+		list []Disconnect
+	}
+
+	// the latest session resumption ticket received from each peer.
+	tickets struct {
+		sync.Mutex
+		m map[peer.ID][]byte
+	}
+
+	// prefer the transport a peer was last successfully dialed over.
+	stickyTransport bool
+	lastTransport   struct {
+		sync.Mutex
+		m map[peer.ID]transport.Transport
+	}
+
+	// peerstore TTL given to successfully dialed addresses, 0 to disable.
+	dialedAddrTTL time.Duration
+
+	// called when the last listener of a transport closes.
+	listenerClosedHandler func(transport.Transport, ma.Multiaddr)
+
+	// consecutive dial failures after which a peer isn't dialed anymore,
+	// 0 for no limit.
+	dialFailureThreshold int
+	dialFailures         struct {
+		sync.Mutex
+		m map[peer.ID]int
+	}
+
+	// limits how fast dials start, nil for no limit.
+	dialRate *dialRateLimiter
+
+	// limits on concurrent dials overriding the defaults, 0 to keep them.
+	fdLimit      int
+	perPeerLimit int
+	perAddrLimit int
+
+	// maximum number of peer dials in progress, 0 for no limit.
+	maxPendingDials int
+
+	// per address dial timeout overriding transport.DialTimeout, 0 to keep
+	// it.
+	dialTimeout time.Duration
+
+	// bound on a whole DialPeer call, 0 for none.
+	maxPeerDialDuration time.Duration
+
+	// called when a dial is deduplicated by the dial sync.
+	dialDedupObserver func(peer.ID)
+
+	// called when a dial succeeds with less than nearTimeoutThreshold of its
+	// time budget left.
+	nearTimeoutObserver  func(peer.ID, time.Duration)
+	nearTimeoutThreshold float64
+
+	// called with the time each inbound stream waited before its handler
+	// started.
+	acceptLatencyObserver func(protocol.ID, time.Duration)
+
+	// enumerates interface addresses for ListenInterface, nil for the
+	// system's.
+	interfaceAddrs InterfaceAddrsFunc
+
+	// ports (inclusive) tried when listening on a zero port, unset if
+	// [0, 0].
+	listenPortRange [2]int
+
+	// delay between starting the dials to successive addresses of a peer.
+	happyEyeballsDelay time.Duration
+
+	// number of duplicate dials raced against each address dial, and the
+	// delay before starting each, see WithAddrHedging.
+	hedgeCount int
+	hedgeDelay time.Duration
+
+	// default stream read/write timeouts, 0 for none.
+	streamReadTimeout  time.Duration
+	streamWriteTimeout time.Duration
+
+	// cap on streamMemory, 0 for none.
+	maxStreamMemory int64
+
+	// streams whose write backlog exceeds this are reset, 0 for no limit.
+	maxWriteBacklog int
+
+	// cap on the streams open to a single peer, 0 for none, and the number
+	// of streams open to each peer when there's a cap.
+	maxStreamsPerPeer int
+	peerStreams       struct {
+		sync.Mutex
+		m map[peer.ID]int
+	}
+
 	proc goprocess.Process
 	ctx  context.Context
 	bwc  metrics.Reporter
 }
 
+// DefaultSuccessfulDialAddrTTL is the default peerstore TTL successfully
+// dialed addresses are extended to.
+var DefaultSuccessfulDialAddrTTL = peerstore.RecentlyConnectedAddrTTL
+
+// Option is an option that can be passed when constructing a Swarm.
+type Option func(*Swarm) error
+
+// WithTransports registers the given transports while constructing the
+// swarm, so the swarm can dial as soon as it's returned. Construction fails if
+// any of them can't be added.
+func WithTransports(ts ...transport.Transport) Option {
+	return func(s *Swarm) error {
+		s.initialTransports = append(s.initialTransports, ts...)
+		return nil
+	}
+}
+
+// WithUpgradeTimeout bounds the time spent upgrading (securing and
+// multiplexing) an outbound connection, separately from the time spent
+// establishing the raw connection.
+//
+// This only applies to transports implementing UpgradableTransport. The
+// upgrade still happens within the per-address dial timeout. For dials with a
+// traffic class (see WithConnTrafficClass) over transports that can't dial
+// raw connections with one (see RawTrafficClassDialer), it bounds the whole
+// dial instead.
+func WithUpgradeTimeout(d time.Duration) Option {
+	return func(s *Swarm) error {
+		s.upgradeTimeout = d
+		return nil
+	}
+}
+
+// WithDialDedupObserver sets a function to be called whenever a dial to a peer
+// attaches to an already in-flight dial instead of starting a new one.
+//
+// The observer is called synchronously from DialPeer and must not block.
+func WithDialDedupObserver(f func(p peer.ID)) Option {
+	return func(s *Swarm) error {
+		s.dialDedupObserver = f
+		return nil
+	}
+}
+
+// WithMaxConnsPerPeer limits the number of connections to any single peer.
+// When a new connection pushes a peer over the limit, the least recently used
+// connections to that peer (see Conn.LastStreamActivity) are closed, except
+// the acquired ones (see Conn.Acquire).
+func WithMaxConnsPerPeer(n int) Option {
+	return func(s *Swarm) error {
+		s.maxConnsPerPeer = n
+		return nil
+	}
+}
+
+// WithInboundDuplicateConnPolicy sets what happens when an inbound connection
+// arrives from a peer the swarm is already connected to. The default,
+// KeepDuplicates, keeps all of them (subject to WithMaxConnsPerPeer).
+// Outbound connections aren't affected.
+func WithInboundDuplicateConnPolicy(policy InboundDuplicateConnPolicy) Option {
+	return func(s *Swarm) error {
+		switch policy {
+		case KeepDuplicates, RejectNew, ReplaceOld:
+		default:
+			return fmt.Errorf("unknown inbound duplicate conn policy: %d", policy)
+		}
+		s.inboundDupPolicy = policy
+		return nil
+	}
+}
+
+// WithStreamLoadBalancing sets how NewStream distributes new streams over
+// the connections to a peer. The default is BestConn.
+func WithStreamLoadBalancing(mode StreamLoadBalancing) Option {
+	return func(s *Swarm) error {
+		switch mode {
+		case BestConn, RoundRobin, LeastStreams:
+		default:
+			return fmt.Errorf("unknown stream load balancing mode: %d", mode)
+		}
+		s.streamBalancing = mode
+		return nil
+	}
+}
+
+// WithConnectionGater sets the connection gater consulted before dialing, and
+// before adding upgraded connections if it implements UpgradedConnGater.
+func WithConnectionGater(g ConnectionGater) Option {
+	return func(s *Swarm) error {
+		s.gater.g = g
+		return nil
+	}
+}
+
+// WithAddrRanker sets the function used to order a peer's addresses before
+// dialing them. The ranker is consulted afresh on every dial so it can take
+// the latest information about the addresses into account.
+func WithAddrRanker(r AddrRanker) Option {
+	return func(s *Swarm) error {
+		s.ranker = r
+		return nil
+	}
+}
+
+// WithAddrTierFunc sets the function used to split a peer's addresses into
+// tiers before dialing. Addresses in a tier are only dialed once every address
+// in the lower tiers failed; within a tier, addresses keep the ranker's order
+// and are dialed concurrently as usual. Without a tier function, all
+// addresses are in the same tier. DialPeerBestEffort ignores tiers, as it
+// dials every address anyway.
+func WithAddrTierFunc(f func(ma.Multiaddr) int) Option {
+	return func(s *Swarm) error {
+		s.tierOf = f
+		return nil
+	}
+}
+
+// WithReuseConnTransport sets whether dials to an already connected peer try
+// the addresses of the transports the peer is connected over first, ahead of
+// the ranker's order (default: true).
+func WithReuseConnTransport(enabled bool) Option {
+	return func(s *Swarm) error {
+		s.reuseConnTransport = enabled
+		return nil
+	}
+}
+
+// WithDefaultConnLinger sets the SO_LINGER timeout connections close with,
+// inbound ones and outbound ones dialed without WithConnLinger. By default the
+// transport's setting is left alone.
+func WithDefaultConnLinger(d time.Duration) Option {
+	return func(s *Swarm) error {
+		if d < 0 {
+			return fmt.Errorf("linger timeout must not be negative, got %s", d)
+		}
+		s.connLinger = d
+		s.hasConnLinger = true
+		return nil
+	}
+}
+
+// WithMuxerErrorHandler sets a function called when a connection's stream
+// multiplexer stops because the remote side violated the protocol (e.g., sent
+// a malformed frame), as opposed to the connection being closed, by either
+// side, or failing (see MuxerProtocolError). It's meant for abuse detection;
+// the connection is closed either way.
+//
+// The handler is called from the connection's background goroutine, before
+// the connection is closed, and must not block.
+func WithMuxerErrorHandler(h func(c network.Conn, err error)) Option {
+	return func(s *Swarm) error {
+		s.muxerErrorHandler = h
+		return nil
+	}
+}
+
+// WithMuxerFallback makes the swarm retry a dial whose stream multiplexer
+// negotiation failed once, preferring the next multiplexer the transport
+// offers (see MuxerTransport). The retry dials a new connection, as the failed
+// upgrade closes the original one.
+func WithMuxerFallback() Option {
+	return func(s *Swarm) error {
+		s.muxerFallback = true
+		return nil
+	}
+}
+
+// WithBestConnChangeObserver sets a function called whenever the connection
+// the swarm considers the best to a peer (the one DialPeer returns) changes:
+// when a better connection is established, the best one closes or starts
+// draining, or streams open and close. old is nil for the peer's first
+// connection, new is nil once the peer's last connection is gone.
+//
+// The observer is called synchronously and must not block.
+func WithBestConnChangeObserver(f func(p peer.ID, old, new network.Conn)) Option {
+	return func(s *Swarm) error {
+		s.bestConnObserver = f
+		return nil
+	}
+}
+
+// WithStickyTransport sets whether dials to a peer try the addresses of the
+// transport the peer was last successfully dialed over first, ahead of the
+// ranker's order (default: false). A peer whose dial fails altogether is
+// forgotten. The transports of existing connections (see
+// WithReuseConnTransport) still take precedence.
+func WithStickyTransport(enabled bool) Option {
+	return func(s *Swarm) error {
+		s.stickyTransport = enabled
+		return nil
+	}
+}
+
+// WithSuccessfulDialAddrTTL sets the peerstore TTL successfully dialed
+// addresses are extended to (default: DefaultSuccessfulDialAddrTTL). Addresses
+// already known with a longer TTL keep it. A zero TTL disables this.
+func WithSuccessfulDialAddrTTL(d time.Duration) Option {
+	return func(s *Swarm) error {
+		s.dialedAddrTTL = d
+		return nil
+	}
+}
+
+// WithTransportListenerClosedHandler sets a function to be called when a
+// listener closes while the swarm is running, leaving its transport without
+// any listeners. It's passed the transport and the listener's address, e.g.
+// to re-listen or raise an alert. It isn't called for the listeners closed by
+// SetDialOnly, RemoveTransport or RemoveTransportGraceful, nor for those
+// ListenInterface closes.
+func WithTransportListenerClosedHandler(h func(t transport.Transport, addr ma.Multiaddr)) Option {
+	return func(s *Swarm) error {
+		s.listenerClosedHandler = h
+		return nil
+	}
+}
+
+// WithDialRateLimit limits how fast the swarm starts new dials to perSecond
+// dials per second, allowing bursts of up to burst dials. This applies to all
+// dials swarm-wide, on top of the limits on concurrent dials.
+func WithDialRateLimit(perSecond, burst int) Option {
+	return func(s *Swarm) error {
+		if perSecond > 0 {
+			s.dialRate = newDialRateLimiter(perSecond, burst)
+		}
+		return nil
+	}
+}
+
+// WithDialLimits overrides the limits on concurrent dials: fdLimit dials
+// (that consume file descriptors) swarm-wide and perPeerLimit dials per peer.
+// Non-positive values keep the defaults (ConcurrentFdDials, or the
+// LIBP2P_SWARM_FD_LIMIT environment variable, and DefaultPerPeerRateLimit).
+func WithDialLimits(fdLimit, perPeerLimit int) Option {
+	return func(s *Swarm) error {
+		s.fdLimit = fdLimit
+		s.perPeerLimit = perPeerLimit
+		return nil
+	}
+}
+
+// WithPerAddrDialLimit limits the number of concurrent dials to the same
+// address to n, whichever peers they're for. Further dials to the address
+// wait for one of them to finish.
+func WithPerAddrDialLimit(n int) Option {
+	return func(s *Swarm) error {
+		if n <= 0 {
+			return fmt.Errorf("per address dial limit must be positive, got %d", n)
+		}
+		s.perAddrLimit = n
+		return nil
+	}
+}
+
+// WithDialTimeout bounds each dial to a single address to d, for all
+// addresses, instead of transport.DialTimeout (or DialTimeoutLocal for local
+// addresses).
+func WithDialTimeout(d time.Duration) Option {
+	return func(s *Swarm) error {
+		s.dialTimeout = d
+		return nil
+	}
+}
+
+// WithMaxPeerDialDuration bounds every DialPeer call to d, across all the
+// addresses of the peer, whatever the caller's context and the per-address
+// dial timeout (see WithDialTimeout). A DialPeer call that runs out of time
+// fails with context.DeadlineExceeded.
+func WithMaxPeerDialDuration(d time.Duration) Option {
+	return func(s *Swarm) error {
+		if d <= 0 {
+			return fmt.Errorf("max peer dial duration must be positive, got %s", d)
+		}
+		s.maxPeerDialDuration = d
+		return nil
+	}
+}
+
+// WithMaxPendingDials limits the number of peers being dialed at once. Once
+// n dials are in progress, DialPeer fails fast with ErrDialQueueFull for any
+// other peer instead of queuing the dial, pushing back on callers that dial
+// faster than dials complete. Dials to a peer already being dialed join the
+// dial in progress as usual.
+func WithMaxPendingDials(n int) Option {
+	return func(s *Swarm) error {
+		s.maxPendingDials = n
+		return nil
+	}
+}
+
+// WithBackoffJitter enables full jitter on dial backoffs: each backoff lasts a
+// random duration between zero and the computed backoff. This avoids many
+// peers retrying in lockstep after a shared failure.
+func WithBackoffJitter(enabled bool) Option {
+	return func(s *Swarm) error {
+		s.backf.jitter = enabled
+		return nil
+	}
+}
+
+// WithDialFailureThreshold stops dialing peers after n consecutive failed
+// dials: DialPeer then fails with ErrDialFailureThresholdExceeded until the
+// peer's failures are reset with ResetDialFailures. A successful dial resets
+// them too. Unlike backoffs, this never expires.
+func WithDialFailureThreshold(n int) Option {
+	return func(s *Swarm) error {
+		s.dialFailureThreshold = n
+		return nil
+	}
+}
+
+// WithDisableBackoff disables dial backoffs: failed dials no longer put the
+// addresses dialed into backoff, so every dial is attempted. Meant for test
+// environments and trusted clusters, where backoffs only delay recovery.
+func WithDisableBackoff() Option {
+	return func(s *Swarm) error {
+		s.backf.disabled = true
+		return nil
+	}
+}
+
+// WithMultiaddrResolver sets the resolver used to resolve DNS multiaddrs
+// (/dns4, /dns6, /dnsaddr) before dialing. Without a resolver, the swarm only
+// dials the addresses it finds in the peerstore as-is.
+func WithMultiaddrResolver(r *madns.Resolver) Option {
+	return func(s *Swarm) error {
+		s.maResolver = r
+		return nil
+	}
+}
+
+// WithResolutionCacheTTL sets how long resolved DNS multiaddrs are cached
+// (default: DefaultResolutionCacheTTL). A zero TTL disables caching.
+func WithResolutionCacheTTL(d time.Duration) Option {
+	return func(s *Swarm) error {
+		s.resolved.ttl = d
+		return nil
+	}
+}
+
+// WithStreamAcceptLatencyObserver sets a function to be called with the time
+// each inbound stream waited between being accepted from the muxer and its
+// handler starting. This covers the stream open notifications and, when
+// protocol handlers are registered, protocol negotiation. The protocol is
+// empty for streams dispatched to the generic stream handler.
+//
+// The observer is called synchronously before the handler and must not block.
+func WithStreamAcceptLatencyObserver(f func(protocol.ID, time.Duration)) Option {
+	return func(s *Swarm) error {
+		s.acceptLatencyObserver = f
+		return nil
+	}
+}
+
+// WithInterfaceAddrsFunc sets the function ListenInterface uses to get the
+// addresses of network interfaces, instead of asking the OS.
+func WithInterfaceAddrsFunc(f InterfaceAddrsFunc) Option {
+	return func(s *Swarm) error {
+		s.interfaceAddrs = f
+		return nil
+	}
+}
+
+// WithEventBufferSize sets the number of events buffered for Events (default:
+// DefaultEventBufferSize).
+func WithEventBufferSize(n int) Option {
+	return func(s *Swarm) error {
+		if n < 1 {
+			return fmt.Errorf("event buffer size must be positive, got %d", n)
+		}
+		s.eventBufferSize = n
+		return nil
+	}
+}
+
+// WithDroppedEventReports makes the swarm deliver an EventDropped event on
+// Events once the consumer has caught up after events were dropped, reporting
+// how many of each type were lost since the previous report.
+func WithDroppedEventReports() Option {
+	return func(s *Swarm) error {
+		s.reportDropped = true
+		return nil
+	}
+}
+
+// WithListenPortRange makes the swarm listen on the first available port in
+// [from, to] instead of a random one when asked to listen on a zero TCP or UDP
+// port (e.g. /ip4/0.0.0.0/tcp/0). The chosen port shows up in
+// ListenAddresses. Addresses with an explicit port are listened on as-is.
+func WithListenPortRange(from, to int) Option {
+	return func(s *Swarm) error {
+		if from <= 0 || to < from || to > 65535 {
+			return fmt.Errorf("invalid listen port range %d-%d", from, to)
+		}
+		s.listenPortRange = [2]int{from, to}
+		return nil
+	}
+}
+
+// WithDefaultHappyEyeballsDelay staggers the dials to the addresses of a peer:
+// each address is only dialed once the dial to the previous one has been
+// running for d, or failed. Individual dials can override the delay with
+// WithHappyEyeballsDelay. The default, zero, dials all addresses at once
+// (subject to the dial limiter).
+func WithDefaultHappyEyeballsDelay(d time.Duration) Option {
+	return func(s *Swarm) error {
+		s.happyEyeballsDelay = d
+		return nil
+	}
+}
+
+// WithAddrHedging races duplicate dials to the same address: when a dial to an
+// address hasn't connected after delay, another dial to that address is
+// started, up to count extra dials. The first one to connect wins and the
+// others are canceled (or closed, if they connected too). Unlike happy
+// eyeballs, which races different addresses, this hedges against a single
+// slow connection attempt, e.g., a lost SYN. The extra dials don't take dial
+// limiter slots of their own.
+func WithAddrHedging(count int, delay time.Duration) Option {
+	return func(s *Swarm) error {
+		if count <= 0 {
+			return fmt.Errorf("hedged dial count must be positive, got %d", count)
+		}
+		if delay <= 0 {
+			return fmt.Errorf("hedged dial delay must be positive, got %s", delay)
+		}
+		s.hedgeCount = count
+		s.hedgeDelay = delay
+		return nil
+	}
+}
+
+// WithDefaultStreamReadTimeout sets a default timeout for reads on the
+// swarm's streams. Until the stream's read deadline is set explicitly (with
+// SetDeadline or SetReadDeadline), every Read fails with a timeout error if no
+// data arrives within d.
+func WithDefaultStreamReadTimeout(d time.Duration) Option {
+	return func(s *Swarm) error {
+		s.streamReadTimeout = d
+		return nil
+	}
+}
+
+// WithDefaultStreamWriteTimeout sets a default timeout for writes on the
+// swarm's streams. Until the stream's write deadline is set explicitly (with
+// SetDeadline or SetWriteDeadline), every Write fails with a timeout error if
+// it doesn't complete within d.
+func WithDefaultStreamWriteTimeout(d time.Duration) Option {
+	return func(s *Swarm) error {
+		s.streamWriteTimeout = d
+		return nil
+	}
+}
+
+// StreamMemoryEstimate is the memory, in bytes, a stream is assumed to use for
+// its buffers when enforcing WithMaxStreamMemory.
+var StreamMemoryEstimate int64 = 256 << 10
+
+// WithMaxStreamMemory caps the estimated memory used by the swarm's open
+// streams, counting StreamMemoryEstimate bytes per stream. Once a new stream
+// would take the swarm over the cap, inbound streams are reset and NewStream
+// fails with ErrResourceLimitExceeded until streams are closed.
+func WithMaxStreamMemory(bytes int64) Option {
+	return func(s *Swarm) error {
+		if bytes <= 0 {
+			return fmt.Errorf("max stream memory must be positive, got %d", bytes)
+		}
+		s.maxStreamMemory = bytes
+		return nil
+	}
+}
+
+// WithMaxStreamsPerPeer caps the number of streams open to a single peer,
+// across all its connections. Over the cap, inbound streams from the peer are
+// reset and NewStream fails with ErrResourceLimitExceeded until some of its
+// streams are closed.
+func WithMaxStreamsPerPeer(n int) Option {
+	return func(s *Swarm) error {
+		if n <= 0 {
+			return fmt.Errorf("max streams per peer must be positive, got %d", n)
+		}
+		s.maxStreamsPerPeer = n
+		return nil
+	}
+}
+
+// WithMaxStreamWriteBacklog resets streams whose backlog of written data the
+// remote side hasn't consumed yet exceeds the given number of bytes, so that
+// a peer that stops reading can't make writes buffer without bound. It only
+// applies to streams whose multiplexer reports the backlog (see
+// WriteBacklogStream); the backlog is checked after every write.
+func WithMaxStreamWriteBacklog(bytes int) Option {
+	return func(s *Swarm) error {
+		if bytes <= 0 {
+			return fmt.Errorf("max stream write backlog must be positive, got %d", bytes)
+		}
+		s.maxWriteBacklog = bytes
+		return nil
+	}
+}
+
+// WithNearTimeoutObserver sets a function called when DialPeer succeeds with
+// less than the given fraction (e.g., 0.1 for 10%) of its time budget left,
+// with the time that was left. Dials that keep barely making it hint that the
+// dial timeout is too tight.
+//
+// The observer is called synchronously and must not block.
+func WithNearTimeoutObserver(threshold float64, f func(p peer.ID, remaining time.Duration)) Option {
+	return func(s *Swarm) error {
+		if threshold <= 0 || threshold >= 1 {
+			return fmt.Errorf("near timeout threshold must be between 0 and 1, got %f", threshold)
+		}
+		s.nearTimeoutThreshold = threshold
+		s.nearTimeoutObserver = f
+		return nil
+	}
+}
+
 // NewSwarm constructs a Swarm
-func NewSwarm(ctx context.Context, local peer.ID, peers peerstore.Peerstore, bwc metrics.Reporter) *Swarm {
+func NewSwarm(ctx context.Context, local peer.ID, peers peerstore.Peerstore, bwc metrics.Reporter, opts ...Option) (*Swarm, error) {
 	s := &Swarm{
 		local:   local,
 		peers:   peers,
 		bwc:     bwc,
 		Filters: filter.NewFilters(),
 	}
+	s.resolved.ttl = DefaultResolutionCacheTTL
+	s.reuseConnTransport = true
+	s.dialedAddrTTL = DefaultSuccessfulDialAddrTTL
+	s.eventBufferSize = DefaultEventBufferSize
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
 
 	s.conns.m = make(map[peer.ID][]*Conn)
-	s.listeners.m = make(map[transport.Listener]struct{})
+	s.listeners.m = make(map[transport.Listener]*listenerState)
+	s.ifaces.m = make(map[string]bool)
 	s.transports.m = make(map[int]transport.Transport)
 	s.notifs.m = make(map[network.Notifiee]struct{})
+	s.protocols.m = make(map[protocol.ID]network.StreamHandler)
+	s.peerStreams.m = make(map[peer.ID]int)
+	s.bestConns.m = make(map[peer.ID]*Conn)
+	s.protocols.mux = mss.NewMultistreamMuxer()
+	s.events = newEventBus(s.eventBufferSize, s.reportDropped)
 
 	s.dsync = NewDialSync(s.doDial)
+	s.dsync.dedupObserver = s.dialDedupObserver
+	s.dsync.maxPending = s.maxPendingDials
 	s.limiter = newDialLimiter(s.dialAddr)
+	s.limiter.rate = s.dialRate
+	if s.fdLimit > 0 {
+		s.limiter.fdLimit = s.fdLimit
+	}
+	if s.perPeerLimit > 0 {
+		s.limiter.perPeerLimit = s.perPeerLimit
+	}
+	s.limiter.perAddrLimit = s.perAddrLimit
+	s.limiter.dialTimeout = s.dialTimeout
+	s.limiter.fdCostly = s.isFdCostly
 	s.proc = goprocessctx.WithContext(ctx)
 	s.ctx = goprocessctx.OnClosingContext(s.proc)
 	s.backf.init(s.ctx)
@@ -120,7 +894,15 @@ func NewSwarm(ctx context.Context, local peer.ID, peers peerstore.Peerstore, bwc
 	// teardown process early.
 	s.proc.SetTeardown(s.teardown)
 
-	return s
+	for _, t := range s.initialTransports {
+		if err := s.AddTransport(t); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	s.initialTransports = nil
+
+	return s, nil
 }
 
 func (s *Swarm) teardown() error {
@@ -186,14 +968,81 @@ func (s *Swarm) Process() goprocess.Process {
 }
 
 func (s *Swarm) addConn(tc transport.CapableConn, dir network.Direction) (*Conn, error) {
+	return s.registerConn(s.newConn(tc, dir))
+}
+
+// addOutboundConn warms up and registers a freshly dialed connection. If the
+// warmup fails, the connection is closed. limiterWait is the time the dial
+// spent in the dial limiter, recorded in the connection's Stat.
+func (s *Swarm) addOutboundConn(ctx context.Context, tc transport.CapableConn, limiterWait time.Duration) (*Conn, error) {
+	c := s.newConn(tc, network.DirOutbound)
+	c.stat.Extra = map[interface{}]interface{}{StatLimiterWait: limiterWait}
+	if class, ok := GetConnTrafficClass(ctx); ok {
+		if _, ok := s.TransportForDialing(tc.RemoteMultiaddr()).(TrafficClassDialer); ok {
+			c.trafficClass = class
+			c.hasTrafficClass = true
+		}
+	}
+	if d, ok := GetConnLinger(ctx); ok {
+		c.linger = d
+		c.hasLinger = true
+	}
+	if err := c.warmup(ctx); err != nil {
+		log.Debugf("warmup of %s failed: %s", c, err)
+		return nil, err
+	}
+	if _, err := s.registerConn(c); err != nil {
+		return nil, err
+	}
+	s.rememberTransport(c.RemotePeer(), c.RemoteMultiaddr())
+
+	// The address clearly works, make sure we don't forget it too soon.
+	// AddAddr only ever extends the TTL of a known address.
+	if s.dialedAddrTTL > 0 {
+		s.peers.AddAddr(c.RemotePeer(), c.RemoteMultiaddr(), s.dialedAddrTTL)
+	}
+	return c, nil
+}
+
+// newConn wraps a transport connection without registering it.
+func (s *Swarm) newConn(tc transport.CapableConn, dir network.Direction) *Conn {
+	stat := network.Stat{Direction: dir}
+	c := &Conn{
+		conn:      tc,
+		swarm:     s,
+		stat:      stat,
+		transient: isTransient(tc),
+		linger:    s.connLinger,
+		hasLinger: s.hasConnLinger,
+		opened:    time.Now(),
+	}
+	c.streams.m = make(map[*Stream]struct{})
+	c.touch()
+	return c
+}
+
+func (s *Swarm) registerConn(c *Conn) (*Conn, error) {
+	tc := c.conn
+	dir := c.stat.Direction
+
 	// The underlying transport (or the dialer) *should* filter it's own
 	// connections but we should double check anyways.
 	raddr := tc.RemoteMultiaddr()
 	if s.Filters.AddrBlocked(raddr) {
 		tc.Close()
+		c.cancelContext()
 		return nil, ErrAddrFiltered
 	}
 
+	gate := s.gateUpgraded(c)
+	if !gate.Allow {
+		log.Debugf("gater disallowed %s connection %s", dir, c)
+		tc.Close()
+		c.cancelContext()
+		return nil, ErrGaterDisallowedConn
+	}
+	c.tags = append([]string(nil), gate.Tags...)
+
 	p := tc.RemotePeer()
 
 	// Add the public key.
@@ -210,19 +1059,49 @@ func (s *Swarm) addConn(tc transport.CapableConn, dir network.Direction) (*Conn,
 	if s.conns.m == nil {
 		s.conns.Unlock()
 		tc.Close()
+		c.cancelContext()
 		return nil, ErrSwarmClosed
 	}
 
-	// Wrap and register the connection.
-	stat := network.Stat{Direction: dir}
-	c := &Conn{
-		conn:  tc,
-		swarm: s,
-		stat:  stat,
+	var evict []*Conn
+	if dir == network.DirInbound && len(s.conns.m[p]) > 0 {
+		switch s.inboundDupPolicy {
+		case RejectNew:
+			s.conns.Unlock()
+			log.Debugf("rejecting duplicate inbound connection %s", c)
+			tc.Close()
+			c.cancelContext()
+			return nil, ErrDuplicateConn
+		case ReplaceOld:
+			for _, old := range s.conns.m[p] {
+				if !old.acquired() {
+					evict = append(evict, old)
+				}
+			}
+		}
 	}
-	c.streams.m = make(map[*Stream]struct{})
+
+	// Register the connection.
 	s.conns.m[p] = append(s.conns.m[p], c)
 
+	// Evict the least recently used connections, other than this one and
+	// the acquired ones. They're closed once we've released the lock.
+	if cs := s.conns.m[p]; len(evict) == 0 && s.maxConnsPerPeer > 0 && len(cs) > s.maxConnsPerPeer {
+		for _, old := range cs[:len(cs)-1] {
+			if !old.acquired() {
+				evict = append(evict, old)
+			}
+		}
+		// Connections are sorted oldest to newest, so the oldest go first
+		// on ties.
+		sort.SliceStable(evict, func(i, j int) bool {
+			return evict[i].LastStreamActivity().Before(evict[j].LastStreamActivity())
+		})
+		if excess := len(cs) - s.maxConnsPerPeer; len(evict) > excess {
+			evict = evict[:excess]
+		}
+	}
+
 	// Add two swarm refs:
 	// * One will be decremented after the close notifications fire in Conn.doClose
 	// * The other will be decremented when Conn.start exits.
@@ -242,10 +1121,26 @@ func (s *Swarm) addConn(tc transport.CapableConn, dir network.Direction) (*Conn,
 	s.notifyAll(func(f network.Notifiee) {
 		f.Connected(s, c)
 	})
+	s.publishConnEvent(EventConnected, c)
 	c.notifyLk.Unlock()
 
 	c.start()
 
+	c.streams.Lock()
+	if len(c.streams.m) == 0 {
+		c.streamsIdle()
+	}
+	c.streams.Unlock()
+	c.startLifetime()
+	s.checkBestConn(p)
+
+	// Close in the background: a connection acquired since we picked it
+	// would block the dial or the accept loop until released.
+	for _, old := range evict {
+		log.Debugf("closing %s: superseded by %s", old, c)
+		go old.CloseWithReason(DisconnectEvicted)
+	}
+
 	// TODO: Get rid of this. We use it for identify but that happen much
 	// earlier (really, inside the transport and, if not then, during the
 	// notifications).
@@ -285,6 +1180,122 @@ func (s *Swarm) ConnHandler() network.ConnHandler {
 	return handler
 }
 
+// ConnWarmupFunc initializes a freshly dialed connection. It may open
+// streams on the connection but must not hold on to it after returning.
+type ConnWarmupFunc func(ctx context.Context, c network.Conn) error
+
+// SetConnWarmupFunc assigns a function run on every connection this swarm
+// dials, after the connection has been upgraded but before it's registered
+// with the swarm and returned from DialPeer. If it returns an error, the
+// connection is closed and the dial fails.
+//
+// Streams opened during the warmup don't trigger stream notifications as the
+// connection itself hasn't been announced yet.
+func (s *Swarm) SetConnWarmupFunc(f ConnWarmupFunc) {
+	s.warmup.Store(f)
+}
+
+// ConnWarmupFunc gets the connection warmup function.
+func (s *Swarm) ConnWarmupFunc() ConnWarmupFunc {
+	f, _ := s.warmup.Load().(ConnWarmupFunc)
+	return f
+}
+
+// StreamGateFunc decides whether a new stream in the given direction may be
+// opened on a connection. It's called before the stream is admitted, so the
+// connection's streams don't include it yet.
+type StreamGateFunc func(dir network.Direction, c network.Conn) bool
+
+// SetStreamGate assigns a function consulted before every stream is opened.
+// When it returns false, inbound streams are reset and NewStream fails with
+// ErrStreamGated. It's called for every stream so it must be cheap.
+func (s *Swarm) SetStreamGate(f StreamGateFunc) {
+	s.streamGate.Store(f)
+}
+
+// admitStream consults the stream gate (if any) about a new stream.
+func (s *Swarm) admitStream(dir network.Direction, c *Conn) bool {
+	f, _ := s.streamGate.Load().(StreamGateFunc)
+	return f == nil || f(dir, c)
+}
+
+// reserveStream reserves room for a new stream to p, failing with
+// ErrResourceLimitExceeded if that would take the swarm over its stream memory
+// cap (see WithMaxStreamMemory) or p over its stream cap (see
+// WithMaxStreamsPerPeer).
+func (s *Swarm) reserveStream(p peer.ID) error {
+	if !s.reserveStreamMemory() {
+		return ErrResourceLimitExceeded
+	}
+	if !s.reservePeerStream(p) {
+		s.releaseStreamMemory()
+		return ErrResourceLimitExceeded
+	}
+	return nil
+}
+
+// releaseStream releases room reserved with reserveStream.
+func (s *Swarm) releaseStream(p peer.ID) {
+	s.releasePeerStream(p)
+	s.releaseStreamMemory()
+}
+
+func (s *Swarm) reserveStreamMemory() bool {
+	if s.maxStreamMemory <= 0 {
+		return true
+	}
+	for {
+		used := atomic.LoadInt64(&s.streamMemory)
+		if used+StreamMemoryEstimate > s.maxStreamMemory {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.streamMemory, used, used+StreamMemoryEstimate) {
+			return true
+		}
+	}
+}
+
+func (s *Swarm) releaseStreamMemory() {
+	if s.maxStreamMemory <= 0 {
+		return
+	}
+	atomic.AddInt64(&s.streamMemory, -StreamMemoryEstimate)
+}
+
+func (s *Swarm) reservePeerStream(p peer.ID) bool {
+	if s.maxStreamsPerPeer <= 0 {
+		return true
+	}
+	s.peerStreams.Lock()
+	defer s.peerStreams.Unlock()
+	if s.peerStreams.m[p] >= s.maxStreamsPerPeer {
+		return false
+	}
+	s.peerStreams.m[p]++
+	return true
+}
+
+func (s *Swarm) releasePeerStream(p peer.ID) {
+	if s.maxStreamsPerPeer <= 0 {
+		return
+	}
+	s.peerStreams.Lock()
+	defer s.peerStreams.Unlock()
+	if s.peerStreams.m[p]--; s.peerStreams.m[p] <= 0 {
+		delete(s.peerStreams.m, p)
+	}
+}
+
+// OpenStreamCountForPeer returns the number of streams open to p, across all
+// its connections.
+func (s *Swarm) OpenStreamCountForPeer(p peer.ID) int {
+	n := 0
+	for _, c := range s.ConnsToPeer(p) {
+		n += len(c.GetStreams())
+	}
+	return n
+}
+
 // SetStreamHandler assigns the handler for new streams.
 func (s *Swarm) SetStreamHandler(handler network.StreamHandler) {
 	s.streamh.Store(handler)
@@ -296,6 +1307,61 @@ func (s *Swarm) StreamHandler() network.StreamHandler {
 	return handler
 }
 
+// SetStreamHandlerForProtocol assigns the handler for new inbound streams
+// speaking the given protocol. Passing a nil handler removes it.
+//
+// Once at least one protocol handler is registered, the swarm negotiates the
+// protocol of every inbound stream (using multistream-select) and dispatches it
+// to the matching handler instead of the handler set with SetStreamHandler.
+func (s *Swarm) SetStreamHandlerForProtocol(proto protocol.ID, handler network.StreamHandler) {
+	s.protocols.Lock()
+	defer s.protocols.Unlock()
+
+	if handler == nil {
+		delete(s.protocols.m, proto)
+		s.protocols.mux.RemoveHandler(string(proto))
+		return
+	}
+
+	s.protocols.m[proto] = handler
+	s.protocols.mux.AddHandler(string(proto), func(p string, rwc io.ReadWriteCloser) error {
+		handler(rwc.(network.Stream))
+		return nil
+	})
+}
+
+// handleInboundStream dispatches a new inbound stream to the appropriate
+// stream handler.
+func (s *Swarm) handleInboundStream(str *Stream, accepted time.Time) {
+	s.protocols.RLock()
+	negotiate := len(s.protocols.m) > 0
+	s.protocols.RUnlock()
+
+	if !negotiate {
+		if h := s.StreamHandler(); h != nil {
+			s.observeAcceptLatency("", accepted)
+			h(str)
+		}
+		return
+	}
+
+	proto, handle, err := s.protocols.mux.Negotiate(str)
+	if err != nil {
+		log.Debugf("protocol negotiation failed on %s: %s", str, err)
+		str.Reset()
+		return
+	}
+	str.SetProtocol(protocol.ID(proto))
+	s.observeAcceptLatency(protocol.ID(proto), accepted)
+	handle(proto, str)
+}
+
+func (s *Swarm) observeAcceptLatency(proto protocol.ID, accepted time.Time) {
+	if s.acceptLatencyObserver != nil {
+		s.acceptLatencyObserver(proto, time.Since(accepted))
+	}
+}
+
 // NewStream creates a new stream on any available connection to peer, dialing
 // if necessary.
 func (s *Swarm) NewStream(ctx context.Context, p peer.ID) (network.Stream, error) {
@@ -313,9 +1379,16 @@ func (s *Swarm) NewStream(ctx context.Context, p peer.ID) (network.Stream, error
 	//
 	// TODO: Try all connections even if we get an error opening a stream on
 	// a non-closed connection.
+	if hint := GetConn(ctx); hint != nil {
+		return s.newStreamOnConn(ctx, p, hint)
+	}
+
 	dials := 0
 	for {
-		c := s.bestConnToPeer(p)
+		c, err := s.selectConnForStream(ctx, p)
+		if err != nil {
+			return nil, err
+		}
 		if c == nil {
 			if nodial, _ := network.GetNoDial(ctx); nodial {
 				return nil, network.ErrNoConn
@@ -326,12 +1399,14 @@ func (s *Swarm) NewStream(ctx context.Context, p peer.ID) (network.Stream, error
 			}
 			dials++
 
-			var err error
 			c, err = s.dialPeer(ctx, p)
 			if err != nil {
 				return nil, err
 			}
 		}
+		if GetLowLatency(ctx) {
+			c.setLowLatency()
+		}
 		s, err := c.NewStream()
 		if err != nil {
 			if c.conn.IsClosed() {
@@ -343,6 +1418,32 @@ func (s *Swarm) NewStream(ctx context.Context, p peer.ID) (network.Stream, error
 	}
 }
 
+// NewStreamWithData opens a new stream to the given peer, like NewStream, and
+// writes the given data to it before returning (see Conn.NewStreamWithData).
+func (s *Swarm) NewStreamWithData(ctx context.Context, p peer.ID, data []byte) (network.Stream, error) {
+	str, err := s.NewStream(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeInitialData(ctx, str, data); err != nil {
+		return nil, err
+	}
+	return str, nil
+}
+
+// newStreamOnConn opens a stream on exactly the given connection. It never
+// falls back to another connection or dials.
+func (s *Swarm) newStreamOnConn(ctx context.Context, p peer.ID, nc network.Conn) (network.Stream, error) {
+	c, ok := nc.(*Conn)
+	if !ok || c.swarm != s || c.RemotePeer() != p {
+		return nil, ErrConnHintMismatch
+	}
+	if GetLowLatency(ctx) {
+		c.setLowLatency()
+	}
+	return c.NewStream()
+}
+
 // ConnsToPeer returns all the live connections to peer.
 func (s *Swarm) ConnsToPeer(p peer.ID) []network.Conn {
 	// TODO: Consider sorting the connection list best to worst. Currently,
@@ -357,11 +1458,50 @@ func (s *Swarm) ConnsToPeer(p peer.ID) []network.Conn {
 	return output
 }
 
+// ConnState is a snapshot of a connection's state, see ConnsToPeerWithState.
+type ConnState struct {
+	Conn      network.Conn
+	Direction network.Direction
+	Streams   int
+	BytesSent uint64
+	BytesRecv uint64
+	Opened    time.Time
+}
+
+// ConnsToPeerWithState returns the connections to the peer, like ConnsToPeer,
+// each with a snapshot of its state taken under the connection locks, so that
+// connections closing meanwhile are left out rather than reported half torn
+// down.
+func (s *Swarm) ConnsToPeerWithState(p peer.ID) []ConnState {
+	s.conns.RLock()
+	defer s.conns.RUnlock()
+	conns := s.conns.m[p]
+	states := make([]ConnState, 0, len(conns))
+	for _, c := range conns {
+		c.streams.Lock()
+		if c.streams.m == nil {
+			c.streams.Unlock()
+			continue
+		}
+		states = append(states, ConnState{
+			Conn:      c,
+			Direction: c.stat.Direction,
+			Streams:   len(c.streams.m),
+			BytesSent: c.BytesSent(),
+			BytesRecv: c.BytesRecv(),
+			Opened:    c.opened,
+		})
+		c.streams.Unlock()
+	}
+	return states
+}
+
 // bestConnToPeer returns the best connection to peer.
 func (s *Swarm) bestConnToPeer(p peer.ID) *Conn {
 	// Selects the best connection we have to the peer.
 	// TODO: Prefer some transports over others. Currently, we just select
-	// the newest non-closed connection with the most streams.
+	// the newest non-closed direct connection with the most streams,
+	// falling back on transient connections.
 	s.conns.RLock()
 	defer s.conns.RUnlock()
 
@@ -372,11 +1512,18 @@ func (s *Swarm) bestConnToPeer(p peer.ID) *Conn {
 			// We *will* garbage collect this soon anyways.
 			continue
 		}
+		if best != nil && !best.transient && c.transient {
+			continue
+		}
 		c.streams.Lock()
 		cLen := len(c.streams.m)
+		draining := c.streams.drained != nil
 		c.streams.Unlock()
+		if draining {
+			continue
+		}
 
-		if cLen >= bestLen {
+		if cLen >= bestLen || (best != nil && best.transient && !c.transient) {
 			best = c
 			bestLen = cLen
 		}
@@ -385,6 +1532,38 @@ func (s *Swarm) bestConnToPeer(p peer.ID) *Conn {
 	return best
 }
 
+// checkBestConn reports a change of the best connection to the peer to the
+// swarm's observer, if any (see WithBestConnChangeObserver). It must be called
+// whenever the best connection may have changed.
+func (s *Swarm) checkBestConn(p peer.ID) {
+	if s.bestConnObserver == nil {
+		return
+	}
+	s.bestConns.Lock()
+	old := s.bestConns.m[p]
+	best := s.bestConnToPeer(p)
+	if best == old {
+		s.bestConns.Unlock()
+		return
+	}
+	if best == nil {
+		delete(s.bestConns.m, p)
+	} else {
+		s.bestConns.m[p] = best
+	}
+	s.bestConns.Unlock()
+
+	// Don't hand out typed nil pointers.
+	var oldConn, newConn network.Conn
+	if old != nil {
+		oldConn = old
+	}
+	if best != nil {
+		newConn = best
+	}
+	s.bestConnObserver(p, oldConn, newConn)
+}
+
 // Connectedness returns our "connectedness" state with the given peer.
 //
 // To check if we have an open connection, use `s.Connectedness(p) ==
@@ -396,7 +1575,9 @@ func (s *Swarm) Connectedness(p peer.ID) network.Connectedness {
 	return network.NotConnected
 }
 
-// Conns returns a slice of all connections.
+// Conns returns a slice of all connections. The slice is a point-in-time
+// snapshot taken under the connection lock; it's safe to use while
+// connections open and close.
 func (s *Swarm) Conns() []network.Conn {
 	s.conns.RLock()
 	defer s.conns.RUnlock()
@@ -410,6 +1591,99 @@ func (s *Swarm) Conns() []network.Conn {
 	return conns
 }
 
+// connSlicePool holds the scratch slices used by ForEachConn.
+var connSlicePool = sync.Pool{
+	New: func() interface{} { return new([]*Conn) },
+}
+
+// ForEachConn calls f with every connection until f returns false. It works on
+// a snapshot of the connections, like Conns, but reuses its scratch space
+// instead of allocating a new slice on every call. f is called without any
+// swarm locks held, so it may open or close connections.
+func (s *Swarm) ForEachConn(f func(network.Conn) bool) {
+	buf := connSlicePool.Get().(*[]*Conn)
+	conns := (*buf)[:0]
+	s.conns.RLock()
+	for _, cs := range s.conns.m {
+		conns = append(conns, cs...)
+	}
+	s.conns.RUnlock()
+
+	defer func() {
+		// Don't keep the connections alive through the pool.
+		for i := range conns {
+			conns[i] = nil
+		}
+		*buf = conns[:0]
+		connSlicePool.Put(buf)
+	}()
+
+	for _, c := range conns {
+		if !f(c) {
+			return
+		}
+	}
+}
+
+// ReuseportStats returns, for every local address shared through reuseport,
+// the number of open connections bound to it. Only connections whose
+// transport reports sharing (see ReuseportConn) are counted.
+func (s *Swarm) ReuseportStats() map[string]int {
+	stats := make(map[string]int)
+	s.ForEachConn(func(c network.Conn) bool {
+		rc, ok := c.(*Conn).conn.(ReuseportConn)
+		if ok && rc.Reuseport() {
+			stats[c.LocalMultiaddr().String()]++
+		}
+		return true
+	})
+	return stats
+}
+
+// Metrics is a snapshot of the swarm's counters and gauges, meant to be
+// exported to a metrics system. Counters never decrease over the lifetime of
+// the swarm.
+type Metrics struct {
+	// ConnsInbound and ConnsOutbound are the open connections, by direction.
+	ConnsInbound, ConnsOutbound int
+	// StreamsOpen is the number of streams open across all connections.
+	StreamsOpen int
+
+	// DialsAttempted counts the dials to peers the swarm actually started,
+	// not counting dials satisfied by an existing connection or joining a
+	// dial in progress. Each ends up counted in DialsSucceeded or
+	// DialsFailed.
+	DialsAttempted, DialsSucceeded, DialsFailed uint64
+
+	// BytesIn and BytesOut count the bytes read from and written to streams.
+	BytesIn, BytesOut uint64
+}
+
+// Metrics returns a snapshot of the swarm's metrics.
+func (s *Swarm) Metrics() Metrics {
+	m := Metrics{
+		DialsAttempted: atomic.LoadUint64(&s.counters.dialsAttempted),
+		DialsSucceeded: atomic.LoadUint64(&s.counters.dialsSucceeded),
+		DialsFailed:    atomic.LoadUint64(&s.counters.dialsFailed),
+		BytesIn:        atomic.LoadUint64(&s.counters.bytesIn),
+		BytesOut:       atomic.LoadUint64(&s.counters.bytesOut),
+	}
+	s.ForEachConn(func(c network.Conn) bool {
+		switch c.Stat().Direction {
+		case network.DirInbound:
+			m.ConnsInbound++
+		case network.DirOutbound:
+			m.ConnsOutbound++
+		}
+		sc := c.(*Conn)
+		sc.streams.Lock()
+		m.StreamsOpen += len(sc.streams.m)
+		sc.streams.Unlock()
+		return true
+	})
+	return m
+}
+
 // ClosePeer closes all connections to the given peer.
 func (s *Swarm) ClosePeer(p peer.ID) error {
 	conns := s.ConnsToPeer(p)
@@ -440,6 +1714,40 @@ func (s *Swarm) ClosePeer(p peer.ID) error {
 	}
 }
 
+// CloseConnsWhere closes, concurrently, all the connections for which f
+// returns true, and waits for them to close. Acquired connections (see
+// Conn.Acquire) are closed in the background once released; CloseConnsWhere
+// doesn't wait for them.
+func (s *Swarm) CloseConnsWhere(f func(network.Conn) bool) {
+	var conns []*Conn
+	s.ForEachConn(func(c network.Conn) bool {
+		if f(c) {
+			conns = append(conns, c.(*Conn))
+		}
+		return true
+	})
+	closeConns(conns)
+}
+
+// closeConns closes the connections concurrently and waits for them to close,
+// except for the acquired ones, which are closed in the background once
+// released.
+func closeConns(conns []*Conn) {
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		if c.acquired() {
+			go c.Close()
+			continue
+		}
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			c.Close()
+		}(c)
+	}
+	wg.Wait()
+}
+
 // Peers returns a copy of the set of peers swarm is connected to.
 func (s *Swarm) Peers() []peer.ID {
 	s.conns.RLock()
@@ -8,10 +8,12 @@ import (
 )
 
 // ListenAddresses returns a list of addresses at which this swarm listens.
+// Relay addresses come first when the swarm is privately reachable (see
+// SetReachability).
 func (s *Swarm) ListenAddresses() []ma.Multiaddr {
 	s.listeners.RLock()
 	defer s.listeners.RUnlock()
-	return s.listenAddressesNoLock()
+	return s.rankByReachability(s.listenAddressesNoLock())
 }
 
 func (s *Swarm) listenAddressesNoLock() []ma.Multiaddr {
@@ -26,7 +28,8 @@ const ifaceAddrsCacheDuration = 1 * time.Minute
 
 // InterfaceListenAddresses returns a list of addresses at which this swarm
 // listens. It expands "any interface" addresses (/ip4/0.0.0.0, /ip6/::) to
-// use the known local interfaces.
+// use the known local interfaces. Relay addresses come first when the swarm is
+// privately reachable (see SetReachability).
 func (s *Swarm) InterfaceListenAddresses() ([]ma.Multiaddr, error) {
 	s.listeners.RLock() // RLock start
 
@@ -36,7 +39,7 @@ func (s *Swarm) InterfaceListenAddresses() ([]ma.Multiaddr, error) {
 
 	if !isEOL {
 		// Cache is valid, clone the slice
-		return append(ifaceListenAddres[:0:0], ifaceListenAddres...), nil
+		return s.rankByReachability(append(ifaceListenAddres[:0:0], ifaceListenAddres...)), nil
 	}
 
 	// Cache is not valid
@@ -68,5 +71,5 @@ func (s *Swarm) InterfaceListenAddresses() ([]ma.Multiaddr, error) {
 
 	s.listeners.Unlock() // Lock end
 
-	return append(ifaceListenAddres[:0:0], ifaceListenAddres...), nil
+	return s.rankByReachability(append(ifaceListenAddres[:0:0], ifaceListenAddres...)), nil
 }
@@ -2,14 +2,23 @@ package swarm_test
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/libp2p/go-libp2p-core/transport"
+	mplex "github.com/libp2p/go-libp2p-mplex"
+	"github.com/libp2p/go-tcp-transport"
 
 	ma "github.com/multiformats/go-multiaddr"
 
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	. "github.com/libp2p/go-libp2p-swarm"
 )
 
 func TestDialBadAddrs(t *testing.T) {
@@ -71,3 +80,405 @@ func TestAddressesWithoutListening(t *testing.T) {
 		t.Fatalf("expected to be listening on no addresses, was listening on %d", len(a1))
 	}
 }
+
+func TestPauseListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := swarmt.GenSwarmMem(t, ctx)
+	defer s1.Close()
+	s2 := swarmt.GenSwarmMem(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+	swarmt.DivulgeAddresses(s1, s2)
+
+	laddr := s1.ListenAddresses()[0]
+	if err := s1.PauseListener(laddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener stops accepting, so the remote dial doesn't complete.
+	done := make(chan error, 1)
+	go func() {
+		_, err := s2.DialPeer(ctx, s1.LocalPeer())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("dial to a paused listener completed: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 0 {
+		t.Fatal("paused listener accepted a connection")
+	}
+
+	if err := s1.ResumeListener(laddr); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial to a resumed listener never completed")
+	}
+	for i := 0; len(s1.ConnsToPeer(s2.LocalPeer())) == 0; i++ {
+		if i > 100 {
+			t.Fatal("resumed listener never accepted the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s1.PauseListener(ma.StringCast("/ip4/1.2.3.4/tcp/1")); err != ErrNoListener {
+		t.Fatalf("expected ErrNoListener, got %v", err)
+	}
+}
+
+func TestSetDialOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := swarmt.GenSwarm(t, ctx)
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+	s3 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s3.Close()
+	swarmt.DivulgeAddresses(s1, s2)
+	swarmt.DivulgeAddresses(s1, s3)
+	if _, err := s2.DialPeer(ctx, s1.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	s1.SetDialOnly(true)
+	if !s1.IsDialOnly() {
+		t.Fatal("expected the swarm to be dial-only")
+	}
+	if addrs := s1.ListenAddresses(); len(addrs) != 0 {
+		t.Fatalf("expected the listeners to be closed, still listening on %v", addrs)
+	}
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 1 {
+		t.Fatal("expected the existing connection to stay")
+	}
+	if _, err := s3.DialPeer(ctx, s1.LocalPeer()); err == nil {
+		t.Fatal("expected inbound connections to be refused")
+	}
+	if err := s1.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != ErrDialOnly {
+		t.Fatalf("expected ErrDialOnly, got %v", err)
+	}
+
+	s1.SetDialOnly(false)
+	if err := s1.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	s3.Peerstore().SetAddrs(s1.LocalPeer(), s1.ListenAddresses(), peerstore.PermanentAddrTTL)
+	s3.Backoff().Clear(s1.LocalPeer())
+	if _, err := s3.DialPeer(ctx, s1.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listenRecordingTransport is a TCP transport handing out the listeners it
+// creates.
+type listenRecordingTransport struct {
+	*tcp.TcpTransport
+	listeners chan transport.Listener
+}
+
+func (t *listenRecordingTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	l, err := t.TcpTransport.Listen(laddr)
+	if err == nil {
+		t.listeners <- l
+	}
+	return l, err
+}
+
+func TestTransportListenerClosedHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type closed struct {
+		tpt  transport.Transport
+		addr ma.Multiaddr
+	}
+	closedCh := make(chan closed, 2)
+	s := makeBareSwarm(ctx, t, WithTransportListenerClosedHandler(func(tpt transport.Transport, addr ma.Multiaddr) {
+		closedCh <- closed{tpt, addr}
+	}))
+	defer s.Close()
+	tpt := &listenRecordingTransport{
+		TcpTransport: tcp.NewTCPTransport(swarmt.GenUpgrader(s)),
+		listeners:    make(chan transport.Listener, 2),
+	}
+	if err := s.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.AddListenAddr(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l1, l2 := <-tpt.listeners, <-tpt.listeners
+
+	// The transport still has a listener left.
+	l1.Close()
+	select {
+	case c := <-closedCh:
+		t.Fatalf("handler fired with a listener left: %s", c.addr)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	l2.Close()
+	select {
+	case c := <-closedCh:
+		if c.tpt != tpt {
+			t.Errorf("expected transport %v, got %v", tpt, c.tpt)
+		}
+		if !c.addr.Equal(l2.Multiaddr()) {
+			t.Errorf("expected address %s, got %s", l2.Multiaddr(), c.addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler never fired for the last listener")
+	}
+}
+
+func TestSetDialOnlySkipsListenerClosedHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	closedCh := make(chan ma.Multiaddr, 1)
+	s := makeSwarmWithOpts(ctx, t, WithTransportListenerClosedHandler(func(_ transport.Transport, addr ma.Multiaddr) {
+		closedCh <- addr
+	}))
+	defer s.Close()
+
+	s.SetDialOnly(true)
+	select {
+	case addr := <-closedCh:
+		t.Fatalf("handler fired for the listener on %s closed by SetDialOnly", addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRemoveTransportSkipsListenerClosedHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		remove func(*Swarm, transport.Transport) error
+	}{
+		{"remove", (*Swarm).RemoveTransport},
+		{"graceful", func(s *Swarm, tpt transport.Transport) error {
+			return s.RemoveTransportGraceful(context.Background(), tpt)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			closedCh := make(chan ma.Multiaddr, 1)
+			s := makeBareSwarm(ctx, t, WithTransportListenerClosedHandler(func(_ transport.Transport, addr ma.Multiaddr) {
+				closedCh <- addr
+			}))
+			defer s.Close()
+			tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s))
+			if err := s.AddTransport(tpt); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tc.remove(s, tpt); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case addr := <-closedCh:
+				t.Fatalf("handler fired for the listener on %s of the removed transport", addr)
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestListenPortRange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Occupy a port whose successor is free.
+	var taken net.Listener
+	var port int
+	for i := 0; taken == nil; i++ {
+		if i > 10 {
+			t.Fatal("couldn't find two adjacent free ports")
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port = l.Addr().(*net.TCPAddr).Port
+		next, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port+1))
+		if err != nil {
+			l.Close()
+			continue
+		}
+		next.Close()
+		taken = l
+	}
+	defer taken.Close()
+
+	s := makeDialOnlySwarmWithOpts(ctx, t, WithListenPortRange(port, port+1))
+	defer s.Close()
+	if err := s.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	addrs := s.ListenAddresses()
+	expected := ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port+1))
+	if len(addrs) != 1 || !addrs[0].Equal(expected) {
+		t.Fatalf("expected to listen on %s, got %v", expected, addrs)
+	}
+}
+
+func TestListenInterface(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("fe80::1")}
+	addrsOf := func(name string) ([]net.IP, error) {
+		if name != "eth0" {
+			return nil, fmt.Errorf("no interface %s", name)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]net.IP(nil), ips...), nil
+	}
+
+	defer func(d time.Duration) { InterfaceRescanInterval = d }(InterfaceRescanInterval)
+	InterfaceRescanInterval = 10 * time.Millisecond
+
+	// Listeners ListenInterface closes don't fire the handler.
+	closedCh := make(chan ma.Multiaddr, 1)
+	s := makeBareSwarm(ctx, t, WithInterfaceAddrsFunc(addrsOf), WithTransportListenerClosedHandler(func(_ transport.Transport, addr ma.Multiaddr) {
+		closedCh <- addr
+	}))
+	defer s.Close()
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s))
+	if err := s.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ListenInterface("eth1", tpt, "tcp", 0); err == nil {
+		t.Fatal("expected listening on an unknown interface to fail")
+	}
+	stop, err := s.ListenInterface("eth0", tpt, "tcp", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { stop() }()
+	if _, err := s.ListenInterface("eth0", tpt, "tcp", 0); err != ErrInterfaceWatched {
+		t.Fatalf("expected ErrInterfaceWatched, got %v", err)
+	}
+
+	listeningOn := func() []string {
+		var hosts []string
+		for _, a := range s.ListenAddresses() {
+			ip, err := a.ValueForProtocol(ma.P_IP4)
+			if err != nil {
+				t.Fatalf("unexpected listen address %s", a)
+			}
+			hosts = append(hosts, ip)
+		}
+		return hosts
+	}
+	waitFor := func(expected ...string) {
+		t.Helper()
+		for i := 0; ; i++ {
+			hosts := listeningOn()
+			if fmt.Sprint(hosts) == fmt.Sprint(expected) {
+				return
+			}
+			if i > 100 {
+				t.Fatalf("expected to listen on %v, listening on %v", expected, hosts)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("127.0.0.1")
+
+	// The interface's address changes.
+	mu.Lock()
+	ips = []net.IP{net.ParseIP("127.0.0.2")}
+	mu.Unlock()
+	waitFor("127.0.0.2")
+
+	// The interface loses its address, then gets it back.
+	mu.Lock()
+	ips = nil
+	mu.Unlock()
+	waitFor()
+	mu.Lock()
+	ips = []net.IP{net.ParseIP("127.0.0.2")}
+	mu.Unlock()
+	waitFor("127.0.0.2")
+
+	// Stopping closes the listeners, and the interface can be listened on
+	// again.
+	stop()
+	waitFor()
+	select {
+	case addr := <-closedCh:
+		t.Fatalf("handler fired for the interface listener on %s", addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+	stop, err = s.ListenInterface("eth0", tpt, "tcp", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor("127.0.0.2")
+}
+
+func TestListenerStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := swarmt.GenSwarmMem(t, ctx)
+	defer s.Close()
+
+	// Two dialers get in, one whose muxer the listener doesn't speak fails
+	// the upgrade.
+	for _, opts := range [][]swarmt.Option{
+		nil,
+		nil,
+		{swarmt.OptMuxer("/mplex/6.7.0", mplex.DefaultTransport)},
+	} {
+		d := swarmt.GenSwarmMem(t, ctx, append(opts, swarmt.OptDialOnly)...)
+		defer d.Close()
+		swarmt.DivulgeAddresses(s, d)
+		_, err := d.DialPeer(ctx, s.LocalPeer())
+		if ok := opts == nil; ok != (err == nil) {
+			t.Fatalf("unexpected dial outcome: %v", err)
+		}
+	}
+
+	want := ListenerStat{
+		Addr:             s.ListenAddresses()[0],
+		Transport:        "memory",
+		AcceptsSucceeded: 2,
+		ConnsUpgraded:    2,
+		UpgradesFailed:   1,
+	}
+	var stats []ListenerStat
+	for i := 0; ; i++ {
+		stats = s.ListenerStats()
+		if len(stats) == 1 && stats[0].Addr.Equal(want.Addr) {
+			got := stats[0]
+			got.Addr = want.Addr
+			if got == want {
+				break
+			}
+		}
+		if i > 100 {
+			t.Fatalf("expected listener stats %+v, got %+v", want, stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
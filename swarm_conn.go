@@ -1,14 +1,20 @@
 package swarm
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/transport"
 
 	ma "github.com/multiformats/go-multiaddr"
@@ -19,9 +25,201 @@ import (
 // ErrConnClosed is returned when operating on a closed connection.
 var ErrConnClosed = errors.New("connection closed")
 
+// ErrConnDraining is returned when opening a stream on a draining connection.
+var ErrConnDraining = errors.New("connection draining")
+
+// ConnReleaseTimeout is how long closing an acquired connection (see
+// Conn.Acquire) waits for it to be released before closing it anyway.
+var ConnReleaseTimeout = 30 * time.Second
+
+// ErrStreamGated is returned when the swarm's stream gate refuses to open a
+// stream.
+var ErrStreamGated = errors.New("stream refused by the stream gate")
+
+// ErrResourceLimitExceeded is returned when opening a stream would take the
+// swarm over its stream memory cap (see WithMaxStreamMemory) or the peer over
+// its stream cap (see WithMaxStreamsPerPeer).
+var ErrResourceLimitExceeded = errors.New("stream resource limit exceeded")
+
+type statKey string
+
+// StatLimiterWait is the key in the Extra map of a dialed connection's Stat
+// holding the time (a time.Duration) its dial waited in the dial limiter
+// before it started.
+const StatLimiterWait = statKey("limiterWait")
+
+// StatOpened is the key in the Extra map of a stream's Stat holding the time
+// (a time.Time) the stream was opened or accepted.
+const StatOpened = statKey("opened")
+
+// NoDelayConn is implemented by transport connections that expose control over
+// Nagle's algorithm (TCP_NODELAY) on the underlying socket.
+type NoDelayConn interface {
+	SetNoDelay(noDelay bool) error
+}
+
+// LingerConn is implemented by transport connections that expose control over
+// SO_LINGER on the underlying socket. The swarm sets it right before closing
+// the connection (see WithConnLinger).
+type LingerConn interface {
+	SetLinger(d time.Duration) error
+}
+
+// TransientConn is implemented by transport connections that know whether
+// they're limited or relayed.
+type TransientConn interface {
+	IsTransient() bool
+}
+
+// ReuseportConn is implemented by transport connections that know whether
+// they share their local socket address with other connections or listeners
+// (SO_REUSEPORT). See Swarm.ReuseportStats.
+type ReuseportConn interface {
+	Reuseport() bool
+}
+
+// ConnectionState describes how a connection was established.
+type ConnectionState struct {
+	// Security is the negotiated security protocol, empty if unknown.
+	Security protocol.ID
+	// StreamMultiplexer is the negotiated stream multiplexer, empty if
+	// unknown.
+	StreamMultiplexer protocol.ID
+	// Transport is the name of the transport protocol (e.g., "tcp").
+	Transport string
+}
+
+// ConnStater is implemented by transport connections that know which security
+// protocol and stream multiplexer they negotiated.
+type ConnStater interface {
+	ConnState() ConnectionState
+}
+
+// isTransient returns true if the transport connection is relayed, either
+// because it says so or because its remote address goes through a circuit.
+func isTransient(tc transport.CapableConn) bool {
+	if t, ok := tc.(TransientConn); ok {
+		return t.IsTransient()
+	}
+	_, err := tc.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// StreamLoadBalancing selects how NewStream distributes streams when there
+// are several connections to a peer (see WithStreamLoadBalancing).
+type StreamLoadBalancing int
+
+const (
+	// BestConn opens every stream on the best connection: the newest direct
+	// connection with the most streams.
+	BestConn StreamLoadBalancing = iota
+	// RoundRobin cycles through the connections.
+	RoundRobin
+	// LeastStreams picks the connection with the fewest open streams.
+	LeastStreams
+)
+
+// connForStream picks the connection to open a new stream to the peer on,
+// according to the swarm's StreamLoadBalancing. Direct connections are always
+// preferred over transient ones, and draining connections are skipped.
+func (s *Swarm) connForStream(p peer.ID) *Conn {
+	if s.streamBalancing == BestConn {
+		return s.bestConnToPeer(p)
+	}
+
+	s.conns.RLock()
+	defer s.conns.RUnlock()
+
+	var pick *Conn
+	pickStreams := 0
+	for _, c := range s.conns.m[p] {
+		if c.conn.IsClosed() {
+			continue
+		}
+		c.streams.Lock()
+		n := len(c.streams.m)
+		draining := c.streams.drained != nil
+		c.streams.Unlock()
+		if draining {
+			continue
+		}
+
+		var better bool
+		switch {
+		case pick == nil:
+			better = true
+		case pick.transient != c.transient:
+			better = pick.transient
+		case s.streamBalancing == RoundRobin:
+			better = atomic.LoadUint64(&c.lastPicked) < atomic.LoadUint64(&pick.lastPicked)
+		default:
+			better = n < pickStreams
+		}
+		if better {
+			pick = c
+			pickStreams = n
+		}
+	}
+	if pick != nil && s.streamBalancing == RoundRobin {
+		atomic.StoreUint64(&pick.lastPicked, atomic.AddUint64(&s.streamPicks, 1))
+	}
+	return pick
+}
+
+// selectConnForStream is connForStream, unless the context carries a
+// connection selector (see WithConnSelector) in which case the selector picks
+// among the open, non-draining connections to the peer.
+func (s *Swarm) selectConnForStream(ctx context.Context, p peer.ID) (*Conn, error) {
+	sel := GetConnSelector(ctx)
+	if sel == nil {
+		return s.connForStream(p), nil
+	}
+
+	s.conns.RLock()
+	var candidates []network.Conn
+	for _, c := range s.conns.m[p] {
+		if c.conn.IsClosed() {
+			continue
+		}
+		c.streams.Lock()
+		draining := c.streams.drained != nil
+		c.streams.Unlock()
+		if !draining {
+			candidates = append(candidates, c)
+		}
+	}
+	s.conns.RUnlock()
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	picked := sel(candidates)
+	if picked == nil {
+		return s.connForStream(p), nil
+	}
+	for _, c := range candidates {
+		if c == picked {
+			return c.(*Conn), nil
+		}
+	}
+	return nil, ErrConnHintMismatch
+}
+
 // Conn is the connection type used by swarm. In general, you won't use this
 // type directly.
 type Conn struct {
+	// bytes sent and received over this connection's streams. Accessed
+	// atomically; keep these first for 64-bit alignment.
+	bytesSent uint64
+	bytesRecv uint64
+
+	// unix nano time of the last stream activity, see LastStreamActivity.
+	lastActivity int64
+
+	// value of the swarm's streamPicks when a stream was last assigned to
+	// this connection (RoundRobin stream load balancing).
+	lastPicked uint64
+
 	conn  transport.CapableConn
 	swarm *Swarm
 
@@ -33,9 +231,119 @@ type Conn struct {
 	streams struct {
 		sync.Mutex
 		m map[*Stream]struct{}
+
+		// non-nil once the connection is draining, closed when the last
+		// stream goes away.
+		drained chan struct{}
 	}
 
 	stat network.Stat
+
+	// when the connection was set up.
+	opened time.Time
+
+	// true if this connection is relayed (set at creation).
+	transient bool
+
+	// tags attached by the connection gater (set at registration).
+	tags []string
+
+	idle     connIdleState
+	lifetime connLifetimeState
+
+	// why the connection was closed, recorded when it closes.
+	closeReason struct {
+		sync.Mutex
+		set    bool
+		reason DisconnectReason
+	}
+
+	// set to 1 once a low latency stream has been requested on this conn.
+	lowLatency int32
+
+	// set to 1 while the swarm's ConnWarmupFunc is running.
+	warming int32
+
+	// traffic class the connection was dialed with (set at creation).
+	trafficClass    int
+	hasTrafficClass bool
+
+	// linger timeout applied before closing (set at creation).
+	linger    time.Duration
+	hasLinger bool
+
+	// references taken with Acquire; released is closed when the last one
+	// is released.
+	refs struct {
+		sync.Mutex
+		n        int
+		released chan struct{}
+	}
+
+	// the connection's context, created on the first call to Context so
+	// connections nobody asks for one from don't hold on to a cancel func.
+	ctx struct {
+		sync.Mutex
+		ctx    context.Context
+		cancel context.CancelFunc
+		closed bool
+	}
+}
+
+// Context returns a context derived from the swarm's context that's canceled
+// when this connection closes.
+func (c *Conn) Context() context.Context {
+	c.ctx.Lock()
+	defer c.ctx.Unlock()
+	if c.ctx.ctx == nil {
+		c.ctx.ctx, c.ctx.cancel = context.WithCancel(c.swarm.ctx)
+		if c.ctx.closed {
+			c.ctx.cancel()
+		}
+	}
+	return c.ctx.ctx
+}
+
+// cancelContext cancels the connection's context, if any, and makes sure any
+// context created later starts out canceled.
+func (c *Conn) cancelContext() {
+	c.ctx.Lock()
+	defer c.ctx.Unlock()
+	c.ctx.closed = true
+	if c.ctx.cancel != nil {
+		c.ctx.cancel()
+	}
+}
+
+// warmup runs the swarm's warmup function (if any) on this not yet registered
+// connection. On failure, the connection and any streams opened during the
+// warmup are torn down.
+func (c *Conn) warmup(ctx context.Context) error {
+	f := c.swarm.ConnWarmupFunc()
+	if f == nil {
+		return nil
+	}
+
+	atomic.StoreInt32(&c.warming, 1)
+	err := f(ctx, c)
+	atomic.StoreInt32(&c.warming, 0)
+	if err == nil {
+		return nil
+	}
+
+	// We can't use Close as the connection never took its swarm refs or
+	// fired its connect notifications.
+	c.streams.Lock()
+	streams := c.streams.m
+	c.streams.m = nil
+	c.streams.Unlock()
+
+	for s := range streams {
+		s.Reset()
+	}
+	c.conn.Close()
+	c.cancelContext()
+	return err
 }
 
 // Close closes this connection.
@@ -44,13 +352,85 @@ type Conn struct {
 // would create a deadlock when called from an open notification (because all
 // open notifications must finish before we can fire off the close
 // notifications).
+//
+// If the connection has been acquired, Close waits for it to be released, for
+// at most ConnReleaseTimeout, or until the swarm shuts down.
 func (c *Conn) Close() error {
+	return c.closeWithin(c.swarm.ctx)
+}
+
+// closeWithin closes the connection like Close, but waits for it to be
+// released only until the context expires.
+func (c *Conn) closeWithin(ctx context.Context) error {
+	c.waitReleased(ctx)
 	c.closeOnce.Do(c.doClose)
 	return c.err
 }
 
+// Acquire takes a reference to the connection, keeping Close from closing it
+// until the reference is released (see Close). It's lighter than protecting
+// the connection with the connection manager; the connection can still be
+// closed by the remote side, or by the swarm shutting down.
+//
+// The returned function releases the reference. It's safe to call more than
+// once.
+func (c *Conn) Acquire() (release func()) {
+	c.refs.Lock()
+	c.refs.n++
+	if c.refs.n == 1 {
+		c.refs.released = make(chan struct{})
+	}
+	c.refs.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.refs.Lock()
+			c.refs.n--
+			if c.refs.n == 0 {
+				close(c.refs.released)
+			}
+			c.refs.Unlock()
+		})
+	}
+}
+
+// acquired returns true if references to the connection taken with Acquire
+// haven't been released yet.
+func (c *Conn) acquired() bool {
+	c.refs.Lock()
+	defer c.refs.Unlock()
+	return c.refs.n > 0
+}
+
+// waitReleased waits for all the references to the connection to be released,
+// bounded by ConnReleaseTimeout, the context and the swarm's lifetime.
+func (c *Conn) waitReleased(ctx context.Context) {
+	c.refs.Lock()
+	released := c.refs.released
+	acquired := c.refs.n > 0
+	c.refs.Unlock()
+	if !acquired {
+		return
+	}
+
+	t := time.NewTimer(ConnReleaseTimeout)
+	defer t.Stop()
+	select {
+	case <-released:
+	case <-t.C:
+		log.Debugf("closing %s: not released within %s", c, ConnReleaseTimeout)
+	case <-ctx.Done():
+	case <-c.swarm.ctx.Done():
+	}
+}
+
 func (c *Conn) doClose() {
+	// Closed locally without a reason, unless one was given. This must stick
+	// before the muxer fails as a result of closing the connection.
+	c.setCloseReason(DisconnectUnspecified)
 	c.swarm.removeConn(c)
+	c.swarm.checkBestConn(c.RemotePeer())
 
 	// Prevent new streams from opening.
 	c.streams.Lock()
@@ -58,14 +438,19 @@ func (c *Conn) doClose() {
 	c.streams.m = nil
 	c.streams.Unlock()
 
-	c.err = c.conn.Close()
-
-	// This is just for cleaning up state. The connection has already been closed.
-	// We *could* optimize this but it really isn't worth it.
+	// Reset the streams before closing the connection so the resets reach
+	// the remote side through the muxer and its streams fail right away.
 	for s := range streams {
 		s.Reset()
 	}
 
+	c.stopIdleTracking()
+	c.stopLifetime()
+	c.setLinger()
+	c.err = c.conn.Close()
+	c.cancelContext()
+	c.swarm.recordDisconnect(c)
+
 	// do this in a goroutine to avoid deadlocking if we call close in an open notification.
 	go func() {
 		// prevents us from issuing close notifications before finishing the open notifications
@@ -75,6 +460,7 @@ func (c *Conn) doClose() {
 		c.swarm.notifyAll(func(f network.Notifiee) {
 			f.Disconnected(c.swarm, c)
 		})
+		c.swarm.publishConnEvent(EventDisconnected, c)
 		c.swarm.refs.Done() // taken in Swarm.addConn
 	}()
 }
@@ -82,7 +468,65 @@ func (c *Conn) doClose() {
 func (c *Conn) removeStream(s *Stream) {
 	c.streams.Lock()
 	delete(c.streams.m, s)
+	if len(c.streams.m) == 0 {
+		c.signalDrainedLocked()
+		c.streamsIdle()
+	}
+	c.streams.Unlock()
+	c.swarm.checkBestConn(c.RemotePeer())
+}
+
+// signalDrainedLocked wakes up Drain, if draining. The caller must hold the
+// streams lock.
+func (c *Conn) signalDrainedLocked() {
+	if c.streams.drained == nil {
+		return
+	}
+	select {
+	case <-c.streams.drained:
+	default:
+		close(c.streams.drained)
+	}
+}
+
+// Drain gracefully closes the connection: new streams are refused (inbound
+// streams are reset, NewStream fails with ErrConnDraining), existing streams
+// are given until the context expires to finish, and the connection is then
+// closed. If it has been acquired (see Acquire), Drain waits for it to be
+// released only until the context expires.
+//
+// Drain returns the context's error if streams were still open when it
+// expired.
+func (c *Conn) Drain(ctx context.Context) error {
+	c.streams.Lock()
+	if c.streams.m == nil {
+		c.streams.Unlock()
+		return ErrConnClosed
+	}
+	if c.streams.drained == nil {
+		c.streams.drained = make(chan struct{})
+		if len(c.streams.m) == 0 {
+			c.signalDrainedLocked()
+		}
+	}
+	drained := c.streams.drained
 	c.streams.Unlock()
+	c.swarm.checkBestConn(c.RemotePeer())
+
+	select {
+	case <-drained:
+		return c.closeWithin(ctx)
+	case <-ctx.Done():
+		c.closeWithin(ctx)
+		return ctx.Err()
+	}
+}
+
+// isDraining returns true once Drain has been called.
+func (c *Conn) isDraining() bool {
+	c.streams.Lock()
+	defer c.streams.Unlock()
+	return c.streams.drained != nil
 }
 
 // listens for new streams.
@@ -92,29 +536,45 @@ func (c *Conn) removeStream(s *Stream) {
 func (c *Conn) start() {
 	go func() {
 		defer c.swarm.refs.Done()
-		defer c.Close()
+		// The connection is dead at this point, there's no point in waiting
+		// for it to be released.
+		defer c.closeOnce.Do(c.doClose)
 
 		for {
 			ts, err := c.conn.AcceptStream()
 			if err != nil {
+				c.checkMuxerError(err)
+				c.setCloseReason(DisconnectRemote)
 				return
 			}
+			accepted := time.Now()
 			c.swarm.refs.Add(1)
 			go func() {
+				if !c.swarm.admitStream(network.DirInbound, c) {
+					log.Debugf("stream gate refused inbound stream on %s", c)
+					ts.Reset()
+					c.swarm.refs.Done()
+					return
+				}
+				if err := c.swarm.reserveStream(c.RemotePeer()); err != nil {
+					log.Debugf("resetting inbound stream on %s: %s", c, err)
+					ts.Reset()
+					c.swarm.refs.Done()
+					return
+				}
 				s, err := c.addStream(ts, network.DirInbound)
 
 				// Don't defer this. We don't want to block
 				// swarm shutdown on the connection handler.
 				c.swarm.refs.Done()
 
-				// We only get an error here when the swarm is closed or closing.
+				// We only get an error here when the swarm is closed or
+				// closing, or the conn is draining.
 				if err != nil {
 					return
 				}
 
-				if h := c.swarm.StreamHandler(); h != nil {
-					h(s)
-				}
+				c.swarm.handleInboundStream(s, accepted)
 			}()
 		}
 	}()
@@ -161,37 +621,226 @@ func (c *Conn) RemotePublicKey() ic.PubKey {
 	return c.conn.RemotePublicKey()
 }
 
+// ConnState returns the security protocol, stream multiplexer and transport
+// used by this connection.
+//
+// The security protocol and stream multiplexer are only known if the transport
+// connection implements ConnStater. If it doesn't report a transport, it's
+// derived from the connection's transport.
+func (c *Conn) ConnState() ConnectionState {
+	var state ConnectionState
+	if cs, ok := c.conn.(ConnStater); ok {
+		state = cs.ConnState()
+	}
+	if state.Transport == "" {
+		if protos := c.conn.Transport().Protocols(); len(protos) > 0 {
+			if proto := ma.ProtocolWithCode(protos[0]); proto.Code != 0 {
+				state.Transport = proto.Name
+			}
+		}
+	}
+	return state
+}
+
+// TrafficClass returns the traffic class this connection was dialed with, if
+// the dialing transport supported setting one.
+func (c *Conn) TrafficClass() (tc int, ok bool) {
+	return c.trafficClass, c.hasTrafficClass
+}
+
 // Stat returns metadata pertaining to this connection
 func (c *Conn) Stat() network.Stat {
 	return c.stat
 }
 
+// Opened returns the time the connection was set up.
+func (c *Conn) Opened() time.Time {
+	return c.opened
+}
+
+// BytesSent returns the number of bytes written to this connection's streams.
+func (c *Conn) BytesSent() uint64 {
+	return atomic.LoadUint64(&c.bytesSent)
+}
+
+// BytesRecv returns the number of bytes read from this connection's streams.
+func (c *Conn) BytesRecv() uint64 {
+	return atomic.LoadUint64(&c.bytesRecv)
+}
+
+// Tags returns the tags the connection gater attached to this connection when
+// allowing it (see UpgradedConnGater).
+func (c *Conn) Tags() []string {
+	return append([]string(nil), c.tags...)
+}
+
+// HasTag returns true if the connection gater attached the given tag to this
+// connection.
+func (c *Conn) HasTag(tag string) bool {
+	for _, t := range c.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTransient returns true if this connection is relayed or otherwise limited.
+func (c *Conn) IsTransient() bool {
+	return c.transient
+}
+
+// LowLatency returns true if a low latency stream has been requested on this
+// connection (see WithLowLatency).
+func (c *Conn) LowLatency() bool {
+	return atomic.LoadInt32(&c.lowLatency) == 1
+}
+
+func (c *Conn) setLowLatency() {
+	if !atomic.CompareAndSwapInt32(&c.lowLatency, 0, 1) {
+		return
+	}
+	if nd, ok := c.conn.(NoDelayConn); ok {
+		if err := nd.SetNoDelay(true); err != nil {
+			log.Debugf("failed to set no delay on %s: %s", c, err)
+		}
+	}
+}
+
+func (c *Conn) setLinger() {
+	if !c.hasLinger {
+		return
+	}
+	if lc, ok := c.conn.(LingerConn); ok {
+		if err := lc.SetLinger(c.linger); err != nil {
+			log.Debugf("failed to set linger on %s: %s", c, err)
+		}
+	}
+}
+
+// MuxerProtocolError is implemented by the errors of stream multiplexers that
+// tell whether the remote side violated the protocol.
+type MuxerProtocolError interface {
+	error
+	ProtocolError() bool
+}
+
+// checkMuxerError calls the swarm's muxer error handler if the connection's
+// muxer stopped accepting streams because of a protocol error, that is, for
+// any reason but the connection being closed or failing: errors implementing
+// MuxerProtocolError say so themselves, EOFs, closed pipes and socket errors
+// (net.OpError) aren't protocol errors.
+func (c *Conn) checkMuxerError(err error) {
+	h := c.swarm.muxerErrorHandler
+	if h == nil {
+		return
+	}
+
+	// Closed locally?
+	c.streams.Lock()
+	closed := c.streams.m == nil
+	c.streams.Unlock()
+	if closed {
+		return
+	}
+
+	var perr MuxerProtocolError
+	var operr *net.OpError
+	switch {
+	case errors.As(err, &perr):
+		if !perr.ProtocolError() {
+			return
+		}
+	case err == io.EOF, err == io.ErrUnexpectedEOF, err == io.ErrClosedPipe:
+		return
+	case errors.As(err, &operr):
+		return
+	}
+	log.Debugf("muxer protocol error on %s: %s", c, err)
+	h(c, err)
+}
+
 // NewStream returns a new Stream from this connection
 func (c *Conn) NewStream() (network.Stream, error) {
+	if c.isDraining() {
+		return nil, ErrConnDraining
+	}
+	if !c.swarm.admitStream(network.DirOutbound, c) {
+		return nil, ErrStreamGated
+	}
+	if err := c.swarm.reserveStream(c.RemotePeer()); err != nil {
+		return nil, err
+	}
 	ts, err := c.conn.OpenStream()
 	if err != nil {
+		c.swarm.releaseStream(c.RemotePeer())
 		return nil, err
 	}
 	return c.addStream(ts, network.DirOutbound)
 }
 
+// NewStreamWithData opens a new stream over the connection, like NewStream,
+// and writes the given data to it before returning. The write is bounded by
+// the context's deadline, if any. If the data can't be written in full, the
+// stream is reset and the error returned.
+func (c *Conn) NewStreamWithData(ctx context.Context, data []byte) (network.Stream, error) {
+	s, err := c.NewStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeInitialData(ctx, s, data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LastStreamActivity returns the last time a stream was opened on the
+// connection, or data was read from or written to one of its streams. It's the
+// time the connection was set up if it never had any stream activity.
+func (c *Conn) LastStreamActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+func (c *Conn) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
 func (c *Conn) addStream(ts mux.MuxedStream, dir network.Direction) (*Stream, error) {
 	c.streams.Lock()
 	// Are we still online?
 	if c.streams.m == nil {
 		c.streams.Unlock()
 		ts.Reset()
+		c.swarm.releaseStream(c.RemotePeer())
 		return nil, ErrConnClosed
 	}
+	if c.streams.drained != nil {
+		c.streams.Unlock()
+		ts.Reset()
+		c.swarm.releaseStream(c.RemotePeer())
+		return nil, ErrConnDraining
+	}
 
 	// Wrap and register the stream.
-	stat := network.Stat{Direction: dir}
+	opened := time.Now()
+	stat := network.Stat{
+		Direction: dir,
+		Extra:     map[interface{}]interface{}{StatOpened: opened},
+	}
 	s := &Stream{
 		stream: ts,
 		conn:   c,
 		stat:   stat,
+		silent: atomic.LoadInt32(&c.warming) == 1,
+		opened: opened,
 	}
+	c.touch()
+	s.readTimeout = c.swarm.streamReadTimeout
+	s.writeTimeout = c.swarm.streamWriteTimeout
 	c.streams.m[s] = struct{}{}
+	if len(c.streams.m) == 1 {
+		c.streamsActive()
+	}
 
 	// Released once the stream disconnect notifications have finished
 	// firing (in Swarm.remove).
@@ -202,16 +851,21 @@ func (c *Conn) addStream(ts mux.MuxedStream, dir network.Direction) (*Stream, er
 	// done.
 	s.notifyLk.Lock()
 	c.streams.Unlock()
+	c.swarm.checkBestConn(c.RemotePeer())
 
-	c.swarm.notifyAll(func(f network.Notifiee) {
-		f.OpenedStream(c.swarm, s)
-	})
+	if !s.silent {
+		c.swarm.notifyAll(func(f network.Notifiee) {
+			f.OpenedStream(c.swarm, s)
+		})
+	}
 	s.notifyLk.Unlock()
 
 	return s, nil
 }
 
-// GetStreams returns the streams associated with this connection.
+// GetStreams returns the streams associated with this connection. The
+// returned slice is a snapshot; it isn't affected by streams opening or
+// closing afterwards.
 func (c *Conn) GetStreams() []network.Stream {
 	c.streams.Lock()
 	defer c.streams.Unlock()
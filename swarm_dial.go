@@ -4,17 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/transport"
 	lgbl "github.com/libp2p/go-libp2p-loggables"
 
 	logging "github.com/ipfs/go-log"
 	addrutil "github.com/libp2p/go-addr-util"
 	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+	manet "github.com/multiformats/go-multiaddr-net"
 )
 
 // Diagram of dial sync:
@@ -40,6 +46,18 @@ var (
 	// given multiaddr.
 	ErrNoTransport = errors.New("no transport for protocol")
 
+	// ErrTransportNotRegistered is returned when removing a transport that
+	// isn't registered with the swarm.
+	ErrTransportNotRegistered = errors.New("transport not registered")
+
+	// ErrDialQueueFull is returned when dialing a peer would exceed the
+	// limit on dials in progress (see WithMaxPendingDials).
+	ErrDialQueueFull = errors.New("too many dials in progress")
+
+	// ErrNoTransports is returned when dialing or listening on a swarm that
+	// has no transports registered at all.
+	ErrNoTransports = errors.New("no transports registered")
+
 	// ErrAllDialsFailed is returned when connecting to a peer has ultimately failed
 	ErrAllDialsFailed = errors.New("all dials failed")
 
@@ -50,6 +68,46 @@ var (
 	// ErrNoGoodAddresses is returned when we find addresses for a peer but
 	// can't use any of them.
 	ErrNoGoodAddresses = errors.New("no good addresses")
+
+	// ErrUpgradeTimeout is returned when upgrading a dialed connection takes
+	// longer than the configured upgrade timeout.
+	ErrUpgradeTimeout = errors.New("connection upgrade timed out")
+
+	// ErrGaterDisallowedPeer is returned when the connection gater refuses
+	// dials to the peer.
+	ErrGaterDisallowedPeer = errors.New("gater disallows dialing peer")
+
+	// ErrGaterDisallowedAddr is returned when the connection gater refuses
+	// dials to every usable address of the peer.
+	ErrGaterDisallowedAddr = errors.New("gater disallows dialing all addresses")
+
+	// ErrGaterDisallowedConn is returned when the connection gater refuses
+	// a dialed connection (see UpgradedConnGater).
+	ErrGaterDisallowedConn = errors.New("gater disallows connection")
+
+	// ErrDuplicateConn is returned when an inbound connection from an
+	// already connected peer is refused (see RejectNew).
+	ErrDuplicateConn = errors.New("already connected to peer")
+
+	// ErrNoKnownDirectAddrs is returned by DialPeerIfKnown when the
+	// peerstore has no usable literal (non-DNS) address for the peer.
+	ErrNoKnownDirectAddrs = errors.New("no known direct addresses")
+
+	// ErrListenPortReuseUnsupported is returned by DialFromListenPort when
+	// the address's transport can't dial from its listen socket.
+	ErrListenPortReuseUnsupported = errors.New("transport can't dial from its listen port")
+
+	// ErrNotListening is returned by DialFromListenPort when the swarm
+	// doesn't listen on the address's transport.
+	ErrNotListening = errors.New("not listening on transport")
+
+	// ErrListenPortNotReused is returned by DialFromListenPort when the
+	// transport dialed from another port than its listen port.
+	ErrListenPortNotReused = errors.New("dial didn't reuse the listen port")
+
+	// ErrDialFailureThresholdExceeded is returned when dialing a peer that
+	// failed too many dials in a row (see WithDialFailureThreshold).
+	ErrDialFailureThresholdExceeded = errors.New("dial failure threshold exceeded")
 )
 
 // DialAttempts governs how many times a goroutine will try to dial a given peer.
@@ -99,6 +157,13 @@ const DefaultPerPeerRateLimit = 8
 type DialBackoff struct {
 	entries map[peer.ID]map[string]*backoffAddr
 	lock    sync.RWMutex
+
+	// jitter randomizes backoff durations within [0, computed backoff].
+	jitter bool
+	rand   *rand.Rand
+
+	// disabled turns AddBackoff into a no-op, see WithDisableBackoff.
+	disabled bool
 }
 
 type backoffAddr struct {
@@ -129,6 +194,9 @@ func (db *DialBackoff) background(ctx context.Context) {
 // Backoff returns whether the client should backoff from dialing
 // peer p at address addr
 func (db *DialBackoff) Backoff(p peer.ID, addr ma.Multiaddr) (backoff bool) {
+	if db.disabled {
+		return false
+	}
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
@@ -156,6 +224,9 @@ var BackoffMax = time.Minute * 5
 //
 // Where PriorBackoffs is the number of previous backoffs.
 func (db *DialBackoff) AddBackoff(p peer.ID, addr ma.Multiaddr) {
+	if db.disabled {
+		return
+	}
 	saddr := string(addr.Bytes())
 	db.lock.Lock()
 	defer db.lock.Unlock()
@@ -168,7 +239,7 @@ func (db *DialBackoff) AddBackoff(p peer.ID, addr ma.Multiaddr) {
 	if !ok {
 		bp[saddr] = &backoffAddr{
 			tries: 1,
-			until: time.Now().Add(BackoffBase),
+			until: time.Now().Add(db.jittered(BackoffBase)),
 		}
 		return
 	}
@@ -177,10 +248,23 @@ func (db *DialBackoff) AddBackoff(p peer.ID, addr ma.Multiaddr) {
 	if backoffTime > BackoffMax {
 		backoffTime = BackoffMax
 	}
-	ba.until = time.Now().Add(backoffTime)
+	ba.until = time.Now().Add(db.jittered(backoffTime))
 	ba.tries++
 }
 
+// jittered applies full jitter to the given backoff duration, if enabled.
+//
+// Must be called with the lock held.
+func (db *DialBackoff) jittered(d time.Duration) time.Duration {
+	if !db.jitter || d <= 0 {
+		return d
+	}
+	if db.rand == nil {
+		db.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return time.Duration(db.rand.Int63n(int64(d) + 1))
+}
+
 // Clear removes a backoff record. Clients should call this after a
 // successful Dial.
 func (db *DialBackoff) Clear(p peer.ID) {
@@ -221,37 +305,698 @@ func (s *Swarm) DialPeer(ctx context.Context, p peer.ID) (network.Conn, error) {
 	return s.dialPeer(ctx, p)
 }
 
-// internal dial method that returns an unwrapped conn
+// DialConfig describes the effective dial limits and timeouts of a swarm.
+type DialConfig struct {
+	// FdLimit is the maximum number of concurrent dials consuming file
+	// descriptors.
+	FdLimit int
+	// PerPeerLimit is the maximum number of concurrent dials to a peer.
+	PerPeerLimit int
+
+	// RateLimit is the maximum number of dials started per second, and
+	// RateBurst the burst allowed on top of it. Both are 0 without a rate
+	// limit (see WithDialRateLimit).
+	RateLimit int
+	RateBurst int
+
+	// DialTimeout bounds each dial to a single address (see WithDialTimeout
+	// and transport.DialTimeout).
+	DialTimeout time.Duration
+	// DialPeerTimeout bounds DialPeer when the context doesn't override it
+	// (network.DialPeerTimeout).
+	DialPeerTimeout time.Duration
+	// UpgradeTimeout bounds the upgrade of outbound connections, 0 for no
+	// separate bound (see WithUpgradeTimeout).
+	UpgradeTimeout time.Duration
+	// HappyEyeballsDelay is the default delay between dials to a peer's
+	// addresses (see WithDefaultHappyEyeballsDelay).
+	HappyEyeballsDelay time.Duration
+}
+
+// DialConfig returns the swarm's effective dial configuration, whether set
+// by options or left at the defaults.
+func (s *Swarm) DialConfig() DialConfig {
+	cfg := DialConfig{
+		FdLimit:            s.limiter.fdLimit,
+		PerPeerLimit:       s.limiter.perPeerLimit,
+		DialTimeout:        transport.DialTimeout,
+		DialPeerTimeout:    network.DialPeerTimeout,
+		UpgradeTimeout:     s.upgradeTimeout,
+		HappyEyeballsDelay: s.happyEyeballsDelay,
+	}
+	if s.dialTimeout > 0 {
+		cfg.DialTimeout = s.dialTimeout
+	}
+	if r := s.limiter.rate; r != nil {
+		cfg.RateLimit = r.perSecond
+		cfg.RateBurst = r.burst
+	}
+	return cfg
+}
+
+// PeerDialResult is the outcome of dialing one of the peers passed to
+// DialPeers.
+type PeerDialResult struct {
+	Peer peer.ID
+	Conn network.Conn
+	Err  error
+}
+
+// DialPeers dials all the given peers, at most concurrency of them at a time
+// (no limit if concurrency is not positive), on top of the swarm's usual dial
+// limits. It returns a channel delivering each peer's result as soon as its
+// dial finishes; the channel is closed once every peer has been dialed.
 //
-// It is gated by the swarm's dial synchronization systems: dialsync and
-// dialbackoff.
-func (s *Swarm) dialPeer(ctx context.Context, p peer.ID) (*Conn, error) {
-	log.Debugf("[%s] swarm dialing peer [%s]", s.local, p)
-	var logdial = lgbl.Dial("swarm", s.LocalPeer(), p, nil, nil)
-	err := p.Validate()
+// The channel is buffered to hold every result, so callers may stop reading
+// early without leaking goroutines.
+func (s *Swarm) DialPeers(ctx context.Context, peers []peer.ID, concurrency int) <-chan PeerDialResult {
+	results := make(chan PeerDialResult, len(peers))
+	if concurrency <= 0 || concurrency > len(peers) {
+		concurrency = len(peers)
+	}
+
+	work := make(chan peer.ID)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				res := PeerDialResult{Peer: p}
+				if c, err := s.dialPeer(ctx, p); err != nil {
+					res.Err = err
+				} else {
+					res.Conn = c
+				}
+				results <- res
+			}
+		}()
+	}
+	go func() {
+		for _, p := range peers {
+			work <- p
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// DialReport describes the outcome of DialPeerBestEffort.
+type DialReport struct {
+	Peer peer.ID
+
+	// Attempts lists the outcome of every address considered, in the order
+	// the outcomes were reported.
+	Attempts []DialAttempt
+
+	// Conn is the resulting connection, if any.
+	Conn network.Conn
+
+	// Err is set when the dial didn't get to attempt all addresses (e.g.,
+	// because there were none or the context expired).
+	Err error
+}
+
+// DialAttempt is the outcome of dialing a single address.
+type DialAttempt struct {
+	Addr ma.Multiaddr
+	// Err is nil if the address was dialed successfully.
+	Err error
+}
+
+// DialState is the state of the dial of an address.
+type DialState int
+
+const (
+	// DialQueued dials wait for the dial limiter to start them.
+	DialQueued DialState = iota
+	// DialDialing dials are connecting to the address.
+	DialDialing
+)
+
+func (s DialState) String() string {
+	switch s {
+	case DialQueued:
+		return "queued"
+	case DialDialing:
+		return "dialing"
+	default:
+		return fmt.Sprintf("DialState(%d)", int(s))
+	}
+}
+
+// AddrDialState describes the dial of one address of a peer in progress.
+type AddrDialState struct {
+	Addr  ma.Multiaddr
+	State DialState
+	// Queued is when the dial was handed to the dial limiter.
+	Queued time.Time
+}
+
+// CurrentDialAttempts returns the addresses of the peer the swarm is dialing
+// right now, and whether each dial is queued or connecting. Addresses already
+// dialed, and those not yet handed to the dial limiter (e.g. in a later tier,
+// or waiting for the happy eyeballs delay), aren't reported.
+func (s *Swarm) CurrentDialAttempts(p peer.ID) []AddrDialState {
+	return s.limiter.dialStates(p)
+}
+
+// DialPeerIfKnown dials the given peer like DialPeer, but only using the
+// literal IP addresses already in the peerstore: DNS addresses aren't resolved
+// and the address discovery function (see SetAddrDiscoveryFunc) isn't
+// consulted. If there are no such addresses, it fails with
+// ErrNoKnownDirectAddrs.
+//
+// A dial to the peer that's already in progress is joined like with DialPeer,
+// whatever addresses it uses.
+func (s *Swarm) DialPeerIfKnown(ctx context.Context, p peer.ID) (network.Conn, error) {
+	if c := s.bestConnToPeer(p); c != nil {
+		return c, nil
+	}
+	if len(s.filterKnownUndialables(literalAddrs(s.peerAddrs(p)))) == 0 {
+		return nil, ErrNoKnownDirectAddrs
+	}
+	return s.dialPeer(withKnownAddrsOnly(ctx), p)
+}
+
+type knownAddrsOnlyKey struct{}
+
+func withKnownAddrsOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, knownAddrsOnlyKey{}, true)
+}
+
+func knownAddrsOnly(ctx context.Context) bool {
+	v, _ := ctx.Value(knownAddrsOnlyKey{}).(bool)
+	return v
+}
+
+// literalAddrs returns the addresses that don't need DNS resolution.
+func literalAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	out := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if !madns.Matches(a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// DialDiagnostics describes how DialPeerWithResult went.
+type DialDiagnostics struct {
+	Peer peer.ID
+
+	// Duration is the time the dial took.
+	Duration time.Duration
+
+	// Addr and Transport are the remote address and the transport (see
+	// ConnectionState) of the resulting connection, if any.
+	Addr      ma.Multiaddr
+	Transport string
+
+	// Attempts lists the outcome of every address dialed, in the order the
+	// outcomes were reported. It's empty when an existing connection was
+	// returned or the dial joined one already in progress.
+	Attempts []DialAttempt
+}
+
+// DialPeerWithResult dials the given peer like DialPeer, additionally
+// describing the dial. The diagnostics are filled in on failure too.
+func (s *Swarm) DialPeerWithResult(ctx context.Context, p peer.ID) (network.Conn, DialDiagnostics, error) {
+	diag := DialDiagnostics{Peer: p}
+	rec := new(dialRecorder)
+	start := time.Now()
+	c, err := s.dialPeer(withDialRecorder(ctx, rec), p)
+	diag.Duration = time.Since(start)
+	diag.Attempts = rec.get()
 	if err != nil {
+		return nil, diag, err
+	}
+	diag.Addr = c.RemoteMultiaddr()
+	diag.Transport = c.ConnState().Transport
+	return c, diag, nil
+}
+
+// dialRecorder collects the dial attempts of a dial, see DialPeerWithResult.
+type dialRecorder struct {
+	mu       sync.Mutex
+	attempts []DialAttempt
+}
+
+type dialRecorderKey struct{}
+
+func withDialRecorder(ctx context.Context, rec *dialRecorder) context.Context {
+	return context.WithValue(ctx, dialRecorderKey{}, rec)
+}
+
+func getDialRecorder(ctx context.Context) *dialRecorder {
+	rec, _ := ctx.Value(dialRecorderKey{}).(*dialRecorder)
+	return rec
+}
+
+// record records a dial attempt. It's a no-op on a nil recorder.
+func (rec *dialRecorder) record(addr ma.Multiaddr, err error) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	rec.attempts = append(rec.attempts, DialAttempt{Addr: addr, Err: err})
+	rec.mu.Unlock()
+}
+
+func (rec *dialRecorder) get() []DialAttempt {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]DialAttempt(nil), rec.attempts...)
+}
+
+// DialPeerBestEffort attempts to dial every known address of the given peer
+// and reports what happened, instead of returning at the first success or
+// failing with a single error.
+//
+// The first successful connection is added to the swarm and returned in the
+// report; later successful connections are closed. It never blocks past ctx.
+//
+// If the peer is already connected, the existing connection is reported
+// without dialing unless the context carries the WithAdditionalConn hint. If
+// ctx expires first, the addresses still being dialed are reported with the
+// context's error.
+func (s *Swarm) DialPeerBestEffort(ctx context.Context, p peer.ID) DialReport {
+	report := DialReport{Peer: p}
+	if c, err := s.checkDialPeer(ctx, p, !GetAdditionalConn(ctx)); err != nil {
+		report.Err = err
+		return report
+	} else if c != nil {
+		report.Conn = c
+		return report
+	}
+
+	peerAddrs := s.resolveAddrs(ctx, p, s.peerAddrs(p))
+	if len(peerAddrs) == 0 {
+		report.Err = ErrNoAddresses
+		return report
+	}
+	goodAddrs := s.filterKnownUndialables(peerAddrs)
+	if len(goodAddrs) == 0 {
+		report.Err = ErrNoGoodAddresses
+		return report
+	}
+	goodAddrs = s.gateAddrs(p, goodAddrs)
+	if len(goodAddrs) == 0 {
+		report.Err = ErrGaterDisallowedAddr
+		return report
+	}
+	goodAddrs = s.rankAddrs(p, goodAddrs)
+	if len(goodAddrs) == 0 {
+		report.Err = ErrNoGoodAddresses
+		return report
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	respch := make(chan dialResult)
+	defer s.limiter.clearPeerDials(p, respch)
+
+	atomic.AddUint64(&s.counters.dialsAttempted, 1)
+	defer func() {
+		if report.Conn != nil {
+			atomic.AddUint64(&s.counters.dialsSucceeded, 1)
+			s.ResetDialFailures(p)
+			return
+		}
+		atomic.AddUint64(&s.counters.dialsFailed, 1)
+		s.forgetTransport(p)
+		if ctx.Err() == nil {
+			s.recordDialFailure(p)
+		}
+	}()
+
+	// addresses being dialed, by their bytes.
+	pending := make(map[string]int)
+	var active []ma.Multiaddr
+	for _, a := range goodAddrs {
+		if s.backf.Backoff(p, a) {
+			report.Attempts = append(report.Attempts, DialAttempt{Addr: a, Err: ErrDialBackoff})
+			continue
+		}
+		s.limitedDial(ctx, p, a, respch)
+		active = append(active, a)
+		pending[string(a.Bytes())]++
+	}
+
+	for range active {
+		select {
+		case <-ctx.Done():
+			report.Err = ctx.Err()
+			for _, a := range active {
+				if key := string(a.Bytes()); pending[key] > 0 {
+					pending[key]--
+					report.Attempts = append(report.Attempts, DialAttempt{Addr: a, Err: report.Err})
+				}
+			}
+			return report
+		case resp := <-respch:
+			pending[string(resp.Addr.Bytes())]--
+			if resp.Err != nil {
+				if resp.Err != context.Canceled {
+					s.backf.AddBackoff(p, resp.Addr)
+				}
+				report.Attempts = append(report.Attempts, DialAttempt{Addr: resp.Addr, Err: resp.Err})
+				continue
+			}
+			if report.Conn != nil {
+				resp.Conn.Close()
+				report.Attempts = append(report.Attempts, DialAttempt{Addr: resp.Addr})
+				continue
+			}
+			c, err := s.addOutboundConn(ctx, resp.Conn, resp.Wait)
+			if err == nil {
+				report.Conn = c
+			}
+			report.Attempts = append(report.Attempts, DialAttempt{Addr: resp.Addr, Err: err})
+		}
+	}
+	return report
+}
+
+// DialFromListenPort dials the peer on the given address from the socket the
+// swarm listens on for the address's transport, so the connection's local
+// port is the listen port (as needed for hole punching). The transport must
+// support it (see ListenPortReuser).
+//
+// It always establishes a new connection, even if the peer is already
+// connected, and bypasses dial synchronization and backoff.
+func (s *Swarm) DialFromListenPort(ctx context.Context, p peer.ID, addr ma.Multiaddr) (network.Conn, error) {
+	if err := p.Validate(); err != nil {
 		return nil, err
 	}
+	if p == s.local {
+		return nil, ErrDialToSelf
+	}
+	if !s.gatePeer(p) {
+		return nil, ErrGaterDisallowedPeer
+	}
+	if len(s.gateAddrs(p, []ma.Multiaddr{addr})) == 0 {
+		return nil, ErrGaterDisallowedAddr
+	}
+
+	tpt := s.TransportForDialing(addr)
+	if tpt == nil {
+		return nil, ErrNoTransport
+	}
+	if r, ok := tpt.(ListenPortReuser); !ok || !r.ReusesListenPort() {
+		return nil, ErrListenPortReuseUnsupported
+	}
+	var listenAddrs []ma.Multiaddr
+	for _, a := range s.ListenAddresses() {
+		if s.TransportForListening(a) == tpt {
+			listenAddrs = append(listenAddrs, a)
+		}
+	}
+	if len(listenAddrs) == 0 {
+		return nil, ErrNotListening
+	}
+
+	ctx, cancel := context.WithCancel(WithReuseListenPort(ctx))
+	defer cancel()
+	respch := make(chan dialResult, 1)
+	defer s.limiter.clearPeerDials(p, respch)
+
+	s.limitedDial(ctx, p, addr, respch)
+	var resp dialResult
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case resp = <-respch:
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	if !sameListenPort(resp.Conn.LocalMultiaddr(), listenAddrs) {
+		resp.Conn.Close()
+		return nil, ErrListenPortNotReused
+	}
+	return s.addOutboundConn(ctx, resp.Conn, resp.Wait)
+}
+
+// sameListenPort returns true if laddr binds the same port as one of the
+// listen addresses. The IP address is ignored as the swarm may listen on an
+// unspecified one.
+func sameListenPort(laddr ma.Multiaddr, listenAddrs []ma.Multiaddr) bool {
+	port := withoutIP(laddr)
+	for _, a := range listenAddrs {
+		if withoutIP(a).Equal(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutIP(a ma.Multiaddr) ma.Multiaddr {
+	first, rest := ma.SplitFirst(a)
+	if first == nil || rest == nil {
+		return a
+	}
+	switch first.Protocol().Code {
+	case ma.P_IP4, ma.P_IP6:
+		return rest
+	}
+	return a
+}
 
+// DialPeerOnce dials the peer on the given addresses, or on its known
+// addresses if none are given, independently of any other dial: unlike
+// DialPeer, it's neither deduplicated against dials to the peer in progress
+// (see DialSync) nor satisfied by an existing connection. Every call can thus
+// create an extra connection to the peer, e.g., to check that a newly learned
+// address works.
+//
+// Addresses in dial backoff are dialed anyway. The first connection
+// established is returned; the others are closed.
+func (s *Swarm) DialPeerOnce(ctx context.Context, p peer.ID, addrs []ma.Multiaddr) (network.Conn, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
 	if p == s.local {
-		log.Event(ctx, "swarmDialSelf", logdial)
 		return nil, ErrDialToSelf
 	}
+	if !s.gatePeer(p) {
+		return nil, &DialError{Peer: p, Cause: ErrGaterDisallowedPeer}
+	}
+	if !s.hasTransports() {
+		return nil, ErrNoTransports
+	}
 
-	defer log.EventBegin(ctx, "swarmDialAttemptSync", p).Done()
+	if len(addrs) == 0 {
+		addrs = s.resolveAddrs(ctx, p, s.peerAddrs(p))
+		if len(addrs) == 0 {
+			return nil, &DialError{Peer: p, Cause: ErrNoAddresses}
+		}
+	}
+	goodAddrs := s.filterKnownUndialables(addrs)
+	if len(goodAddrs) == 0 {
+		return nil, &DialError{Peer: p, Cause: ErrNoGoodAddresses}
+	}
+	goodAddrs = s.gateAddrs(p, goodAddrs)
+	if len(goodAddrs) == 0 {
+		return nil, &DialError{Peer: p, Cause: ErrGaterDisallowedAddr}
+	}
+	goodAddrs = s.rankAddrs(p, goodAddrs)
+	if len(goodAddrs) == 0 {
+		return nil, &DialError{Peer: p, Cause: ErrNoGoodAddresses}
+	}
 
-	// check if we already have an open connection first
-	conn := s.bestConnToPeer(p)
-	if conn != nil {
-		return conn, nil
+	// Canceling the context on return cancels the dials still queued and
+	// closes the connections nobody receives. Don't clear the peer's dials
+	// from the limiter: some may belong to other dials.
+	ctx, cancel := context.WithTimeout(ctx, network.GetDialPeerTimeout(ctx))
+	defer cancel()
+
+	respch := make(chan dialResult)
+	for _, a := range goodAddrs {
+		s.limitedDial(ctx, p, a, respch)
+	}
+	dialErr := &DialError{Peer: p}
+	for range goodAddrs {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case resp := <-respch:
+			if resp.Err != nil {
+				if resp.Err != context.Canceled {
+					s.backf.AddBackoff(p, resp.Addr)
+				}
+				dialErr.recordErr(resp.Addr, resp.Err)
+				continue
+			}
+			c, err := s.addOutboundConn(ctx, resp.Conn, resp.Wait)
+			if err != nil {
+				resp.Conn.Close()
+				return nil, &DialError{Peer: p, Cause: err}
+			}
+			return c, nil
+		}
+	}
+	return nil, dialErr
+}
+
+// SimultaneousConnectGracePeriod is how long the side of a simultaneous open
+// that isn't the client waits for the client's connection once its own dial
+// succeeded, see Swarm.SimultaneousConnect.
+var SimultaneousConnectGracePeriod = 5 * time.Second
+
+// SimultaneousConnect dials the peer on addr while the peer dials us, as
+// coordinated by a hole punching protocol such as DCUtR, and settles on a
+// single direct connection both sides agree on: the one dialed by the side
+// with the lowest peer ID, the client (see WithSimultaneousConnect). The other
+// connection is closed.
+//
+// The client returns the connection it dialed, or the peer's if its own dial
+// failed. The other side returns the client's connection once it arrives,
+// waiting for it up to SimultaneousConnectGracePeriod after its own dial
+// succeeded; if it doesn't arrive, the client's dial presumably failed and
+// the connection it dialed is returned. A direct inbound connection the peer
+// opened just before the call counts as the client's.
+//
+// Like DialPeerOnce, it bypasses dial synchronization, backoff and existing
+// connections.
+func (s *Swarm) SimultaneousConnect(ctx context.Context, p peer.ID, addr ma.Multiaddr) (network.Conn, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if p == s.local {
+		return nil, ErrDialToSelf
+	}
+	if !s.gatePeer(p) {
+		return nil, &DialError{Peer: p, Cause: ErrGaterDisallowedPeer}
+	}
+	isClient := s.local < p
+
+	ctx, cancel := context.WithTimeout(ctx, network.GetDialPeerTimeout(ctx))
+	defer cancel()
+
+	// Watch for the peer's connection before dialing so we can't miss it.
+	inbound := make(chan network.Conn, 1)
+	offer := func(c network.Conn) {
+		if c.RemotePeer() != p || c.Stat().Direction != network.DirInbound {
+			return
+		}
+		if sc, ok := c.(*Conn); ok && sc.transient {
+			return
+		}
+		select {
+		case inbound <- c:
+		default:
+		}
+	}
+	nb := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) { offer(c) },
+	}
+	s.Notify(nb)
+	defer s.StopNotify(nb)
+	for _, c := range s.ConnsToPeer(p) {
+		offer(c)
+	}
+
+	type dialOutcome struct {
+		c   network.Conn
+		err error
+	}
+	mine := make(chan dialOutcome, 1)
+	go func() {
+		c, err := s.DialPeerOnce(WithSimultaneousConnect(ctx, isClient), p, []ma.Multiaddr{addr})
+		mine <- dialOutcome{c, err}
+	}()
+
+	if isClient {
+		var dialErr error
+		select {
+		case r := <-mine:
+			if r.err == nil {
+				return r.c, nil
+			}
+			dialErr = r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// Our dial failed: settle on the peer's, if it gets through.
+		select {
+		case c := <-inbound:
+			return c, nil
+		case <-ctx.Done():
+			return nil, dialErr
+		}
+	}
+
+	var own network.Conn
+	var dialErr error
+	var grace <-chan time.Time
+	for {
+		select {
+		case c := <-inbound:
+			if own != nil {
+				own.Close()
+			} else if mine != nil {
+				go func(mine <-chan dialOutcome) {
+					if r := <-mine; r.err == nil {
+						r.c.Close()
+					}
+				}(mine)
+			}
+			return c, nil
+		case r := <-mine:
+			mine = nil
+			if r.err != nil {
+				// Wait for the client's connection.
+				dialErr = r.err
+				continue
+			}
+			own = r.c
+			t := time.NewTimer(SimultaneousConnectGracePeriod)
+			defer t.Stop()
+			grace = t.C
+		case <-grace:
+			return own, nil
+		case <-ctx.Done():
+			if own != nil {
+				return own, nil
+			}
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			return nil, ctx.Err()
+		}
 	}
+}
+
+// internal dial method that returns an unwrapped conn
+//
+// It is gated by the swarm's dial synchronization systems: dialsync and
+// dialbackoff.
+func (s *Swarm) dialPeer(ctx context.Context, p peer.ID) (*Conn, error) {
+	log.Debugf("[%s] swarm dialing peer [%s]", s.local, p)
+	conn, err := s.checkDialPeer(ctx, p, true)
+	if err == ErrGaterDisallowedPeer {
+		return nil, &DialError{Peer: p, Cause: err}
+	}
+	if conn != nil || err != nil {
+		return conn, err
+	}
+	defer log.EventBegin(ctx, "swarmDialAttemptSync", p).Done()
 
 	// apply the DialPeer timeout
 	ctx, cancel := context.WithTimeout(ctx, network.GetDialPeerTimeout(ctx))
 	defer cancel()
+	if s.maxPeerDialDuration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.maxPeerDialDuration)
+		defer cancel()
+	}
 
+	start := time.Now()
 	conn, err = s.dsync.DialLock(ctx, p)
 	if err == nil {
+		s.observeNearTimeout(ctx, p, start)
 		return conn, nil
 	}
 
@@ -270,6 +1015,59 @@ func (s *Swarm) dialPeer(ctx context.Context, p peer.ID) (*Conn, error) {
 	return nil, err
 }
 
+// checkDialPeer runs the checks before dialing the peer. It returns the
+// existing connection to the peer, if any and reuseConn is set, or an error if
+// the peer mustn't be dialed.
+func (s *Swarm) checkDialPeer(ctx context.Context, p peer.ID, reuseConn bool) (*Conn, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	if p == s.local {
+		log.Event(ctx, "swarmDialSelf", lgbl.Dial("swarm", s.LocalPeer(), p, nil, nil))
+		return nil, ErrDialToSelf
+	}
+
+	if !s.gatePeer(p) {
+		log.Debugf("gater disallowed outbound connection to peer %s", p)
+		return nil, ErrGaterDisallowedPeer
+	}
+
+	// check if we already have an open connection first
+	if reuseConn {
+		if conn := s.bestConnToPeer(p); conn != nil {
+			return conn, nil
+		}
+	}
+
+	if !s.hasTransports() {
+		return nil, ErrNoTransports
+	}
+
+	if s.dialFailureThresholdExceeded(p) {
+		return nil, ErrDialFailureThresholdExceeded
+	}
+	return nil, nil
+}
+
+// observeNearTimeout calls the near timeout observer (if any) if the dial to p
+// started at start succeeded with less than the observer's threshold of its
+// time budget left.
+func (s *Swarm) observeNearTimeout(ctx context.Context, p peer.ID, start time.Time) {
+	if s.nearTimeoutObserver == nil {
+		return
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	budget := deadline.Sub(start)
+	remaining := time.Until(deadline)
+	if float64(remaining) < s.nearTimeoutThreshold*float64(budget) {
+		s.nearTimeoutObserver(p, remaining)
+	}
+}
+
 // doDial is an ugly shim method to retain all the logging and backoff logic
 // of the old dialsync code
 func (s *Swarm) doDial(ctx context.Context, p peer.ID) (*Conn, error) {
@@ -287,10 +1085,12 @@ func (s *Swarm) doDial(ctx context.Context, p peer.ID) (*Conn, error) {
 	// if it succeeds, dial will add the conn to the swarm itself.
 	defer log.EventBegin(ctx, "swarmDialAttemptStart", logdial).Done()
 
+	atomic.AddUint64(&s.counters.dialsAttempted, 1)
 	conn, err := s.dial(ctx, p)
 	if err != nil {
 		conn = s.bestConnToPeer(p)
 		if conn != nil {
+			atomic.AddUint64(&s.counters.dialsSucceeded, 1)
 			// Hm? What error?
 			// Could have canceled the dial because we received a
 			// connection or some other random reason.
@@ -300,11 +1100,53 @@ func (s *Swarm) doDial(ctx context.Context, p peer.ID) (*Conn, error) {
 		}
 
 		// ok, we failed.
+		atomic.AddUint64(&s.counters.dialsFailed, 1)
+		s.forgetTransport(p)
+		if ctx.Err() == nil {
+			s.recordDialFailure(p)
+		}
 		return nil, err
 	}
+	atomic.AddUint64(&s.counters.dialsSucceeded, 1)
+	s.ResetDialFailures(p)
 	return conn, nil
 }
 
+// dialFailureThresholdExceeded returns true if the peer failed at least the
+// swarm's dial failure threshold of dials in a row.
+func (s *Swarm) dialFailureThresholdExceeded(p peer.ID) bool {
+	if s.dialFailureThreshold <= 0 {
+		return false
+	}
+	s.dialFailures.Lock()
+	defer s.dialFailures.Unlock()
+	return s.dialFailures.m[p] >= s.dialFailureThreshold
+}
+
+func (s *Swarm) recordDialFailure(p peer.ID) {
+	if s.dialFailureThreshold <= 0 {
+		return
+	}
+	s.dialFailures.Lock()
+	defer s.dialFailures.Unlock()
+	if s.dialFailures.m == nil {
+		s.dialFailures.m = make(map[peer.ID]int)
+	}
+	s.dialFailures.m[p]++
+}
+
+// ResetDialFailures forgets the consecutive dial failures of the given peer,
+// allowing it to be dialed again once it exceeded the dial failure threshold
+// (see WithDialFailureThreshold).
+func (s *Swarm) ResetDialFailures(p peer.ID) {
+	if s.dialFailureThreshold <= 0 {
+		return
+	}
+	s.dialFailures.Lock()
+	defer s.dialFailures.Unlock()
+	delete(s.dialFailures.m, p)
+}
+
 func (s *Swarm) canDial(addr ma.Multiaddr) bool {
 	t := s.TransportForDialing(addr)
 	return t != nil && t.CanDial(addr)
@@ -335,31 +1177,48 @@ func (s *Swarm) dial(ctx context.Context, p peer.ID) (*Conn, error) {
 		the improved rate limiter, while maintaining the outward behaviour
 		that we previously had (halting a dial when we run out of addrs)
 	*/
-	peerAddrs := s.peers.Addrs(p)
-	if len(peerAddrs) == 0 {
-		return nil, &DialError{Peer: p, Cause: ErrNoAddresses}
+	peerAddrs := s.peerAddrs(p)
+	var goodAddrs []ma.Multiaddr
+	if knownAddrsOnly(ctx) {
+		goodAddrs = s.filterKnownUndialables(literalAddrs(peerAddrs))
+		if len(goodAddrs) == 0 {
+			return nil, &DialError{Peer: p, Cause: ErrNoKnownDirectAddrs}
+		}
+	} else {
+		goodAddrs = s.filterKnownUndialables(s.resolveAddrs(ctx, p, peerAddrs))
 	}
-	goodAddrs := s.filterKnownUndialables(peerAddrs)
+	if len(goodAddrs) == 0 {
+		discovered := s.discoverAddrs(ctx, p)
+		if len(peerAddrs) == 0 && len(discovered) == 0 {
+			return nil, &DialError{Peer: p, Cause: ErrNoAddresses}
+		}
+		goodAddrs = s.filterKnownUndialables(s.resolveAddrs(ctx, p, discovered))
+	}
+	if len(goodAddrs) == 0 {
+		return nil, &DialError{Peer: p, Cause: ErrNoGoodAddresses}
+	}
+	goodAddrs = s.gateAddrs(p, goodAddrs)
+	if len(goodAddrs) == 0 {
+		return nil, &DialError{Peer: p, Cause: ErrGaterDisallowedAddr}
+	}
+	goodAddrs = s.rankAddrs(p, goodAddrs)
 	if len(goodAddrs) == 0 {
 		return nil, &DialError{Peer: p, Cause: ErrNoGoodAddresses}
 	}
-	goodAddrsChan := make(chan ma.Multiaddr, len(goodAddrs))
-	nonBackoff := false
+	nonBackoff := goodAddrs[:0:0]
 	for _, a := range goodAddrs {
 		// skip addresses in back-off
 		if !s.backf.Backoff(p, a) {
-			nonBackoff = true
-			goodAddrsChan <- a
+			nonBackoff = append(nonBackoff, a)
 		}
 	}
-	close(goodAddrsChan)
-	if !nonBackoff {
+	if len(nonBackoff) == 0 {
 		return nil, ErrDialBackoff
 	}
 	/////////
 
-	// try to get a connection to any addr
-	connC, dialErr := s.dialAddrs(ctx, p, goodAddrsChan)
+	// try to get a connection to any addr, one tier at a time
+	res, dialErr := s.dialAddrTiers(ctx, p, s.tierAddrs(nonBackoff))
 	if dialErr != nil {
 		logdial["error"] = dialErr.Cause.Error()
 		switch dialErr.Cause {
@@ -373,11 +1232,13 @@ func (s *Swarm) dial(ctx context.Context, p peer.ID) (*Conn, error) {
 		}
 		return nil, dialErr
 	}
+	connC := res.Conn
 	logdial["conn"] = logging.Metadata{
 		"localAddr":  connC.LocalMultiaddr(),
 		"remoteAddr": connC.RemoteMultiaddr(),
 	}
-	swarmC, err := s.addConn(connC, network.DirOutbound)
+	logdial["limiterWait"] = res.Wait.String()
+	swarmC, err := s.addOutboundConn(ctx, connC, res.Wait)
 	if err != nil {
 		logdial["error"] = err.Error()
 		connC.Close() // close the connection. didn't work out :(
@@ -388,6 +1249,449 @@ func (s *Swarm) dial(ctx context.Context, p peer.ID) (*Conn, error) {
 	return swarmC, nil
 }
 
+// AddrRanker orders the dialable addresses of a peer, most preferred first.
+// It may drop addresses that shouldn't be dialed at all.
+//
+// Addresses are handed to the dial limiter in the returned order. As the
+// limiter dials several addresses of a peer concurrently, the order decides
+// which dials start first, not that they run one at a time.
+type AddrRanker func(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr
+
+// NetworkCondition describes the network the local node is on, as reported by
+// the application, see Swarm.SetNetworkCondition.
+type NetworkCondition int
+
+const (
+	// NetworkNormal is an unmetered, wired or Wi-Fi network.
+	NetworkNormal NetworkCondition = iota
+	// NetworkMobile is a mobile or otherwise metered network.
+	NetworkMobile
+)
+
+func (c NetworkCondition) String() string {
+	switch c {
+	case NetworkNormal:
+		return "normal"
+	case NetworkMobile:
+		return "mobile"
+	default:
+		return fmt.Sprintf("NetworkCondition(%d)", int(c))
+	}
+}
+
+// SetNetworkCondition tells the swarm what network it's on, e.g., when the
+// operating system reports a network change. Without a ranker (see
+// WithAddrRanker), the swarm dials QUIC addresses first on NetworkMobile, as
+// QUIC needs fewer round trips to connect and survives address changes.
+func (s *Swarm) SetNetworkCondition(c NetworkCondition) {
+	atomic.StoreInt32(&s.netCondition, int32(c))
+}
+
+// NetworkCondition returns the network condition set with
+// SetNetworkCondition, NetworkNormal by default.
+func (s *Swarm) NetworkCondition() NetworkCondition {
+	return NetworkCondition(atomic.LoadInt32(&s.netCondition))
+}
+
+// rankByNetworkCondition is the ranking used without a ranker.
+func (s *Swarm) rankByNetworkCondition(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if s.NetworkCondition() != NetworkMobile {
+		return addrs
+	}
+	return preferProtocol(ma.P_QUIC, addrs)
+}
+
+// SetReachability tells the swarm whether it's reachable from the public
+// internet, e.g., as determined by AutoNAT. When network.ReachabilityPrivate,
+// relay addresses are dialed before direct ones without a ranker (see
+// WithAddrRanker), and listed first by ListenAddresses and
+// InterfaceListenAddresses so that they're advertised more prominently.
+func (s *Swarm) SetReachability(r network.Reachability) {
+	atomic.StoreInt32(&s.reachability, int32(r))
+}
+
+// Reachability returns the reachability set with SetReachability,
+// network.ReachabilityUnknown by default.
+func (s *Swarm) Reachability() network.Reachability {
+	return network.Reachability(atomic.LoadInt32(&s.reachability))
+}
+
+// rankByReachability moves relay addresses to the front when the swarm is
+// privately reachable.
+func (s *Swarm) rankByReachability(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if s.Reachability() != network.ReachabilityPrivate {
+		return addrs
+	}
+	return preferProtocol(ma.P_CIRCUIT, addrs)
+}
+
+// preferProtocol stably moves the addresses using the given protocol to the
+// front.
+func preferProtocol(code int, addrs []ma.Multiaddr) []ma.Multiaddr {
+	ranked := make([]ma.Multiaddr, 0, len(addrs))
+	var rest []ma.Multiaddr
+	for _, a := range addrs {
+		if _, err := a.ValueForProtocol(code); err == nil {
+			ranked = append(ranked, a)
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	return append(ranked, rest...)
+}
+
+// rankAddrs orders the given addresses with the swarm's ranker, or by network
+// condition and reachability without one (see SetNetworkCondition and
+// SetReachability), and then moves the addresses using the transports of
+// existing connections to the peer to the front (see WithReuseConnTransport).
+func (s *Swarm) rankAddrs(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	if s.ranker != nil {
+		addrs = s.ranker(p, addrs)
+	} else {
+		addrs = s.rankByReachability(s.rankByNetworkCondition(addrs))
+	}
+	if s.stickyTransport {
+		if t := s.stickyTransportTo(p); t != nil {
+			addrs = preferTransports([]transport.Transport{t}, addrs)
+		}
+	}
+	if s.reuseConnTransport {
+		addrs = s.preferConnTransports(p, addrs)
+	}
+	return addrs
+}
+
+// preferConnTransports stably moves the addresses dialable with a transport
+// already used by a connection to the peer to the front.
+func (s *Swarm) preferConnTransports(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	var used []transport.Transport
+	for _, c := range s.ConnsToPeer(p) {
+		used = append(used, c.(*Conn).conn.Transport())
+	}
+	return preferTransports(used, addrs)
+}
+
+// preferTransports stably moves the addresses dialable with one of the given
+// transports to the front.
+func preferTransports(tpts []transport.Transport, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if len(tpts) == 0 {
+		return addrs
+	}
+	// Compare transports by what they can dial rather than by identity: the
+	// transport a connection reports may be wrapped by the one registered
+	// with the swarm.
+	reuses := func(a ma.Multiaddr) bool {
+		for _, t := range tpts {
+			if t.CanDial(a) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ranked := make([]ma.Multiaddr, 0, len(addrs))
+	var rest []ma.Multiaddr
+	for _, a := range addrs {
+		if reuses(a) {
+			ranked = append(ranked, a)
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	return append(ranked, rest...)
+}
+
+// rememberTransport records the transport of the address the peer was just
+// dialed on (see WithStickyTransport).
+func (s *Swarm) rememberTransport(p peer.ID, addr ma.Multiaddr) {
+	if !s.stickyTransport {
+		return
+	}
+	t := s.TransportForDialing(addr)
+	if t == nil {
+		return
+	}
+	s.lastTransport.Lock()
+	defer s.lastTransport.Unlock()
+	if s.lastTransport.m == nil {
+		s.lastTransport.m = make(map[peer.ID]transport.Transport)
+	}
+	s.lastTransport.m[p] = t
+}
+
+func (s *Swarm) forgetTransport(p peer.ID) {
+	if !s.stickyTransport {
+		return
+	}
+	s.lastTransport.Lock()
+	defer s.lastTransport.Unlock()
+	delete(s.lastTransport.m, p)
+}
+
+func (s *Swarm) stickyTransportTo(p peer.ID) transport.Transport {
+	s.lastTransport.Lock()
+	defer s.lastTransport.Unlock()
+	return s.lastTransport.m[p]
+}
+
+// tierAddrs groups the given addresses by the tier assigned to them by the
+// swarm's tier function, lowest tier first. The order of the addresses within
+// a tier is preserved.
+func (s *Swarm) tierAddrs(addrs []ma.Multiaddr) [][]ma.Multiaddr {
+	if s.tierOf == nil {
+		return [][]ma.Multiaddr{addrs}
+	}
+	byTier := make(map[int][]ma.Multiaddr)
+	var tiers []int
+	for _, a := range addrs {
+		t := s.tierOf(a)
+		if _, ok := byTier[t]; !ok {
+			tiers = append(tiers, t)
+		}
+		byTier[t] = append(byTier[t], a)
+	}
+	sort.Ints(tiers)
+	grouped := make([][]ma.Multiaddr, 0, len(tiers))
+	for _, t := range tiers {
+		grouped = append(grouped, byTier[t])
+	}
+	return grouped
+}
+
+// dialAddrTiers dials the tiers of addresses in order, moving on to the next
+// tier only when every dial in the current one failed. The errors of all the
+// tiers attempted are collected into the returned DialError.
+func (s *Swarm) dialAddrTiers(ctx context.Context, p peer.ID, tiers [][]ma.Multiaddr) (dialResult, *DialError) {
+	var dialErr *DialError
+	for _, tier := range tiers {
+		addrsChan := make(chan ma.Multiaddr, len(tier))
+		for _, a := range tier {
+			addrsChan <- a
+		}
+		close(addrsChan)
+
+		res, err := s.dialAddrs(ctx, p, addrsChan)
+		if err == nil {
+			return res, nil
+		}
+		if dialErr == nil {
+			dialErr = err
+		} else {
+			for _, te := range err.DialErrors {
+				dialErr.recordErr(te.Address, te.Cause)
+			}
+			dialErr.Skipped += err.Skipped
+			dialErr.Cause = err.Cause
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return dialResult{}, dialErr
+}
+
+// AddrDiscoveryFunc looks up addresses for a peer.
+type AddrDiscoveryFunc func(ctx context.Context, p peer.ID) []ma.Multiaddr
+
+// SetAddrDiscoveryFunc assigns a function used to find addresses for a peer
+// when DialPeer finds no usable addresses for it in the peerstore. Discovered
+// addresses are added to the peerstore (with a temporary TTL) and dialed.
+func (s *Swarm) SetAddrDiscoveryFunc(f AddrDiscoveryFunc) {
+	s.discovery.Store(f)
+}
+
+// discoverAddrs runs the address discovery function (if any) for the given
+// peer, adding the addresses it finds to the peerstore.
+func (s *Swarm) discoverAddrs(ctx context.Context, p peer.ID) []ma.Multiaddr {
+	f, _ := s.discovery.Load().(AddrDiscoveryFunc)
+	if f == nil {
+		return nil
+	}
+	addrs := f(ctx, p)
+	if len(addrs) > 0 {
+		log.Debugf("discovered %d addresses for %s", len(addrs), p)
+		s.peers.AddAddrs(p, addrs, peerstore.TempAddrTTL)
+	}
+	return s.filterNewAddrs(p, addrs)
+}
+
+// NewAddrFilter rewrites the addresses of a peer before they're dialed. It
+// may drop, reorder or normalize them, and must not modify the given slice.
+type NewAddrFilter func(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr
+
+// SetNewAddrFilter assigns a function applied to a peer's addresses every
+// time they're taken from the peerstore (or from address discovery) to be
+// dialed. It's meant as a single place to normalize or filter addresses
+// learned from other peers, e.g. through identify, without touching the
+// peerstore itself.
+func (s *Swarm) SetNewAddrFilter(f NewAddrFilter) {
+	s.addrFilter.Store(f)
+}
+
+// peerAddrs returns the peer's addresses from the peerstore, passed through
+// the NewAddrFilter.
+func (s *Swarm) peerAddrs(p peer.ID) []ma.Multiaddr {
+	return s.filterNewAddrs(p, s.peers.Addrs(p))
+}
+
+func (s *Swarm) filterNewAddrs(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	f, _ := s.addrFilter.Load().(NewAddrFilter)
+	if f == nil || len(addrs) == 0 {
+		return addrs
+	}
+	return f(p, addrs)
+}
+
+// DefaultResolutionCacheTTL is the default amount of time resolved DNS
+// multiaddrs are cached for.
+const DefaultResolutionCacheTTL = time.Minute
+
+// resolveCache caches the results of DNS multiaddr resolution.
+type resolveCache struct {
+	sync.Mutex
+	ttl time.Duration
+	m   map[string]*resolvedEntry
+}
+
+type resolvedEntry struct {
+	addr     ma.Multiaddr
+	resolved []ma.Multiaddr
+	expires  time.Time
+}
+
+func (rc *resolveCache) get(addr ma.Multiaddr) ([]ma.Multiaddr, bool) {
+	rc.Lock()
+	defer rc.Unlock()
+	e, ok := rc.m[string(addr.Bytes())]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(rc.m, string(addr.Bytes()))
+		return nil, false
+	}
+	return e.resolved, true
+}
+
+func (rc *resolveCache) put(addr ma.Multiaddr, resolved []ma.Multiaddr) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.ttl <= 0 {
+		return
+	}
+	if rc.m == nil {
+		rc.m = make(map[string]*resolvedEntry)
+	}
+	rc.m[string(addr.Bytes())] = &resolvedEntry{
+		addr:     addr,
+		resolved: resolved,
+		expires:  time.Now().Add(rc.ttl),
+	}
+}
+
+func (rc *resolveCache) entries() []ResolvedAddr {
+	rc.Lock()
+	defer rc.Unlock()
+	now := time.Now()
+	entries := make([]ResolvedAddr, 0, len(rc.m))
+	for _, e := range rc.m {
+		if now.After(e.expires) {
+			continue
+		}
+		entries = append(entries, ResolvedAddr{
+			Addr:     e.addr,
+			Resolved: append([]ma.Multiaddr(nil), e.resolved...),
+			Expires:  e.expires,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Addr.String() < entries[j].Addr.String()
+	})
+	return entries
+}
+
+func (rc *resolveCache) flush() {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.m = nil
+}
+
+// ResolvedAddr is an entry of the swarm's DNS resolution cache.
+type ResolvedAddr struct {
+	// Addr is the DNS multiaddr that was resolved.
+	Addr ma.Multiaddr
+	// Resolved holds the addresses it resolved to.
+	Resolved []ma.Multiaddr
+	// Expires is when the entry expires, see WithResolutionCacheTTL.
+	Expires time.Time
+}
+
+// ResolutionCacheEntries returns the unexpired entries of the DNS resolution
+// cache, sorted by address.
+func (s *Swarm) ResolutionCacheEntries() []ResolvedAddr {
+	return s.resolved.entries()
+}
+
+// FlushResolutionCache empties the DNS resolution cache, so that addresses are
+// resolved afresh on their next dial, e.g., after a DNS failover.
+func (s *Swarm) FlushResolutionCache() {
+	s.resolved.flush()
+}
+
+// ResolveAddr resolves a DNS multiaddr (/dns4, /dns6, /dnsaddr) the same way
+// the swarm does before dialing: with the resolver set by
+// WithMultiaddrResolver, through the resolution cache. Addresses that don't
+// need resolving, or all addresses if no resolver is set, are returned as-is.
+func (s *Swarm) ResolveAddr(ctx context.Context, addr ma.Multiaddr) ([]ma.Multiaddr, error) {
+	return s.resolveAddr(ctx, addr)
+}
+
+// resolveAddr resolves a single DNS multiaddr using the swarm's resolver and
+// resolution cache. Addresses that don't need resolving are returned as-is.
+func (s *Swarm) resolveAddr(ctx context.Context, addr ma.Multiaddr) ([]ma.Multiaddr, error) {
+	if s.maResolver == nil || !madns.Matches(addr) {
+		return []ma.Multiaddr{addr}, nil
+	}
+	if resolved, ok := s.resolved.get(addr); ok {
+		return resolved, nil
+	}
+	resolved, err := s.maResolver.Resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.resolved.put(addr, resolved)
+	return resolved, nil
+}
+
+// resolveAddrs resolves the DNS multiaddrs of peer p. Resolved addresses
+// belonging to other peers are dropped and the /p2p component of addresses
+// belonging to p is stripped.
+func (s *Swarm) resolveAddrs(ctx context.Context, p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if s.maResolver == nil {
+		return addrs
+	}
+
+	out := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		resolved, err := s.resolveAddr(ctx, addr)
+		if err != nil {
+			log.Debugf("failed to resolve %s: %s", addr, err)
+			continue
+		}
+		for _, ra := range resolved {
+			ra, id := peer.SplitAddr(ra)
+			if ra == nil || (id != "" && id != p) {
+				continue
+			}
+			out = append(out, ra)
+		}
+	}
+	return out
+}
+
 // filterKnownUndialables takes a list of multiaddrs, and removes those
 // that we definitely don't want to dial: addresses configured to be blocked,
 // IPv6 link-local addresses, addresses without a dial-capable transport,
@@ -413,7 +1717,7 @@ func (s *Swarm) filterKnownUndialables(addrs []ma.Multiaddr) []ma.Multiaddr {
 	)
 }
 
-func (s *Swarm) dialAddrs(ctx context.Context, p peer.ID, remoteAddrs <-chan ma.Multiaddr) (transport.CapableConn, *DialError) {
+func (s *Swarm) dialAddrs(ctx context.Context, p peer.ID, remoteAddrs <-chan ma.Multiaddr) (dialResult, *DialError) {
 	log.Debugf("%s swarm dialing %s", s.local, p)
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -422,8 +1726,23 @@ func (s *Swarm) dialAddrs(ctx context.Context, p peer.ID, remoteAddrs <-chan ma.
 	// use a single response type instead of errs and conns, reduces complexity *a ton*
 	respch := make(chan dialResult)
 	err := &DialError{Peer: p}
+	rec := getDialRecorder(ctx)
 
-	defer s.limiter.clearAllPeerDials(p)
+	defer s.limiter.clearPeerDials(p, respch)
+
+	// Stagger the dials (happy eyeballs): while stagger is set, the next
+	// address is only dialed once it fires or a dial fails.
+	delay := s.happyEyeballsDelay
+	if d, ok := GetHappyEyeballsDelay(ctx); ok {
+		delay = d
+	}
+	var stagger *time.Timer
+	var staggered <-chan time.Time
+	defer func() {
+		if stagger != nil {
+			stagger.Stop()
+		}
+	}()
 
 	var active int
 dialLoop:
@@ -434,6 +1753,7 @@ dialLoop:
 			break dialLoop
 		case resp := <-respch:
 			active--
+			rec.record(resp.Addr, resp.Err)
 			if resp.Err != nil {
 				// Errors are normal, lots of dials will fail
 				if resp.Err != context.Canceled {
@@ -442,8 +1762,9 @@ dialLoop:
 
 				log.Infof("got error on dial: %s", resp.Err)
 				err.recordErr(resp.Addr, resp.Err)
+				staggered = nil
 			} else if resp.Conn != nil {
-				return resp.Conn, nil
+				return resp, nil
 			}
 
 			// We got a result, try again from the top.
@@ -452,8 +1773,12 @@ dialLoop:
 		}
 
 		// Now, attempt to dial.
+		nextAddrs := remoteAddrs
+		if staggered != nil {
+			nextAddrs = nil
+		}
 		select {
-		case addr, ok := <-remoteAddrs:
+		case addr, ok := <-nextAddrs:
 			if !ok {
 				remoteAddrs = nil
 				continue
@@ -461,10 +1786,27 @@ dialLoop:
 
 			s.limitedDial(ctx, p, addr, respch)
 			active++
+			if delay > 0 {
+				if stagger == nil {
+					stagger = time.NewTimer(delay)
+				} else {
+					if !stagger.Stop() {
+						select {
+						case <-stagger.C:
+						default:
+						}
+					}
+					stagger.Reset(delay)
+				}
+				staggered = stagger.C
+			}
+		case <-staggered:
+			staggered = nil
 		case <-ctx.Done():
 			break dialLoop
 		case resp := <-respch:
 			active--
+			rec.record(resp.Addr, resp.Err)
 			if resp.Err != nil {
 				// Errors are normal, lots of dials will fail
 				if resp.Err != context.Canceled {
@@ -473,8 +1815,9 @@ dialLoop:
 
 				log.Infof("got error on dial: %s", resp.Err)
 				err.recordErr(resp.Addr, resp.Err)
+				staggered = nil
 			} else if resp.Conn != nil {
-				return resp.Conn, nil
+				return resp, nil
 			}
 		}
 	}
@@ -486,7 +1829,7 @@ dialLoop:
 	} else {
 		err.Cause = ErrAllDialsFailed
 	}
-	return nil, err
+	return dialResult{}, err
 }
 
 // limitedDial will start a dial to the given peer when
@@ -513,7 +1856,26 @@ func (s *Swarm) dialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) (tra
 		return nil, ErrNoTransport
 	}
 
-	connC, err := tpt.Dial(ctx, addr, p)
+	if order := s.SecurityPreference(); len(order) > 0 {
+		ctx = WithSecurityPreference(ctx, order)
+	}
+	ctx = s.withResumption(ctx, p)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	id := s.pending.add(PendingConn{
+		Peer:       p,
+		RemoteAddr: addr,
+		Direction:  network.DirOutbound,
+	}, cancel)
+	connC, err := s.hedgedDialTransport(ctx, tpt, addr, p)
+	if err != nil && s.muxerFallback && ctx.Err() == nil && isMuxerNegotiationErr(err) {
+		if alt, ok := alternateMuxer(ctx, tpt); ok {
+			log.Debugf("muxer negotiation with %s %s failed, retrying with %s: %s", p, addr, alt, err)
+			connC, err = s.hedgedDialTransport(WithPreferredMuxer(ctx, alt), tpt, addr, p)
+		}
+	}
+	s.pending.remove(id)
 	if err != nil {
 		return nil, err
 	}
@@ -529,3 +1891,117 @@ func (s *Swarm) dialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) (tra
 	// success! we got one!
 	return connC, nil
 }
+
+// hedgedDialTransport dials the given address over tpt, racing duplicate
+// dials against it if hedging is enabled (see WithAddrHedging). It returns the
+// first connection established, or the last error once all dials failed.
+func (s *Swarm) hedgedDialTransport(ctx context.Context, tpt transport.Transport, addr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if s.hedgeCount <= 0 {
+		return s.dialTransport(ctx, tpt, addr, p)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn transport.CapableConn
+		err  error
+	}
+	results := make(chan result, s.hedgeCount+1)
+	dial := func() {
+		c, err := s.dialTransport(ctx, tpt, addr, p)
+		results <- result{c, err}
+	}
+
+	go dial()
+	started, done := 1, 0
+	hedge := time.NewTimer(s.hedgeDelay)
+	defer hedge.Stop()
+
+	var err error
+	for done < started {
+		var hedgeC <-chan time.Time
+		if started <= s.hedgeCount {
+			hedgeC = hedge.C
+		}
+		select {
+		case <-hedgeC:
+			log.Debugf("hedging dial to %s %s", p, addr)
+			started++
+			go dial()
+			hedge.Reset(s.hedgeDelay)
+		case r := <-results:
+			done++
+			if r.err != nil {
+				err = r.err
+				continue
+			}
+			// Close the losers that connect anyway.
+			go func(n int) {
+				for i := 0; i < n; i++ {
+					if r := <-results; r.err == nil {
+						r.conn.Close()
+					}
+				}
+			}(started - done)
+			return r.conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialTransport dials the given address over tpt. If an upgrade timeout is
+// configured and the transport supports it, the raw connect and the upgrade
+// are performed as separate steps so that the upgrade timeout only governs the
+// latter. Transports that can only dial with a traffic class in one step have
+// the upgrade timeout govern the whole dial.
+func (s *Swarm) dialTransport(ctx context.Context, tpt transport.Transport, addr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if tc, ok := GetConnTrafficClass(ctx); ok {
+		if rtpt, ok := tpt.(RawTrafficClassDialer); ok && s.upgradeTimeout > 0 {
+			raw, err := rtpt.DialRawWithTrafficClass(ctx, addr, p, tc)
+			if err != nil {
+				return nil, err
+			}
+			return s.upgradeOutbound(ctx, rtpt, raw, p)
+		}
+		if tctpt, ok := tpt.(TrafficClassDialer); ok {
+			if s.upgradeTimeout <= 0 {
+				return tctpt.DialWithTrafficClass(ctx, addr, p, tc)
+			}
+			uctx, cancel := context.WithTimeout(ctx, s.upgradeTimeout)
+			defer cancel()
+			connC, err := tctpt.DialWithTrafficClass(uctx, addr, p, tc)
+			if err != nil && ctx.Err() == nil && uctx.Err() == context.DeadlineExceeded {
+				return nil, ErrUpgradeTimeout
+			}
+			return connC, err
+		}
+	}
+
+	utpt, ok := tpt.(UpgradableTransport)
+	if !ok || s.upgradeTimeout <= 0 {
+		return tpt.Dial(ctx, addr, p)
+	}
+
+	raw, err := utpt.DialRaw(ctx, addr, p)
+	if err != nil {
+		return nil, err
+	}
+	return s.upgradeOutbound(ctx, utpt, raw, p)
+}
+
+// upgradeOutbound upgrades a raw connection dialed over utpt within the
+// upgrade timeout.
+func (s *Swarm) upgradeOutbound(ctx context.Context, utpt UpgradableTransport, raw manet.Conn, p peer.ID) (transport.CapableConn, error) {
+	uctx, cancel := context.WithTimeout(ctx, s.upgradeTimeout)
+	defer cancel()
+	connC, err := utpt.UpgradeOutbound(uctx, raw, p)
+	if err != nil {
+		raw.Close()
+		if ctx.Err() == nil && uctx.Err() == context.DeadlineExceeded {
+			return nil, ErrUpgradeTimeout
+		}
+		return nil, err
+	}
+	return connC, nil
+}
@@ -1,17 +1,226 @@
 package swarm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/transport"
 
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
 )
 
+// InboundDuplicateConnPolicy decides what happens when an inbound connection
+// arrives from a peer the swarm is already connected to (see
+// WithInboundDuplicateConnPolicy).
+type InboundDuplicateConnPolicy int
+
+const (
+	// KeepDuplicates keeps both the existing and the new connections.
+	KeepDuplicates InboundDuplicateConnPolicy = iota
+	// RejectNew closes the new connection.
+	RejectNew
+	// ReplaceOld closes the existing connections in favor of the new one,
+	// except the acquired ones (see Conn.Acquire).
+	ReplaceOld
+)
+
+var (
+	// ErrNoListener is returned when no listener matches the given address.
+	ErrNoListener = errors.New("no listener for address")
+
+	// ErrDialOnly is returned when listening while the swarm is dial-only
+	// (see SetDialOnly).
+	ErrDialOnly = errors.New("swarm is dial-only")
+
+	// ErrInterfaceWatched is returned by ListenInterface for an interface
+	// it's already listening on.
+	ErrInterfaceWatched = errors.New("already listening on interface")
+)
+
+// listenerState tracks a listener's transport, whether its accept loop is
+// paused and its counters.
+type listenerState struct {
+	// counters reported by ListenerStats. Accessed atomically; keep first
+	// for 64-bit alignment.
+	accepted, acceptFailed uint64
+
+	tpt transport.Transport
+
+	// set, under the listeners lock, when closed on purpose (e.g. by
+	// SetDialOnly or RemoveTransport).
+	closedOnPurpose bool
+
+	mu     sync.Mutex
+	paused chan struct{} // closed on resume, nil when not paused
+}
+
+func (ls *listenerState) pause() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.paused == nil {
+		ls.paused = make(chan struct{})
+	}
+}
+
+func (ls *listenerState) resume() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.paused != nil {
+		close(ls.paused)
+		ls.paused = nil
+	}
+}
+
+// waitResumed blocks while the listener is paused. It returns false if the
+// context is canceled first.
+func (ls *listenerState) waitResumed(ctx context.Context) bool {
+	ls.mu.Lock()
+	paused := ls.paused
+	ls.mu.Unlock()
+	if paused == nil {
+		return true
+	}
+	select {
+	case <-paused:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// PausableListener is implemented by listeners that can stop accepting
+// connections on their socket, leaving new ones queued (e.g. in the OS
+// backlog) before any handshake.
+type PausableListener interface {
+	transport.Listener
+
+	// Pause stops accepting connections until Resume is called.
+	Pause()
+	Resume()
+}
+
+// PauseListener stops accepting new connections on the listener listening on
+// the given address, without closing it, until ResumeListener is called.
+//
+// If the listener is a PausableListener, it stops accepting on its socket: the
+// socket stays bound, incoming connections queue up and the remote dials
+// don't complete. Other listeners, such as the transport upgrader's, keep
+// securing and multiplexing incoming connections in the background, so the
+// remote dials may complete; the swarm just doesn't take the connections.
+func (s *Swarm) PauseListener(addr ma.Multiaddr) error {
+	l, ls := s.listenerFor(addr)
+	if ls == nil {
+		return ErrNoListener
+	}
+	ls.pause()
+	if pl, ok := l.(PausableListener); ok {
+		pl.Pause()
+	}
+	return nil
+}
+
+// ResumeListener resumes accepting connections on a listener paused with
+// PauseListener.
+func (s *Swarm) ResumeListener(addr ma.Multiaddr) error {
+	l, ls := s.listenerFor(addr)
+	if ls == nil {
+		return ErrNoListener
+	}
+	if pl, ok := l.(PausableListener); ok {
+		pl.Resume()
+	}
+	ls.resume()
+	return nil
+}
+
+func (s *Swarm) listenerFor(addr ma.Multiaddr) (transport.Listener, *listenerState) {
+	s.listeners.RLock()
+	defer s.listeners.RUnlock()
+	for l, ls := range s.listeners.m {
+		if l.Multiaddr().Equal(addr) {
+			return l, ls
+		}
+	}
+	return nil, nil
+}
+
+// UpgradeStatsListener is implemented by listeners that can tell how many of
+// the connections they accepted they upgraded (secured and multiplexed), and
+// how many upgrades failed. Listeners of the transport upgrader only hand over
+// the upgraded connections, dropping the others silently.
+type UpgradeStatsListener interface {
+	transport.Listener
+
+	UpgradeStats() (upgraded, failed uint64)
+}
+
+// ListenerStat holds the counters of a listener, see Swarm.ListenerStats.
+type ListenerStat struct {
+	Addr ma.Multiaddr
+	// Transport is the name of the listener's transport's first protocol.
+	Transport string
+
+	// AcceptsSucceeded and AcceptsFailed count the connections handed over
+	// by the listener the swarm added, and failed to add (e.g. because their
+	// address is filtered).
+	AcceptsSucceeded, AcceptsFailed uint64
+
+	// ConnsUpgraded and UpgradesFailed count the connections the listener
+	// upgraded and failed to upgrade. Unless the listener reports them (see
+	// UpgradeStatsListener), the swarm only knows about the connections it
+	// was handed over: ConnsUpgraded is the sum of the accepts and
+	// UpgradesFailed is 0.
+	ConnsUpgraded, UpgradesFailed uint64
+}
+
+// ListenerStats returns the counters of the swarm's open listeners, ordered by
+// address.
+func (s *Swarm) ListenerStats() []ListenerStat {
+	s.listeners.RLock()
+	stats := make([]ListenerStat, 0, len(s.listeners.m))
+	for l, ls := range s.listeners.m {
+		stat := ListenerStat{
+			Addr:             l.Multiaddr(),
+			AcceptsSucceeded: atomic.LoadUint64(&ls.accepted),
+			AcceptsFailed:    atomic.LoadUint64(&ls.acceptFailed),
+		}
+		if protos := ls.tpt.Protocols(); len(protos) > 0 {
+			stat.Transport = ma.ProtocolWithCode(protos[0]).Name
+		}
+		if ul, ok := l.(UpgradeStatsListener); ok {
+			stat.ConnsUpgraded, stat.UpgradesFailed = ul.UpgradeStats()
+		} else {
+			stat.ConnsUpgraded = stat.AcceptsSucceeded + stat.AcceptsFailed
+		}
+		stats = append(stats, stat)
+	}
+	s.listeners.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Addr.String() < stats[j].Addr.String()
+	})
+	return stats
+}
+
 // Listen sets up listeners for all of the given addresses.
 // It returns as long as we successfully listen on at least *one* address.
+// If none of the addresses has a transport that can listen on it, Listen
+// returns ErrNoTransport (or ErrNoTransports if there are no transports at
+// all) instead of a generic failure.
 func (s *Swarm) Listen(addrs ...ma.Multiaddr) error {
+	if s.IsDialOnly() {
+		return ErrDialOnly
+	}
 	errs := make([]error, len(addrs))
 	var succeeded int
 	for i, a := range addrs {
@@ -29,33 +238,106 @@ func (s *Swarm) Listen(addrs ...ma.Multiaddr) error {
 	}
 
 	if succeeded == 0 && len(addrs) > 0 {
+		if err := noTransportErr(errs); err != nil {
+			return err
+		}
 		return fmt.Errorf("failed to listen on any addresses: %s", errs)
 	}
 
 	return nil
 }
 
+// noTransportErr returns ErrNoTransports or ErrNoTransport if every listen
+// error is one of them, nil otherwise.
+func noTransportErr(errs []error) error {
+	common := ErrNoTransports
+	for _, err := range errs {
+		switch err {
+		case ErrNoTransports:
+		case ErrNoTransport:
+			common = ErrNoTransport
+		default:
+			return nil
+		}
+	}
+	return common
+}
+
+// SetDialOnly switches the swarm in and out of dial-only mode. Switching it on
+// closes all the listeners, keeping the existing connections, and makes Listen
+// fail with ErrDialOnly until it's switched off again.
+func (s *Swarm) SetDialOnly(dialOnly bool) {
+	s.listeners.Lock()
+	s.listeners.dialOnly = dialOnly
+	var lists []transport.Listener
+	if dialOnly {
+		for l, ls := range s.listeners.m {
+			ls.closedOnPurpose = true
+			lists = append(lists, l)
+			delete(s.listeners.m, l)
+		}
+		s.listeners.cacheEOL = time.Time{}
+	}
+	s.listeners.Unlock()
+
+	// The accept loops notice and clean up after them.
+	for _, l := range lists {
+		l.Close()
+	}
+}
+
+// IsDialOnly returns whether the swarm is dial-only (see SetDialOnly).
+func (s *Swarm) IsDialOnly() bool {
+	s.listeners.RLock()
+	defer s.listeners.RUnlock()
+	return s.listeners.dialOnly
+}
+
 // AddListenAddr tells the swarm to listen on a single address. Unlike Listen,
 // this method does not attempt to filter out bad addresses.
 func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
+	if s.IsDialOnly() {
+		return ErrDialOnly
+	}
+	if !s.hasTransports() {
+		return ErrNoTransports
+	}
 	tpt := s.TransportForListening(a)
 	if tpt == nil {
 		return ErrNoTransport
 	}
+	_, err := s.addListener(tpt, a)
+	return err
+}
 
-	list, err := tpt.Listen(a)
+// addListener listens on the given address with the given transport and
+// starts accepting connections.
+func (s *Swarm) addListener(tpt transport.Transport, a ma.Multiaddr) (transport.Listener, error) {
+	var list transport.Listener
+	var err error
+	if s.listenPortRange[1] > 0 && hasZeroPort(a) {
+		list, err = s.listenInPortRange(tpt, a)
+	} else {
+		list, err = tpt.Listen(a)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	s.listeners.Lock()
 	if s.listeners.m == nil {
 		s.listeners.Unlock()
 		list.Close()
-		return ErrSwarmClosed
+		return nil, ErrSwarmClosed
+	}
+	if s.listeners.dialOnly {
+		s.listeners.Unlock()
+		list.Close()
+		return nil, ErrDialOnly
 	}
 	s.refs.Add(1)
-	s.listeners.m[list] = struct{}{}
+	ls := &listenerState{tpt: tpt}
+	s.listeners.m[list] = ls
 	s.listeners.cacheEOL = time.Time{}
 	s.listeners.Unlock()
 
@@ -65,6 +347,7 @@ func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
 	s.notifyAll(func(n network.Notifiee) {
 		n.Listen(s, maddr)
 	})
+	s.events.publish(Event{Type: EventListen, Addr: maddr})
 
 	go func() {
 		defer func() {
@@ -72,12 +355,27 @@ func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
 			s.listeners.Lock()
 			delete(s.listeners.m, list)
 			s.listeners.cacheEOL = time.Time{}
+			closedOnPurpose := ls.closedOnPurpose
+			lastForTransport := true
+			for _, other := range s.listeners.m {
+				if other.tpt == tpt {
+					lastForTransport = false
+					break
+				}
+			}
 			s.listeners.Unlock()
 
 			// signal to our notifiees on listen close.
 			s.notifyAll(func(n network.Notifiee) {
 				n.ListenClose(s, maddr)
 			})
+			s.events.publish(Event{Type: EventListenClose, Addr: maddr})
+
+			// Listeners going away with the swarm, or closed on
+			// purpose, are expected.
+			if h := s.listenerClosedHandler; h != nil && lastForTransport && !closedOnPurpose && s.ctx.Err() == nil {
+				h(tpt, maddr)
+			}
 			s.refs.Done()
 		}()
 		for {
@@ -89,6 +387,12 @@ func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
 				}
 				return
 			}
+			// Hold on to the connection while paused. Any further
+			// connections queue up in the listener.
+			if !ls.waitResumed(s.ctx) {
+				c.Close()
+				return
+			}
 			log.Debugf("swarm listener accepted connection: %s", c)
 			s.refs.Add(1)
 			go func() {
@@ -96,15 +400,276 @@ func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
 				_, err := s.addConn(c, network.DirInbound)
 				switch err {
 				case nil:
+					atomic.AddUint64(&ls.accepted, 1)
 				case ErrSwarmClosed:
 					// ignore.
 					return
 				default:
 					log.Warningf("add conn %s failed: ", err)
+					atomic.AddUint64(&ls.acceptFailed, 1)
 					return
 				}
 			}()
 		}
 	}()
+	return list, nil
+}
+
+// listenInPortRange listens on the given address, which has a zero TCP or UDP
+// port, on the first port of the swarm's listen port range that's available.
+func (s *Swarm) listenInPortRange(tpt transport.Transport, a ma.Multiaddr) (transport.Listener, error) {
+	var err error
+	for port := s.listenPortRange[0]; port <= s.listenPortRange[1]; port++ {
+		var list transport.Listener
+		list, err = tpt.Listen(withPort(a, port))
+		if err == nil {
+			return list, nil
+		}
+		log.Debugf("listen on port %d for %s failed: %s", port, a, err)
+	}
+	return nil, fmt.Errorf("no port available in range %d-%d for %s: %s",
+		s.listenPortRange[0], s.listenPortRange[1], a, err)
+}
+
+func isPortComponent(c ma.Component) bool {
+	code := c.Protocol().Code
+	return code == ma.P_TCP || code == ma.P_UDP
+}
+
+// hasZeroPort returns true if the first TCP or UDP port of addr is zero.
+func hasZeroPort(addr ma.Multiaddr) bool {
+	zero := false
+	ma.ForEach(addr, func(c ma.Component) bool {
+		if isPortComponent(c) {
+			zero = c.Value() == "0"
+			return false
+		}
+		return true
+	})
+	return zero
+}
+
+// withPort returns addr with its first TCP or UDP port replaced.
+func withPort(addr ma.Multiaddr, port int) ma.Multiaddr {
+	var parts []ma.Multiaddr
+	replaced := false
+	ma.ForEach(addr, func(c ma.Component) bool {
+		if !replaced && isPortComponent(c) {
+			if pc, err := ma.NewComponent(c.Protocol().Name, strconv.Itoa(port)); err == nil {
+				parts = append(parts, pc)
+				replaced = true
+				return true
+			}
+		}
+		parts = append(parts, &c)
+		return true
+	})
+	return ma.Join(parts...)
+}
+
+// InterfaceAddrsFunc returns the IP addresses of the named network interface.
+type InterfaceAddrsFunc func(name string) ([]net.IP, error)
+
+// InterfaceRescanInterval is how often the interfaces listened on with
+// ListenInterface are checked for address changes.
+var InterfaceRescanInterval = 30 * time.Second
+
+// systemInterfaceAddrs is the default InterfaceAddrsFunc, returning the
+// addresses the OS reports for the interface.
+func systemInterfaceAddrs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// ListenInterface listens with the given transport on every address of the
+// named network interface, on the given transport protocol (e.g. "tcp") and
+// port. The interface's addresses are checked every InterfaceRescanInterval:
+// the swarm starts listening on new addresses and stops listening on the
+// addresses the interface lost. IPv6 link-local addresses are skipped.
+//
+// The returned function stops watching the interface and closes its
+// listeners. Listeners closed this way, or because their address left the
+// interface, don't trigger the listener closed handler (see
+// WithTransportListenerClosedHandler). It's safe to call more than once. Until it's called, listening
+// on the same interface again fails with ErrInterfaceWatched.
+func (s *Swarm) ListenInterface(name string, t transport.Transport, proto string, port int) (stop func(), err error) {
+	s.ifaces.Lock()
+	if s.ifaces.m[name] {
+		s.ifaces.Unlock()
+		return nil, ErrInterfaceWatched
+	}
+	s.ifaces.m[name] = true
+	s.ifaces.Unlock()
+
+	il := &ifaceListener{
+		swarm:     s,
+		name:      name,
+		tpt:       t,
+		proto:     proto,
+		port:      port,
+		listeners: make(map[string]transport.Listener),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := il.sync(); err != nil {
+		il.closeAll()
+		s.unwatchIface(name)
+		return nil, err
+	}
+	go il.watch(InterfaceRescanInterval)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(il.stop)
+			<-il.done
+			il.closeAll()
+			s.unwatchIface(name)
+		})
+	}, nil
+}
+
+func (s *Swarm) unwatchIface(name string) {
+	s.ifaces.Lock()
+	delete(s.ifaces.m, name)
+	s.ifaces.Unlock()
+}
+
+// ifaceListener keeps listeners bound to the addresses of a network
+// interface.
+type ifaceListener struct {
+	swarm *Swarm
+	name  string
+	tpt   transport.Transport
+	proto string
+	port  int
+
+	// listeners by interface IP.
+	listeners map[string]transport.Listener
+
+	// stop is closed to stop watching, done when the watcher has.
+	stop, done chan struct{}
+}
+
+func (il *ifaceListener) watch(interval time.Duration) {
+	defer close(il.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := il.sync(); err != nil {
+				log.Debugf("listening on interface %s: %s", il.name, err)
+			}
+		case <-il.stop:
+			return
+		case <-il.swarm.ctx.Done():
+			// The swarm closes the listeners.
+			return
+		}
+	}
+}
+
+// sync listens on the interface's current addresses and closes the listeners
+// on addresses it no longer has.
+func (il *ifaceListener) sync() error {
+	ips, err := il.swarm.ifaceAddrs(il.name)
+	if err != nil {
+		return fmt.Errorf("failed to get the addresses of interface %s: %s", il.name, err)
+	}
+
+	current := make(map[string]bool, len(ips))
+	var errs []string
+	for _, ip := range ips {
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			continue
+		}
+		key := ip.String()
+		current[key] = true
+		if list, ok := il.listeners[key]; ok && il.swarm.hasListener(list) {
+			continue
+		}
+		addr, err := il.listenAddr(ip)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		list, err := il.swarm.addListener(il.tpt, addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		log.Debugf("listening on %s (interface %s)", list.Multiaddr(), il.name)
+		il.listeners[key] = list
+	}
+	for key, list := range il.listeners {
+		if !current[key] {
+			log.Debugf("closing listener on %s: gone from interface %s", list.Multiaddr(), il.name)
+			il.swarm.closeListener(list)
+			delete(il.listeners, key)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to listen on interface %s: %s", il.name, strings.Join(errs, ", "))
+	}
 	return nil
 }
+
+func (il *ifaceListener) listenAddr(ip net.IP) (ma.Multiaddr, error) {
+	ipAddr, err := manet.FromIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	portAddr, err := ma.NewComponent(il.proto, strconv.Itoa(il.port))
+	if err != nil {
+		return nil, err
+	}
+	return ipAddr.Encapsulate(portAddr), nil
+}
+
+func (il *ifaceListener) closeAll() {
+	for key, list := range il.listeners {
+		il.swarm.closeListener(list)
+		delete(il.listeners, key)
+	}
+}
+
+// closeListener closes the listener on purpose, so its accept loop doesn't
+// report it to the listener closed handler.
+func (s *Swarm) closeListener(list transport.Listener) error {
+	s.listeners.Lock()
+	if ls, ok := s.listeners.m[list]; ok {
+		ls.closedOnPurpose = true
+	}
+	s.listeners.Unlock()
+	return list.Close()
+}
+
+// hasListener returns true if the listener is still open.
+func (s *Swarm) hasListener(list transport.Listener) bool {
+	s.listeners.RLock()
+	defer s.listeners.RUnlock()
+	_, ok := s.listeners.m[list]
+	return ok
+}
+
+// ifaceAddrs returns the addresses of the given network interface.
+func (s *Swarm) ifaceAddrs(name string) ([]net.IP, error) {
+	if s.interfaceAddrs != nil {
+		return s.interfaceAddrs(name)
+	}
+	return systemInterfaceAddrs(name)
+}
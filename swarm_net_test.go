@@ -8,7 +8,7 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/network"
 
-	. "github.com/libp2p/go-libp2p-swarm/testing"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 )
 
 // TestConnectednessCorrect starts a few networks, connects a few
@@ -19,13 +19,13 @@ func TestConnectednessCorrect(t *testing.T) {
 
 	nets := make([]network.Network, 4)
 	for i := 0; i < 4; i++ {
-		nets[i] = GenSwarm(t, ctx)
+		nets[i] = swarmt.GenSwarm(t, ctx)
 	}
 
 	// connect 0-1, 0-2, 0-3, 1-2, 2-3
 
 	dial := func(a, b network.Network) {
-		DivulgeAddresses(b, a)
+		swarmt.DivulgeAddresses(b, a)
 		if _, err := a.DialPeer(ctx, b.LocalPeer()); err != nil {
 			t.Fatalf("Failed to dial: %s", err)
 		}
@@ -110,11 +110,11 @@ func TestNetworkOpenStream(t *testing.T) {
 
 	nets := make([]network.Network, 4)
 	for i := 0; i < 4; i++ {
-		nets[i] = GenSwarm(t, ctx)
+		nets[i] = swarmt.GenSwarm(t, ctx)
 	}
 
 	dial := func(a, b network.Network) {
-		DivulgeAddresses(b, a)
+		swarmt.DivulgeAddresses(b, a)
 		if _, err := a.DialPeer(ctx, b.LocalPeer()); err != nil {
 			t.Fatalf("Failed to dial: %s", err)
 		}
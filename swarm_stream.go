@@ -1,6 +1,8 @@
 package swarm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -22,6 +24,12 @@ const (
 	streamReset
 )
 
+// StreamProtocolGracePeriod is how long the bandwidth used by a stream is held
+// back while its protocol is unknown. If the protocol is set within the grace
+// period, the held back bandwidth is attributed to it; otherwise, it's
+// attributed to the empty (unknown) protocol.
+var StreamProtocolGracePeriod = 5 * time.Second
+
 // Validate Stream conforms to the go-libp2p-net Stream interface
 var _ network.Stream = &Stream{}
 
@@ -41,6 +49,25 @@ type Stream struct {
 	protocol atomic.Value
 
 	stat network.Stat
+
+	// true if this stream was opened during a connection warmup, in which
+	// case no stream notifications are fired for it.
+	silent bool
+
+	// default per-operation timeouts, cleared once the corresponding
+	// deadline is set explicitly.
+	readTimeout, writeTimeout         time.Duration
+	readDeadlineSet, writeDeadlineSet int32
+
+	// bandwidth not yet attributed to a protocol, see
+	// StreamProtocolGracePeriod.
+	opened       time.Time
+	attributed   int32
+	unattributed struct {
+		sync.Mutex
+		sent, recv int64
+		done       bool
+	}
 }
 
 func (s *Stream) String() string {
@@ -61,11 +88,21 @@ func (s *Stream) Conn() network.Conn {
 
 // Read reads bytes from a stream.
 func (s *Stream) Read(p []byte) (int, error) {
+	if s.readTimeout > 0 && atomic.LoadInt32(&s.readDeadlineSet) == 0 {
+		s.stream.SetReadDeadline(time.Now().Add(s.readTimeout))
+	}
 	n, err := s.stream.Read(p)
+	if n > 0 {
+		s.conn.touch()
+	}
+	atomic.AddUint64(&s.conn.bytesRecv, uint64(n))
+	atomic.AddUint64(&s.conn.swarm.counters.bytesIn, uint64(n))
 	// TODO: push this down to a lower level for better accuracy.
 	if s.conn.swarm.bwc != nil {
 		s.conn.swarm.bwc.LogRecvMessage(int64(n))
-		s.conn.swarm.bwc.LogRecvMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+		if s.attribute(0, int64(n)) {
+			s.conn.swarm.bwc.LogRecvMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+		}
 	}
 	// If we observe an EOF, this stream is now closed for reading.
 	// If we're already closed for writing, this stream is now fully closed.
@@ -85,15 +122,94 @@ func (s *Stream) Read(p []byte) (int, error) {
 
 // Write writes bytes to a stream, flushing for each call.
 func (s *Stream) Write(p []byte) (int, error) {
+	if s.writeTimeout > 0 && atomic.LoadInt32(&s.writeDeadlineSet) == 0 {
+		s.stream.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
 	n, err := s.stream.Write(p)
+	if n > 0 {
+		s.conn.touch()
+	}
+	atomic.AddUint64(&s.conn.bytesSent, uint64(n))
+	atomic.AddUint64(&s.conn.swarm.counters.bytesOut, uint64(n))
 	// TODO: push this down to a lower level for better accuracy.
 	if s.conn.swarm.bwc != nil {
 		s.conn.swarm.bwc.LogSentMessage(int64(n))
-		s.conn.swarm.bwc.LogSentMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+		if s.attribute(int64(n), 0) {
+			s.conn.swarm.bwc.LogSentMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+		}
+	}
+	if err == nil && s.writeBacklogExceeded() {
+		log.Debugf("resetting stream to %s: write backlog exceeded", s.conn.RemotePeer())
+		s.Reset()
+		err = ErrStreamWriteBacklogExceeded
 	}
 	return n, err
 }
 
+// writeBacklogExceeded returns true if the stream's write backlog exceeds the
+// swarm's limit (see WithMaxStreamWriteBacklog).
+func (s *Stream) writeBacklogExceeded() bool {
+	max := s.conn.swarm.maxWriteBacklog
+	if max <= 0 {
+		return false
+	}
+	bs, ok := s.stream.(WriteBacklogStream)
+	return ok && bs.WriteBacklog() > max
+}
+
+// attribute returns true if the given bandwidth should be logged against the
+// stream's protocol right away. While the protocol is unknown, and at most
+// for StreamProtocolGracePeriod, it holds the bandwidth back instead.
+func (s *Stream) attribute(sent, recv int64) bool {
+	if atomic.LoadInt32(&s.attributed) == 1 {
+		return true
+	}
+	s.unattributed.Lock()
+	defer s.unattributed.Unlock()
+	if !s.unattributed.done {
+		if s.Protocol() == "" && time.Since(s.opened) < StreamProtocolGracePeriod {
+			s.unattributed.sent += sent
+			s.unattributed.recv += recv
+			return false
+		}
+		s.flushUnattributedLocked()
+	}
+	return true
+}
+
+// flushUnattributedLocked logs the held back bandwidth against the stream's
+// current protocol and stops holding back bandwidth.
+func (s *Stream) flushUnattributedLocked() {
+	s.unattributed.done = true
+	atomic.StoreInt32(&s.attributed, 1)
+
+	bwc := s.conn.swarm.bwc
+	if bwc == nil {
+		return
+	}
+	proto, p := s.Protocol(), s.conn.RemotePeer()
+	if n := s.unattributed.sent; n > 0 {
+		bwc.LogSentMessageStream(n, proto, p)
+	}
+	if n := s.unattributed.recv; n > 0 {
+		bwc.LogRecvMessageStream(n, proto, p)
+	}
+	s.unattributed.sent, s.unattributed.recv = 0, 0
+}
+
+// flushUnattributed attributes any held back bandwidth to the stream's
+// current protocol.
+func (s *Stream) flushUnattributed() {
+	if atomic.LoadInt32(&s.attributed) == 1 {
+		return
+	}
+	s.unattributed.Lock()
+	if !s.unattributed.done {
+		s.flushUnattributedLocked()
+	}
+	s.unattributed.Unlock()
+}
+
 // Close closes the stream, indicating this side is finished
 // with the stream.
 func (s *Stream) Close() error {
@@ -111,6 +227,84 @@ func (s *Stream) Close() error {
 	return err
 }
 
+// FlushingStream is implemented by muxed streams that buffer writes (see
+// Stream.CloseWithFlush).
+type FlushingStream interface {
+	mux.MuxedStream
+
+	// Flush writes out the buffered data. It must return once the stream's
+	// write deadline passes or it's reset.
+	Flush() error
+}
+
+// WriteBacklogStream is implemented by muxed streams that report how much of
+// the data written to them the remote side hasn't consumed yet.
+type WriteBacklogStream interface {
+	mux.MuxedStream
+
+	// WriteBacklog returns the number of bytes written but not yet consumed
+	// by the remote side.
+	WriteBacklog() int
+}
+
+// ErrStreamWriteBacklogExceeded is returned by a write after which the
+// stream's write backlog exceeded the swarm's limit (see
+// WithMaxStreamWriteBacklog). The stream is reset.
+var ErrStreamWriteBacklogExceeded = errors.New("stream write backlog exceeded")
+
+// CloseWithFlush flushes any writes buffered by the stream muxer and then
+// closes the stream for writing. Flushing is best effort and bounded by ctx;
+// if ctx expires first, the stream is reset. It only flushes streams of
+// muxers implementing FlushingStream; for the others, which don't buffer
+// writes (e.g. yamux and mplex), it's the same as Close.
+func (s *Stream) CloseWithFlush(ctx context.Context) error {
+	f, ok := s.stream.(FlushingStream)
+	if !ok {
+		return s.Close()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.stream.SetWriteDeadline(deadline)
+	}
+
+	// Reset the stream if ctx expires mid-flush, making Flush return. Once
+	// Flush has returned, the stream is no longer reset: a flush that
+	// finished just as ctx expired still counts.
+	var (
+		mu              sync.Mutex
+		finished, reset bool
+	)
+	flushed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !finished {
+				s.Reset()
+				reset = true
+			}
+			mu.Unlock()
+		case <-flushed:
+		}
+	}()
+	err := f.Flush()
+	mu.Lock()
+	finished = true
+	mu.Unlock()
+	close(flushed)
+	<-done
+
+	if reset {
+		return ctx.Err()
+	}
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	return s.Close()
+}
+
 // Reset resets the stream, closing both ends.
 func (s *Stream) Reset() error {
 	err := s.stream.Reset()
@@ -126,6 +320,8 @@ func (s *Stream) Reset() error {
 
 func (s *Stream) remove() {
 	s.conn.removeStream(s)
+	s.conn.swarm.releaseStream(s.conn.RemotePeer())
+	s.flushUnattributed()
 
 	// We *must* do this in a goroutine. This can be called during a
 	// an open notification and will block until that notification is done.
@@ -133,9 +329,11 @@ func (s *Stream) remove() {
 		s.notifyLk.Lock()
 		defer s.notifyLk.Unlock()
 
-		s.conn.swarm.notifyAll(func(f network.Notifiee) {
-			f.ClosedStream(s.conn.swarm, s)
-		})
+		if !s.silent {
+			s.conn.swarm.notifyAll(func(f network.Notifiee) {
+				f.ClosedStream(s.conn.swarm, s)
+			})
+		}
 		s.conn.swarm.refs.Done()
 	}()
 }
@@ -152,26 +350,79 @@ func (s *Stream) Protocol() protocol.ID {
 // This doesn't actually *do* anything other than record the fact that we're
 // speaking the given protocol over this stream. It's still up to the user to
 // negotiate the protocol. This is usually done by the Host.
+//
+// Bandwidth used by the stream before it had a protocol is attributed to the
+// first protocol set, if it's set within StreamProtocolGracePeriod.
 func (s *Stream) SetProtocol(p protocol.ID) {
 	s.protocol.Store(p)
+	s.flushUnattributed()
 }
 
-// SetDeadline sets the read and write deadlines for this stream.
+// SetDeadline sets the read and write deadlines for this stream, overriding
+// the swarm's default stream timeouts.
 func (s *Stream) SetDeadline(t time.Time) error {
+	atomic.StoreInt32(&s.readDeadlineSet, 1)
+	atomic.StoreInt32(&s.writeDeadlineSet, 1)
 	return s.stream.SetDeadline(t)
 }
 
-// SetReadDeadline sets the read deadline for this stream.
+// SetReadDeadline sets the read deadline for this stream, overriding the
+// swarm's default read timeout.
 func (s *Stream) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt32(&s.readDeadlineSet, 1)
 	return s.stream.SetReadDeadline(t)
 }
 
-// SetWriteDeadline sets the write deadline for this stream.
+// SetWriteDeadline sets the write deadline for this stream, overriding the
+// swarm's default write timeout.
 func (s *Stream) SetWriteDeadline(t time.Time) error {
+	atomic.StoreInt32(&s.writeDeadlineSet, 1)
 	return s.stream.SetWriteDeadline(t)
 }
 
-// Stat returns metadata information for this stream.
+// Stat returns metadata information for this stream: whether it was opened
+// locally (DirOutbound) or accepted (DirInbound), and when (see StatOpened).
 func (s *Stream) Stat() network.Stat {
 	return s.stat
 }
+
+// Opened returns the time the stream was opened or accepted.
+func (s *Stream) Opened() time.Time {
+	return s.opened
+}
+
+// writeInitialData writes all the data to a newly opened stream, within the
+// context's deadline, resetting the stream on failure.
+func writeInitialData(ctx context.Context, s network.Stream, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		s.Reset()
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if str, ok := s.(*Stream); ok {
+			// Override the default write timeout for these writes only, so it
+			// still applies to the writes after them.
+			set := atomic.SwapInt32(&str.writeDeadlineSet, 1)
+			str.stream.SetWriteDeadline(deadline)
+			defer func() {
+				str.stream.SetWriteDeadline(time.Time{})
+				atomic.StoreInt32(&str.writeDeadlineSet, set)
+			}()
+		} else {
+			s.SetWriteDeadline(deadline)
+			defer s.SetWriteDeadline(time.Time{})
+		}
+	}
+	for len(data) > 0 {
+		n, err := s.Write(data)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			s.Reset()
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,649 @@
+package swarm_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/transport"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+	yamux "github.com/libp2p/go-libp2p-yamux"
+	"github.com/libp2p/go-tcp-transport"
+	mss "github.com/multiformats/go-multistream"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestStreamCloseWithFlush(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	received := make(chan []byte, 1)
+	swarms[1].SetStreamHandler(func(s network.Stream) {
+		defer s.Close()
+		data, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- data
+	})
+
+	str, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte("flush me "), 1024)
+	if _, err := str.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := str.(*Stream).CloseWithFlush(cctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, payload) {
+			t.Fatalf("peer read %d bytes, expected %d", len(data), len(payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer never observed EOF")
+	}
+}
+
+// stallingFlushMuxer opens streams that buffer writes until they're reset.
+type stallingFlushMuxer struct {
+	mux.Multiplexer
+}
+
+func (m stallingFlushMuxer) NewConn(c net.Conn, isServer bool) (mux.MuxedConn, error) {
+	mc, err := m.Multiplexer.NewConn(c, isServer)
+	if err != nil {
+		return nil, err
+	}
+	return stallingFlushConn{mc}, nil
+}
+
+type stallingFlushConn struct {
+	mux.MuxedConn
+}
+
+func (c stallingFlushConn) OpenStream() (mux.MuxedStream, error) {
+	s, err := c.MuxedConn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &stallingFlushStream{MuxedStream: s, reset: make(chan struct{})}, nil
+}
+
+type stallingFlushStream struct {
+	mux.MuxedStream
+	once  sync.Once
+	reset chan struct{}
+}
+
+func (s *stallingFlushStream) Flush() error {
+	<-s.reset
+	return errors.New("stream reset")
+}
+
+func (s *stallingFlushStream) Reset() error {
+	s.once.Do(func() { close(s.reset) })
+	return s.MuxedStream.Reset()
+}
+
+func TestStreamCloseWithFlushExpired(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2, swarmt.OptMuxer("/yamux/1.0.0", stallingFlushMuxer{yamux.DefaultTransport}))
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	str, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The flush is cut short, and over, once ctx expires.
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- str.(*Stream).CloseWithFlush(cctx) }()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected the flush to time out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush outlived its context")
+	}
+	if _, err := str.Write([]byte("x")); err == nil {
+		t.Fatal("expected the stream to be reset")
+	}
+}
+
+func TestConnByteCounters(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	str, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+
+	// The echo handler replies with "pong" to every "ping".
+	buf := make([]byte, 4)
+	for i := 0; i < 10; i++ {
+		if _, err := str.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(str, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := str.Conn().(*Conn)
+	if sent := c.BytesSent(); sent != 40 {
+		t.Errorf("expected 40 bytes sent, got %d", sent)
+	}
+	if recv := c.BytesRecv(); recv != 40 {
+		t.Errorf("expected 40 bytes received, got %d", recv)
+	}
+}
+
+func TestConnGetStreams(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	protos := []protocol.ID{"/test/a", "/test/b", "/test/c"}
+	handled := make(chan struct{}, len(protos))
+	done := make(chan struct{})
+	defer close(done)
+	for _, proto := range protos {
+		swarms[1].SetStreamHandlerForProtocol(proto, func(s network.Stream) {
+			handled <- struct{}{}
+			<-done
+			s.Close()
+		})
+	}
+
+	for _, proto := range protos {
+		str, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mss.SelectProtoOrFail(string(proto), str); err != nil {
+			t.Fatal(err)
+		}
+		str.SetProtocol(proto)
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatalf("stream for %s was never handled", proto)
+		}
+	}
+
+	check := func(c network.Conn, dir network.Direction) []network.Stream {
+		streams := c.GetStreams()
+		seen := make(map[protocol.ID]bool)
+		for _, s := range streams {
+			if s.Stat().Direction != dir {
+				t.Errorf("expected direction %v, got %v", dir, s.Stat().Direction)
+			}
+			seen[s.Protocol()] = true
+		}
+		if len(streams) != len(protos) {
+			t.Fatalf("expected %d streams, got %d", len(protos), len(streams))
+		}
+		for _, proto := range protos {
+			if !seen[proto] {
+				t.Errorf("missing stream for %s", proto)
+			}
+		}
+		return streams
+	}
+	check(swarms[1].ConnsToPeer(swarms[0].LocalPeer())[0], network.DirInbound)
+	streams := check(swarms[0].ConnsToPeer(swarms[1].LocalPeer())[0], network.DirOutbound)
+
+	// The snapshot isn't affected by streams closing.
+	streams[0].Reset()
+	if len(streams) != len(protos) {
+		t.Fatal("snapshot changed after a stream closed")
+	}
+	if n := len(swarms[0].ConnsToPeer(swarms[1].LocalPeer())[0].GetStreams()); n != len(protos)-1 {
+		t.Fatalf("expected %d streams after reset, got %d", len(protos)-1, n)
+	}
+}
+
+func TestStreamDefaultReadTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const timeout = 200 * time.Millisecond
+	s1 := makeSwarmWithOpts(ctx, t, WithDefaultStreamReadTimeout(timeout))
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	// The echo handler on s2 never sends anything unless we do.
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Reset()
+
+	start := time.Now()
+	_, err = str.Read(make([]byte, 1))
+	elapsed := time.Since(start)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed < timeout || elapsed > 5*timeout {
+		t.Fatalf("expected the read to time out after about %s, took %s", timeout, elapsed)
+	}
+}
+
+func TestNewStreamWithDataKeepsDefaultWriteTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const timeout = 200 * time.Millisecond
+	s1 := makeSwarmWithOpts(ctx, t, WithDefaultStreamWriteTimeout(timeout))
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	// Never read, so writes block once the muxer's buffers are full.
+	done := make(chan struct{})
+	defer close(done)
+	s2.SetStreamHandler(func(str network.Stream) {
+		<-done
+		str.Reset()
+	})
+
+	wctx, wcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer wcancel()
+	str, err := s1.NewStreamWithData(wctx, s2.LocalPeer(), []byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Reset()
+
+	// The context's deadline only applied to the initial data.
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := str.Write(make([]byte, 16<<20))
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+	case <-time.After(5 * timeout):
+		t.Fatalf("expected the write to time out after about %s", timeout)
+	}
+}
+
+// protoReporter records the bandwidth logged per protocol.
+type protoReporter struct {
+	*metrics.BandwidthCounter
+
+	mu   sync.Mutex
+	sent map[protocol.ID]int64
+}
+
+func (r *protoReporter) LogSentMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	r.mu.Lock()
+	r.sent[proto] += size
+	r.mu.Unlock()
+	r.BandwidthCounter.LogSentMessageStream(size, proto, p)
+}
+
+func (r *protoReporter) sentFor(proto protocol.ID) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sent[proto]
+}
+
+func TestStreamLateProtocolBandwidth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bwc := &protoReporter{
+		BandwidthCounter: metrics.NewBandwidthCounter(),
+		sent:             make(map[protocol.ID]int64),
+	}
+	p := tnet.RandPeerNetParamsOrFatal(t)
+	ps := pstoremem.NewPeerstore()
+	defer ps.Close()
+	ps.AddPubKey(p.ID, p.PubKey)
+	ps.AddPrivKey(p.ID, p.PrivKey)
+	s1, err := NewSwarm(ctx, p.ID, ps, bwc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	if err := s1.AddTransport(tcp.NewTCPTransport(swarmt.GenUpgrader(s1))); err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if n := bwc.sentFor(""); n != 0 {
+		t.Fatalf("expected no bandwidth attributed before the protocol is set, got %d", n)
+	}
+
+	const proto = protocol.ID("/test/late")
+	str.SetProtocol(proto)
+	if n := bwc.sentFor(proto); n != 4 {
+		t.Fatalf("expected the early 4 bytes to be attributed to %s, got %d", proto, n)
+	}
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if n := bwc.sentFor(proto); n != 8 {
+		t.Fatalf("expected 8 bytes attributed to %s, got %d", proto, n)
+	}
+}
+
+func TestConnLastStreamActivity(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	s := swarms[0]
+	busy := s.ConnsToPeer(swarms[1].LocalPeer())[0].(*Conn)
+	idle := s.ConnsToPeer(swarms[2].LocalPeer())[0].(*Conn)
+
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	str, err := busy.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(str, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	if last := busy.LastStreamActivity(); last.Before(before) {
+		t.Fatalf("expected stream activity after %s, got %s", before, last)
+	}
+	if last := idle.LastStreamActivity(); !last.Before(before) {
+		t.Fatalf("expected no stream activity on the idle conn since %s, got %s", before, last)
+	}
+}
+
+func TestConnCloseResetsStreams(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	const proto = "/test/reset"
+	const n = 3
+	readErrs := make(chan error, n)
+	swarms[1].SetStreamHandlerForProtocol(proto, func(s network.Stream) {
+		_, err := io.Copy(ioutil.Discard, s)
+		readErrs <- err
+	})
+
+	for i := 0; i < n; i++ {
+		str, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mss.SelectProtoOrFail(proto, str); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := swarms[0].ConnsToPeer(swarms[1].LocalPeer())[0]
+	// Wait for every stream to be handled remotely before pulling the plug.
+	remote := swarms[1].ConnsToPeer(swarms[0].LocalPeer())[0]
+	for i := 0; len(remote.GetStreams()) != n; i++ {
+		if i > 100 {
+			t.Fatalf("expected %d remote streams, got %d", n, len(remote.GetStreams()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-readErrs:
+			if err == nil {
+				t.Fatal("expected the remote stream to be reset, it was closed cleanly")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("remote stream hung after the conn was closed")
+		}
+	}
+}
+
+func TestStreamStat(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	accepted := make(chan network.Stream, 1)
+	s2.SetStreamHandler(func(str network.Stream) { accepted <- str })
+	connectSwarms(t, ctx, swarms)
+
+	before := time.Now()
+	out, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := out.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	var in network.Stream
+	select {
+	case in = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream never accepted")
+	}
+	defer in.Close()
+	after := time.Now()
+
+	check := func(str network.Stream, dir network.Direction, owner *Swarm) {
+		t.Helper()
+		stat := str.Stat()
+		if stat.Direction != dir {
+			t.Errorf("expected direction %v, got %v", dir, stat.Direction)
+		}
+		opened, ok := stat.Extra[StatOpened].(time.Time)
+		if !ok {
+			t.Fatal("expected the stat to hold the open time")
+		}
+		if opened.Before(before) || opened.After(after) {
+			t.Errorf("expected the open time to be between %s and %s, got %s", before, after, opened)
+		}
+		if !str.(*Stream).Opened().Equal(opened) {
+			t.Error("expected Opened to match the stat")
+		}
+		c, ok := str.Conn().(*Conn)
+		if !ok {
+			t.Fatalf("expected the stream's conn to be a swarm conn, got %T", str.Conn())
+		}
+		if conns := owner.ConnsToPeer(c.RemotePeer()); len(conns) != 1 || conns[0] != c {
+			t.Error("expected the stream's conn to be its owning conn")
+		}
+	}
+	check(out, network.DirOutbound, s1)
+	check(in, network.DirInbound, s2)
+
+	if !in.(*Stream).Opened().After(out.(*Stream).Opened()) {
+		t.Error("expected the stream to be accepted after it was opened")
+	}
+}
+
+// backlogConn is a conn whose streams report everything written to them as
+// backlog, as if the remote side never read.
+type backlogConn struct {
+	transport.CapableConn
+}
+
+func (c *backlogConn) OpenStream() (mux.MuxedStream, error) {
+	str, err := c.CapableConn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &backlogStream{MuxedStream: str}, nil
+}
+
+type backlogStream struct {
+	mux.MuxedStream
+	written int
+}
+
+func (s *backlogStream) Write(p []byte) (int, error) {
+	n, err := s.MuxedStream.Write(p)
+	s.written += n
+	return n, err
+}
+
+func (s *backlogStream) WriteBacklog() int {
+	return s.written
+}
+
+func TestStreamWriteBacklog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeWrapConnSwarm(ctx, t, func(c transport.CapableConn) transport.CapableConn {
+		return &backlogConn{CapableConn: c}
+	}, WithMaxStreamWriteBacklog(10))
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx)
+	defer s2.Close()
+	accepted := make(chan network.Stream, 1)
+	s2.SetStreamHandler(func(str network.Stream) { accepted <- str })
+	swarmt.DivulgeAddresses(s2, s1)
+
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write(make([]byte, 8)); err != nil {
+		t.Fatalf("expected a write within the backlog limit to succeed, got %v", err)
+	}
+	if _, err := str.Write(make([]byte, 8)); err != ErrStreamWriteBacklogExceeded {
+		t.Fatalf("expected ErrStreamWriteBacklogExceeded, got %v", err)
+	}
+	if _, err := str.Write([]byte("x")); err == nil {
+		t.Fatal("expected the stream to be reset")
+	}
+
+	// The remote side sees the reset.
+	var remote network.Stream
+	select {
+	case remote = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream never accepted")
+	}
+	if _, err := ioutil.ReadAll(remote); err == nil {
+		t.Fatal("expected the remote side to see the stream reset")
+	}
+}
+
+func TestNewStreamWithData(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	received := make(chan []byte, 1)
+	s2.SetStreamHandler(func(str network.Stream) {
+		defer str.Close()
+		// The stream of the failed write is reset.
+		if b, err := ioutil.ReadAll(str); err == nil {
+			received <- b
+		}
+	})
+	connectSwarms(t, ctx, swarms)
+
+	payload := bytes.Repeat([]byte("request"), 64<<10)
+	check := func(open func() (network.Stream, error)) {
+		t.Helper()
+		str, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		str.Close()
+		ioutil.ReadAll(str)
+		select {
+		case b := <-received:
+			if !bytes.Equal(b, payload) {
+				t.Fatalf("expected the peer to read the %d byte payload, got %d bytes", len(payload), len(b))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("payload never received")
+		}
+	}
+
+	check(func() (network.Stream, error) {
+		return s1.NewStreamWithData(ctx, s2.LocalPeer(), payload)
+	})
+	c := s1.ConnsToPeer(s2.LocalPeer())[0].(*Conn)
+	check(func() (network.Stream, error) {
+		return c.NewStreamWithData(ctx, payload)
+	})
+
+	// Failing to write the payload resets the stream.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.NewStreamWithData(cctx, payload); err != context.Canceled {
+		t.Fatalf("expected the write to be canceled, got %v", err)
+	}
+	for i := 0; len(c.GetStreams()) > 0; i++ {
+		if i > 100 {
+			t.Fatal("expected the stream to be reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -5,20 +5,29 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	logging "github.com/ipfs/go-log"
+	goprocess "github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p-core/metrics"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+	"github.com/libp2p/go-tcp-transport"
 
 	ma "github.com/multiformats/go-multiaddr"
+	mss "github.com/multiformats/go-multistream"
 
 	. "github.com/libp2p/go-libp2p-swarm"
-	. "github.com/libp2p/go-libp2p-swarm/testing"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 )
 
 var log = logging.Logger("swarm_test")
@@ -55,17 +64,17 @@ func EchoStreamHandler(stream network.Stream) {
 }
 
 func makeDialOnlySwarm(ctx context.Context, t *testing.T) *Swarm {
-	swarm := GenSwarm(t, ctx, OptDialOnly)
+	swarm := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
 	swarm.SetStreamHandler(EchoStreamHandler)
 
 	return swarm
 }
 
-func makeSwarms(ctx context.Context, t *testing.T, num int, opts ...Option) []*Swarm {
+func makeSwarms(ctx context.Context, t *testing.T, num int, opts ...swarmt.Option) []*Swarm {
 	swarms := make([]*Swarm, 0, num)
 
 	for i := 0; i < num; i++ {
-		swarm := GenSwarm(t, ctx, opts...)
+		swarm := swarmt.GenSwarm(t, ctx, opts...)
 		swarm.SetStreamHandler(EchoStreamHandler)
 		swarms = append(swarms, swarm)
 	}
@@ -73,6 +82,43 @@ func makeSwarms(ctx context.Context, t *testing.T, num int, opts ...Option) []*S
 	return swarms
 }
 
+// makeBareSwarm constructs a swarm with the given options but without any
+// transports or listeners.
+func makeBareSwarm(ctx context.Context, t *testing.T, opts ...Option) *Swarm {
+	p := tnet.RandPeerNetParamsOrFatal(t)
+
+	ps := pstoremem.NewPeerstore()
+	ps.AddPubKey(p.ID, p.PubKey)
+	ps.AddPrivKey(p.ID, p.PrivKey)
+	s, err := NewSwarm(ctx, p.ID, ps, metrics.NewBandwidthCounter(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Process().AddChild(goprocess.WithTeardown(ps.Close))
+	return s
+}
+
+// makeDialOnlySwarmWithOpts constructs a swarm with the given options and a
+// TCP transport, but without any listeners.
+func makeDialOnlySwarmWithOpts(ctx context.Context, t *testing.T, opts ...Option) *Swarm {
+	s := makeBareSwarm(ctx, t, opts...)
+	if err := s.AddTransport(tcp.NewTCPTransport(swarmt.GenUpgrader(s))); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// makeSwarmWithOpts constructs a listening swarm with the given options.
+func makeSwarmWithOpts(ctx context.Context, t *testing.T, opts ...Option) *Swarm {
+	s := makeDialOnlySwarmWithOpts(ctx, t, opts...)
+	if err := s.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	s.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), peerstore.PermanentAddrTTL)
+	s.SetStreamHandler(EchoStreamHandler)
+	return s
+}
+
 func connectSwarms(t *testing.T, ctx context.Context, swarms []*Swarm) {
 
 	var wg sync.WaitGroup
@@ -103,7 +149,7 @@ func SubtestSwarm(t *testing.T, SwarmNum int, MsgNum int) {
 	// t.Skip("skipping for another test")
 
 	ctx := context.Background()
-	swarms := makeSwarms(ctx, t, SwarmNum, OptDisableReuseport)
+	swarms := makeSwarms(ctx, t, SwarmNum, swarmt.OptDisableReuseport)
 
 	// connect everyone
 	connectSwarms(t, ctx, swarms)
@@ -346,3 +392,878 @@ func TestNoDial(t *testing.T) {
 		t.Fatal("should have failed with ErrNoConn")
 	}
 }
+
+func TestStreamHandlerForProtocol(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	got := make(chan protocol.ID, 2)
+	for _, proto := range []protocol.ID{"/test/a", "/test/b"} {
+		proto := proto
+		swarms[1].SetStreamHandlerForProtocol(proto, func(s network.Stream) {
+			if s.Protocol() != proto {
+				t.Errorf("expected stream protocol %s, got %s", proto, s.Protocol())
+			}
+			got <- proto
+			s.Close()
+		})
+	}
+
+	for _, proto := range []protocol.ID{"/test/b", "/test/a"} {
+		s, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mss.SelectProtoOrFail(string(proto), s); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case p := <-got:
+			if p != proto {
+				t.Fatalf("stream for %s routed to handler for %s", proto, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream for %s was never handled", proto)
+		}
+		s.Close()
+	}
+}
+
+func TestStreamAcceptLatencyObserver(t *testing.T) {
+	ctx := context.Background()
+
+	type observation struct {
+		proto   protocol.ID
+		latency time.Duration
+	}
+	observed := make(chan observation, 3)
+	s1 := makeSwarmWithOpts(ctx, t, WithStreamAcceptLatencyObserver(func(proto protocol.ID, d time.Duration) {
+		observed <- observation{proto, d}
+	}))
+	defer s1.Close()
+	s2 := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s2.Peerstore().AddAddrs(s1.LocalPeer(), s1.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	// Each inbound stream is held up longer than the last before it reaches
+	// its handler.
+	const step = 20 * time.Millisecond
+	var opened int32
+	s1.Notify(&network.NotifyBundle{
+		OpenedStreamF: func(_ network.Network, str network.Stream) {
+			if str.Stat().Direction == network.DirInbound {
+				time.Sleep(time.Duration(atomic.AddInt32(&opened, 1)) * step)
+			}
+		},
+	})
+	s1.SetStreamHandlerForProtocol("/test/slow", func(s network.Stream) {
+		s.Close()
+	})
+
+	var last time.Duration
+	for i := 1; i <= 3; i++ {
+		str, err := s2.NewStream(ctx, s1.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mss.SelectProtoOrFail("/test/slow", str); err != nil {
+			t.Fatal(err)
+		}
+
+		var o observation
+		select {
+		case o = <-observed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("accept latency never observed")
+		}
+		if o.proto != "/test/slow" {
+			t.Errorf("expected protocol /test/slow, got %q", o.proto)
+		}
+		if o.latency < time.Duration(i)*step || o.latency <= last {
+			t.Errorf("stream %d: expected growing latency, got %s after %s", i, o.latency, last)
+		}
+		last = o.latency
+		str.Close()
+	}
+}
+
+func TestNewStreamConnHint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeSwarmWithOpts(ctx, t)
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s2.Close()
+
+	// Dial directly over the transport so that s1 ends up with two
+	// connections to s2.
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s2))
+	for i := 0; i < 2; i++ {
+		c, err := tpt.Dial(ctx, s1.ListenAddresses()[0], s1.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	var conns []network.Conn
+	for i := 0; len(conns) != 2; i++ {
+		if i > 100 {
+			t.Fatalf("expected 2 conns, have %d", len(conns))
+		}
+		time.Sleep(10 * time.Millisecond)
+		conns = s1.ConnsToPeer(s2.LocalPeer())
+	}
+
+	for _, c := range conns {
+		str, err := s1.NewStream(WithConn(ctx, c), s2.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str.Conn() != c {
+			t.Errorf("expected stream on %s, got %s", c, str.Conn())
+		}
+		str.Reset()
+	}
+
+	// A conn to another peer is never used for the stream.
+	s3 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s3.Close()
+	if _, err := s1.NewStream(WithConn(ctx, conns[0]), s3.LocalPeer()); err != ErrConnHintMismatch {
+		t.Fatalf("expected ErrConnHintMismatch, got %v", err)
+	}
+}
+
+func TestConnDrain(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	swarms[1].SetStreamHandler(func(s network.Stream) {
+		io.Copy(ioutil.Discard, s)
+		s.Close()
+	})
+
+	str, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := str.Conn().(*Conn)
+
+	drainCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- c.Drain(drainCtx)
+	}()
+
+	// New outbound streams are refused.
+	for i := 0; ; i++ {
+		s, err := c.NewStream()
+		if err == ErrConnDraining {
+			break
+		} else if err == nil {
+			// Drain hasn't started yet.
+			s.Reset()
+		}
+		if i > 100 {
+			t.Fatal("conn never started draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New inbound streams are reset.
+	rc := swarms[1].ConnsToPeer(swarms[0].LocalPeer())[0]
+	rstr, err := rc.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rstr.Write([]byte("hello"))
+	if _, err := rstr.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("expected inbound stream on a draining conn to be reset, got %v", err)
+	}
+
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned with a stream still open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Finish the existing stream; the conn then closes.
+	str.Close()
+	if _, err := ioutil.ReadAll(str); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain never finished")
+	}
+	if len(swarms[0].ConnsToPeer(swarms[1].LocalPeer())) != 0 {
+		t.Fatal("expected the drained conn to be closed")
+	}
+}
+
+func TestConnIdleCallbacks(t *testing.T) {
+	ctx := context.Background()
+	const idleAfter = 50 * time.Millisecond
+
+	events := make(chan string, 10)
+	s1 := makeSwarmWithOpts(ctx, t,
+		WithConnIdleCallback(idleAfter, func(network.Conn) { events <- "idle" }),
+		WithConnActiveCallback(func(network.Conn) { events <- "active" }),
+	)
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("expected %s callback, got %s", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s callback never fired", want)
+		}
+	}
+	expectNothing := func() {
+		t.Helper()
+		select {
+		case got := <-events:
+			t.Fatalf("unexpected %s callback", got)
+		case <-time.After(3 * idleAfter):
+		}
+	}
+
+	// A new conn without streams goes idle, once.
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	expect("idle")
+	expectNothing()
+
+	// Opening a stream makes it active, and it stays so while the stream is
+	// open.
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("active")
+	expectNothing()
+
+	// A second stream isn't another transition.
+	str2, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	str.Reset()
+	expectNothing()
+
+	// Once the last stream goes away, it's idle again.
+	str2.Reset()
+	expect("idle")
+	expectNothing()
+}
+
+func TestStreamGate(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	// Admit at most two inbound streams per connection.
+	const maxStreams = 2
+	swarms[1].SetStreamGate(func(dir network.Direction, c network.Conn) bool {
+		return dir != network.DirInbound || len(c.GetStreams()) < maxStreams
+	})
+
+	ping := func(str network.Stream) error {
+		if _, err := str.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(str, make([]byte, 4))
+		return err
+	}
+	for i := 0; i < maxStreams; i++ {
+		str, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer str.Close()
+		if err := ping(str); err != nil {
+			t.Fatalf("stream %d: %s", i, err)
+		}
+	}
+	str, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(str); err == nil {
+		t.Fatal("expected the inbound stream over the limit to be reset")
+	}
+
+	// Outbound streams refused by the gate fail to open.
+	swarms[0].SetStreamGate(func(network.Direction, network.Conn) bool { return false })
+	if _, err := swarms[0].NewStream(ctx, swarms[1].LocalPeer()); err != ErrStreamGated {
+		t.Fatalf("expected ErrStreamGated, got %v", err)
+	}
+}
+
+func TestConnAcquire(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	s := swarms[0]
+	c := s.ConnsToPeer(swarms[1].LocalPeer())[0].(*Conn)
+	release := c.Acquire()
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("expected closing to wait for the acquired conn to be released")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(s.ConnsToPeer(swarms[1].LocalPeer())) != 1 {
+		t.Fatal("expected the acquired conn to stay open")
+	}
+
+	// CloseConnsWhere doesn't wait for acquired conns.
+	where := make(chan struct{})
+	go func() {
+		s.CloseConnsWhere(func(network.Conn) bool { return true })
+		close(where)
+	}()
+	select {
+	case <-where:
+	case <-time.After(time.Second):
+		t.Fatal("expected CloseConnsWhere not to wait for the acquired conn")
+	}
+	if len(s.ConnsToPeer(swarms[1].LocalPeer())) != 1 {
+		t.Fatal("expected the acquired conn to stay open")
+	}
+
+	release()
+	release() // releasing twice is harmless
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn wasn't closed after being released")
+	}
+	if len(s.ConnsToPeer(swarms[1].LocalPeer())) != 0 {
+		t.Fatal("expected the conn to be closed")
+	}
+}
+
+func TestDrainAcquiredConn(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	c := swarms[0].ConnsToPeer(swarms[1].LocalPeer())[0].(*Conn)
+	release := c.Acquire()
+	defer release()
+
+	// Drain doesn't wait past its context for the conn to be released.
+	dctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.Drain(dctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain waited for the acquired conn to be released")
+	}
+	if len(swarms[0].ConnsToPeer(swarms[1].LocalPeer())) != 0 {
+		t.Fatal("expected the conn to be closed")
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	connectSwarms(t, ctx, swarms)
+
+	c := swarms[0].ConnsToPeer(swarms[1].LocalPeer())[0].(*Conn)
+	remote := swarms[1].ConnsToPeer(swarms[0].LocalPeer())[0].(*Conn)
+	cctx := c.Context()
+	if cctx != c.Context() {
+		t.Fatal("expected the same context on every call")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		<-cctx.Done()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("context canceled before the conn was closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("context wasn't canceled when the conn closed")
+	}
+
+	// Contexts of closed connections start out canceled.
+	remote.Close()
+	if remote.Context().Err() == nil {
+		t.Fatal("expected the context of a closed conn to be canceled")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s := swarms[0]
+
+	// Skip the listen event.
+	select {
+	case evt := <-s.Events():
+		if evt.Type != EventListen {
+			t.Fatalf("expected a listen event, got %s", evt.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no listen event")
+	}
+
+	connectSwarms(t, ctx, swarms)
+	if err := s.ClosePeer(swarms[1].LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []EventType{EventConnected, EventDisconnected} {
+		select {
+		case evt := <-s.Events():
+			if evt.Type != expected {
+				t.Fatalf("expected a %s event, got %s", expected, evt.Type)
+			}
+			if evt.Peer != swarms[1].LocalPeer() || evt.Conn == nil {
+				t.Fatalf("unexpected %s event: %+v", evt.Type, evt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", expected)
+		}
+	}
+}
+
+func TestEventsDropOldest(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarmWithOpts(ctx, t, WithEventBufferSize(1))
+	defer s.Close()
+
+	// Listening on a second address overflows the buffer.
+	first := s.ListenAddresses()[0]
+	if err := s.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.DroppedEvents(); n != 1 {
+		t.Fatalf("expected one dropped event, got %d", n)
+	}
+	evt := <-s.Events()
+	if evt.Type != EventListen || evt.Addr.Equal(first) {
+		t.Fatalf("expected the newest listen event to be kept, got %+v", evt)
+	}
+}
+
+func TestEventDropStats(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarmWithOpts(ctx, t, WithEventBufferSize(2), WithDroppedEventReports())
+	defer s.Close()
+
+	listen := func() {
+		if err := s.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nobody consumes the events: with the initial listen event, the buffer
+	// overflows twice.
+	for i := 0; i < 3; i++ {
+		listen()
+	}
+	if n := s.EventDropStats()[EventListen]; n != 2 {
+		t.Fatalf("expected two dropped listen events, got %d", n)
+	}
+
+	// Catch up, the next event is preceded by a report.
+	for i := 0; i < 2; i++ {
+		<-s.Events()
+	}
+	listen()
+	evt := <-s.Events()
+	if evt.Type != EventDropped || evt.Dropped[EventListen] != 2 {
+		t.Fatalf("expected a report of two dropped listen events, got %+v", evt)
+	}
+	if evt := <-s.Events(); evt.Type != EventListen {
+		t.Fatalf("expected a listen event, got %s", evt.Type)
+	}
+
+	// Counters are cumulative.
+	for i := 0; i < 3; i++ {
+		listen()
+	}
+	if n := s.EventDropStats()[EventListen]; n != 3 {
+		t.Fatalf("expected three dropped listen events, got %d", n)
+	}
+}
+
+func TestLastDisconnectReason(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+	connectSwarms(t, ctx, swarms)
+
+	if _, ok := s1.LastDisconnectReason(s2.LocalPeer()); ok {
+		t.Fatal("expected no disconnect reason before any connection closed")
+	}
+
+	banned := DisconnectApplication + 1
+	c := s1.ConnsToPeer(s2.LocalPeer())[0].(*Conn)
+	if err := c.CloseWithReason(banned); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := s1.LastDisconnectReason(s2.LocalPeer()); !ok || r != banned {
+		t.Fatalf("expected disconnect reason %s, got %s (%t)", banned, r, ok)
+	}
+	if ds := s1.RecentDisconnects(); len(ds) != 1 || ds[0].Peer != s2.LocalPeer() || ds[0].Summary == "" {
+		t.Fatalf("unexpected recent disconnects: %+v", ds)
+	}
+
+	// The other side sees the connection going away.
+	for i := 0; ; i++ {
+		if r, ok := s2.LastDisconnectReason(s1.LocalPeer()); ok {
+			if r != DisconnectRemote {
+				t.Fatalf("expected disconnect reason %s, got %s", DisconnectRemote, r)
+			}
+			break
+		}
+		if i > 100 {
+			t.Fatal("the remote side never recorded the disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNoTransports(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := makeBareSwarm(ctx, t)
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != ErrNoTransports {
+		t.Fatalf("expected ErrNoTransports when dialing, got %v", err)
+	}
+	if err := s1.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != ErrNoTransports {
+		t.Fatalf("expected ErrNoTransports when listening, got %v", err)
+	}
+
+	// With a transport, an address nothing can listen on is reported as such.
+	if err := s2.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0")); err != ErrNoTransport {
+		t.Fatalf("expected ErrNoTransport, got %v", err)
+	}
+}
+
+func TestGenSwarmMem(t *testing.T) {
+	ctx := context.Background()
+	a := swarmt.GenSwarmMem(t, ctx)
+	defer a.Close()
+	b := swarmt.GenSwarmMem(t, ctx)
+	defer b.Close()
+	a.SetStreamHandler(EchoStreamHandler)
+	b.SetStreamHandler(EchoStreamHandler)
+
+	swarmt.ConnectSwarms(t, a, b)
+
+	ping := func(from, to *Swarm) {
+		str, err := from.NewStream(ctx, to.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer str.Close()
+		if _, err := str.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(str, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "pong" {
+			t.Fatalf("expected pong, got %q", buf)
+		}
+	}
+	ping(a, b)
+	ping(b, a)
+}
+
+func TestDropConn(t *testing.T) {
+	ctx := context.Background()
+	a := swarmt.GenSwarmMem(t, ctx)
+	defer a.Close()
+	b := swarmt.GenSwarmMem(t, ctx)
+	defer b.Close()
+
+	readErr := make(chan error, 1)
+	b.SetStreamHandler(func(s network.Stream) {
+		_, err := io.Copy(ioutil.Discard, s)
+		readErr <- err
+	})
+	disconnected := make(chan struct{}, 1)
+	b.Notify(&network.NotifyBundle{
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			disconnected <- struct{}{}
+		},
+	})
+
+	swarmt.ConnectSwarms(t, a, b)
+	str, err := a.NewStream(ctx, b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the remote side has the stream before dropping the conn.
+	if _, err := str.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(b.ConnsToPeer(a.LocalPeer())[0].GetStreams()) == 0; i++ {
+		if i > 100 {
+			t.Fatal("remote stream never showed up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := swarmt.DropConn(a.ConnsToPeer(b.LocalPeer())[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatal("expected the remote stream to fail, it was closed cleanly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote stream hung after the conn was dropped")
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote side never noticed the disconnect")
+	}
+	for i := 0; len(a.ConnsToPeer(b.LocalPeer())) != 0; i++ {
+		if i > 100 {
+			t.Fatal("local side never noticed the disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	swarmt.ConnectSwarms(t, a, b)
+	if a.Connectedness(b.LocalPeer()) != network.Connected {
+		t.Fatal("expected to reconnect")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	a := swarmt.GenSwarmMem(t, ctx)
+	defer a.Close()
+	b := swarmt.GenSwarmMem(t, ctx)
+	defer b.Close()
+	b.SetStreamHandler(EchoStreamHandler)
+
+	// A peer that went away: dialing it fails.
+	gone := swarmt.GenSwarmMem(t, ctx)
+	swarmt.DivulgeAddresses(gone, a)
+	gone.Close()
+	if _, err := a.DialPeer(ctx, gone.LocalPeer()); err == nil {
+		t.Fatal("expected dialing a closed swarm to fail")
+	}
+
+	swarmt.ConnectSwarms(t, a, b)
+	// Dialing a connected peer reuses the connection.
+	if _, err := a.DialPeer(ctx, b.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	str, err := a.NewStream(ctx, b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(str, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	m := a.Metrics()
+	if m.ConnsOutbound != 1 || m.ConnsInbound != 0 {
+		t.Errorf("expected 1 outbound and 0 inbound conns, got %d and %d", m.ConnsOutbound, m.ConnsInbound)
+	}
+	if m.StreamsOpen != 1 {
+		t.Errorf("expected 1 open stream, got %d", m.StreamsOpen)
+	}
+	if m.DialsAttempted != 2 || m.DialsSucceeded != 1 || m.DialsFailed != 1 {
+		t.Errorf("expected 2 dials, 1 succeeded and 1 failed, got %d, %d and %d", m.DialsAttempted, m.DialsSucceeded, m.DialsFailed)
+	}
+	if m.BytesOut != 4 || m.BytesIn != 4 {
+		t.Errorf("expected 4 bytes out and in, got %d and %d", m.BytesOut, m.BytesIn)
+	}
+	if m := b.Metrics(); m.ConnsInbound != 1 || m.ConnsOutbound != 0 {
+		t.Errorf("expected the remote to see 1 inbound conn, got %d inbound and %d outbound", m.ConnsInbound, m.ConnsOutbound)
+	}
+
+	str.Reset()
+	for i := 0; a.Metrics().StreamsOpen != 0; i++ {
+		if i > 100 {
+			t.Fatal("stream still counted as open after reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxStreamMemory(t *testing.T) {
+	ctx := context.Background()
+	a := makeSwarmWithOpts(ctx, t, WithMaxStreamMemory(2*StreamMemoryEstimate))
+	defer a.Close()
+	b := makeSwarmWithOpts(ctx, t, WithMaxStreamMemory(StreamMemoryEstimate))
+	defer b.Close()
+	b.SetStreamHandler(EchoStreamHandler)
+	swarmt.ConnectSwarms(t, a, b)
+
+	ping := func(str network.Stream) error {
+		if _, err := str.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(str, buf)
+		return err
+	}
+
+	s1, err := a.NewStream(ctx, b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(s1); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is at its cap, so it resets the second stream.
+	s2, err := a.NewStream(ctx, b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(s2); err == nil {
+		t.Fatal("expected the remote to reset a stream over its memory cap")
+	}
+
+	// a is at its cap as long as s2 isn't closed.
+	if _, err := a.NewStream(ctx, b.LocalPeer()); err != ErrResourceLimitExceeded {
+		t.Fatalf("expected ErrResourceLimitExceeded, got %v", err)
+	}
+	s2.Reset()
+
+	// Closing s1 frees room on both sides.
+	s1.Close()
+	if _, err := ioutil.ReadAll(s1); err != nil {
+		t.Fatal(err)
+	}
+	var s3 network.Stream
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s3, err = a.NewStream(ctx, b.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ping(s3); err == nil {
+			break
+		}
+		s3.Reset()
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a stream to be accepted once streams were closed, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s3.Close()
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	ctx := context.Background()
+	const lifetime = 100 * time.Millisecond
+	s1 := makeSwarmWithOpts(ctx, t, WithMaxConnLifetime(lifetime))
+	defer s1.Close()
+	s2 := makeSwarmWithOpts(ctx, t)
+	defer s2.Close()
+	s3 := makeSwarmWithOpts(ctx, t)
+	defer s3.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddrs(s3.LocalPeer(), s3.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	old, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exempt, err := s1.DialPeer(ctx, s3.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exempt.(*Conn).SetLifetimeExempt(true)
+
+	for i := 0; s1.Connectedness(s2.LocalPeer()) == network.Connected; i++ {
+		if i > 500 {
+			t.Fatal("expected the conn to be closed after its max lifetime")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s1.Connectedness(s3.LocalPeer()) != network.Connected {
+		t.Fatal("expected the exempt conn to stay open")
+	}
+
+	// The next stream gets a fresh conn.
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+	if str.Conn() == old {
+		t.Fatal("expected a new conn")
+	}
+
+	// Lifting the exemption from an expired conn closes it.
+	exempt.(*Conn).SetLifetimeExempt(false)
+	for i := 0; s1.Connectedness(s3.LocalPeer()) == network.Connected; i++ {
+		if i > 500 {
+			t.Fatal("expected the conn to be closed once no longer exempt")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,16 +1,121 @@
 package swarm
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/transport"
 
+	addrutil "github.com/libp2p/go-addr-util"
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
 )
 
+// UpgradableTransport is a transport that lets the swarm drive the connection
+// upgrade itself instead of upgrading inside Dial. This allows the swarm to
+// apply separate connect and upgrade timeouts (see WithUpgradeTimeout).
+type UpgradableTransport interface {
+	transport.Transport
+
+	// DialRaw dials the remote address without upgrading the connection.
+	DialRaw(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (manet.Conn, error)
+
+	// UpgradeOutbound upgrades a connection returned by DialRaw.
+	UpgradeOutbound(ctx context.Context, conn manet.Conn, p peer.ID) (transport.CapableConn, error)
+}
+
+// FdCostlyTransport is implemented by transports that know whether their
+// dials consume file descriptors, and so count against the swarm's limit on
+// concurrent fd consuming dials. For other transports the swarm decides by the
+// address (TCP dials consume file descriptors).
+type FdCostlyTransport interface {
+	transport.Transport
+
+	IsFdCostly() bool
+}
+
+// ListenPortReuser is implemented by transports that can dial from the
+// socket they listen on, sharing its local port. Those reporting true honor
+// the WithReuseListenPort hint (see Swarm.DialFromListenPort).
+type ListenPortReuser interface {
+	transport.Transport
+
+	ReusesListenPort() bool
+}
+
+// isFdCostly returns true if dialing the address consumes a file descriptor.
+func (s *Swarm) isFdCostly(a ma.Multiaddr) bool {
+	if t, ok := s.TransportForDialing(a).(FdCostlyTransport); ok {
+		return t.IsFdCostly()
+	}
+	return addrutil.IsFDCostlyTransport(a)
+}
+
+// MuxerTransport is implemented by transports that report the stream
+// multiplexers they offer when dialing, in order of preference, and honor the
+// WithPreferredMuxer hint. The swarm uses it to retry dials whose multiplexer
+// negotiation failed with another multiplexer (see WithMuxerFallback).
+type MuxerTransport interface {
+	transport.Transport
+
+	Muxers() []protocol.ID
+}
+
+// muxerNegotiationFailure is how the upgrader reports stream multiplexer
+// negotiation failures; it doesn't export an error to compare with.
+const muxerNegotiationFailure = "failed to negotiate stream multiplexer"
+
+func isMuxerNegotiationErr(err error) bool {
+	return strings.Contains(err.Error(), muxerNegotiationFailure)
+}
+
+// alternateMuxer returns the first multiplexer the transport offers other than
+// the one the failed dial offered first.
+func alternateMuxer(ctx context.Context, tpt transport.Transport) (protocol.ID, bool) {
+	mt, ok := tpt.(MuxerTransport)
+	if !ok {
+		return "", false
+	}
+	muxers := mt.Muxers()
+	if len(muxers) < 2 {
+		return "", false
+	}
+	tried, ok := GetPreferredMuxer(ctx)
+	if !ok {
+		tried = muxers[0]
+	}
+	for _, m := range muxers {
+		if m != tried {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+// TrafficClassDialer is implemented by transports that can set the traffic
+// class (DSCP value) of the connections they dial. The swarm uses it instead
+// of Dial when a dial asks for a traffic class (see WithConnTrafficClass).
+type TrafficClassDialer interface {
+	DialWithTrafficClass(ctx context.Context, raddr ma.Multiaddr, p peer.ID, tc int) (transport.CapableConn, error)
+}
+
+// RawTrafficClassDialer is implemented by upgradable transports that can set
+// the traffic class of the raw connections they dial. The swarm uses it
+// instead of DialWithTrafficClass when an upgrade timeout is configured, so
+// the timeout only governs the upgrade (see WithUpgradeTimeout).
+type RawTrafficClassDialer interface {
+	UpgradableTransport
+
+	DialRawWithTrafficClass(ctx context.Context, raddr ma.Multiaddr, p peer.ID, tc int) (manet.Conn, error)
+}
+
 // TransportForDialing retrieves the appropriate transport for dialing the given
-// multiaddr.
+// multiaddr. The fallback transport (see SetFallbackTransport) is only
+// returned if no registered transport can dial it.
 func (s *Swarm) TransportForDialing(a ma.Multiaddr) transport.Transport {
 	protocols := a.Protocols()
 	if len(protocols) == 0 {
@@ -19,11 +124,21 @@ func (s *Swarm) TransportForDialing(a ma.Multiaddr) transport.Transport {
 
 	s.transports.RLock()
 	defer s.transports.RUnlock()
-	if len(s.transports.m) == 0 {
+	if len(s.transports.m) == 0 && s.transports.fallback == nil {
 		log.Error("you have no transports configured")
 		return nil
 	}
 
+	t := s.registeredTransportForDialing(protocols)
+	if fb := s.transports.fallback; fb != nil && (t == nil || !t.CanDial(a)) && fb.CanDial(a) {
+		return fb
+	}
+	return t
+}
+
+// registeredTransportForDialing picks the registered transport for dialing an
+// address with the given protocols. The caller must hold the transports lock.
+func (s *Swarm) registeredTransportForDialing(protocols []ma.Protocol) transport.Transport {
 	for _, p := range protocols {
 		transport, ok := s.transports.m[p.Code]
 		if !ok {
@@ -37,6 +152,23 @@ func (s *Swarm) TransportForDialing(a ma.Multiaddr) transport.Transport {
 	return s.transports.m[protocols[len(protocols)-1].Code]
 }
 
+// SetFallbackTransport sets a transport used to dial the addresses no
+// registered transport can dial, e.g., an experimental transport or a relay
+// of last resort. It's never listened on. Passing nil removes it.
+func (s *Swarm) SetFallbackTransport(t transport.Transport) {
+	s.transports.Lock()
+	defer s.transports.Unlock()
+	s.transports.fallback = t
+}
+
+// hasTransports returns true if at least one transport is registered, or a
+// fallback transport is set.
+func (s *Swarm) hasTransports() bool {
+	s.transports.RLock()
+	defer s.transports.RUnlock()
+	return len(s.transports.m) > 0 || s.transports.fallback != nil
+}
+
 // TransportForListening retrieves the appropriate transport for listening on
 // the given multiaddr.
 func (s *Swarm) TransportForListening(a ma.Multiaddr) transport.Transport {
@@ -65,6 +197,21 @@ func (s *Swarm) TransportForListening(a ma.Multiaddr) transport.Transport {
 	return selected
 }
 
+// SetSecurityPreference sets the order in which security protocols should be
+// offered when upgrading outbound connections. The preference is passed to
+// transports through the dial context (see WithSecurityPreference); transports
+// and security muxers that don't support it will ignore it.
+func (s *Swarm) SetSecurityPreference(order []protocol.ID) {
+	s.secPreference.Store(append([]protocol.ID(nil), order...))
+}
+
+// SecurityPreference returns the security protocol preference set with
+// SetSecurityPreference.
+func (s *Swarm) SecurityPreference() []protocol.ID {
+	order, _ := s.secPreference.Load().([]protocol.ID)
+	return order
+}
+
 // AddTransport adds a transport to this swarm.
 //
 // Satisfies the Network interface from go-libp2p-transport.
@@ -100,3 +247,86 @@ func (s *Swarm) AddTransport(t transport.Transport) error {
 	}
 	return nil
 }
+
+// RemoveTransport unregisters the transport and closes its listeners and
+// connections. Acquired connections (see Conn.Acquire) are closed in the
+// background once released; RemoveTransport doesn't wait for them.
+func (s *Swarm) RemoveTransport(t transport.Transport) error {
+	conns, err := s.removeTransport(t)
+	if err != nil {
+		return err
+	}
+	closeConns(conns)
+	return nil
+}
+
+// RemoveTransportGraceful unregisters the transport and closes its listeners,
+// like RemoveTransport, but drains its connections (see Conn.Drain) instead of
+// closing them outright: they refuse new streams and close once their
+// existing streams are done, or when the context expires.
+//
+// The transport is unregistered before its connections are drained, not
+// after, so no new connections are dialed over it in the meantime.
+//
+// It returns the context's error if streams were still open when it expired.
+func (s *Swarm) RemoveTransportGraceful(ctx context.Context, t transport.Transport) error {
+	conns, err := s.removeTransport(t)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, len(conns))
+	for _, c := range conns {
+		go func(c *Conn) {
+			errCh <- c.Drain(ctx)
+		}(c)
+	}
+	for range conns {
+		if e := <-errCh; e != nil && e != ErrConnClosed && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// removeTransport unregisters the transport, closes its listeners and returns
+// its connections.
+func (s *Swarm) removeTransport(t transport.Transport) ([]*Conn, error) {
+	// Find the connections before unregistering, while their addresses
+	// still map to the transport.
+	var conns []*Conn
+	s.ForEachConn(func(nc network.Conn) bool {
+		c := nc.(*Conn)
+		if c.conn.Transport() == t || s.TransportForDialing(c.RemoteMultiaddr()) == t {
+			conns = append(conns, c)
+		}
+		return true
+	})
+
+	s.transports.Lock()
+	removed := false
+	for p, other := range s.transports.m {
+		if other == t {
+			delete(s.transports.m, p)
+			removed = true
+		}
+	}
+	s.transports.Unlock()
+	if !removed {
+		return nil, ErrTransportNotRegistered
+	}
+
+	var listeners []transport.Listener
+	s.listeners.Lock()
+	for l, ls := range s.listeners.m {
+		if ls.tpt == t {
+			ls.closedOnPurpose = true
+			listeners = append(listeners, l)
+		}
+	}
+	s.listeners.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	return conns, nil
+}
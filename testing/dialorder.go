@@ -0,0 +1,96 @@
+package testing
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// orderedPeerstore remembers the order in which addresses were added for each
+// peer, which the underlying peerstore doesn't preserve.
+type orderedPeerstore struct {
+	peerstore.Peerstore
+
+	mu    sync.Mutex
+	order map[peer.ID]map[string]int
+	next  int
+}
+
+func newOrderedPeerstore(ps peerstore.Peerstore) *orderedPeerstore {
+	return &orderedPeerstore{
+		Peerstore: ps,
+		order:     make(map[peer.ID]map[string]int),
+	}
+}
+
+func (ps *orderedPeerstore) record(p peer.ID, addrs []ma.Multiaddr) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	order := ps.order[p]
+	if order == nil {
+		order = make(map[string]int)
+		ps.order[p] = order
+	}
+	for _, a := range addrs {
+		if _, ok := order[string(a.Bytes())]; !ok {
+			order[string(a.Bytes())] = ps.next
+			ps.next++
+		}
+	}
+}
+
+func (ps *orderedPeerstore) AddAddr(p peer.ID, addr ma.Multiaddr, ttl time.Duration) {
+	ps.AddAddrs(p, []ma.Multiaddr{addr}, ttl)
+}
+
+func (ps *orderedPeerstore) AddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
+	ps.record(p, addrs)
+	ps.Peerstore.AddAddrs(p, addrs, ttl)
+}
+
+func (ps *orderedPeerstore) SetAddr(p peer.ID, addr ma.Multiaddr, ttl time.Duration) {
+	ps.SetAddrs(p, []ma.Multiaddr{addr}, ttl)
+}
+
+func (ps *orderedPeerstore) SetAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
+	ps.record(p, addrs)
+	ps.Peerstore.SetAddrs(p, addrs, ttl)
+}
+
+// rank is a swarm.AddrRanker ordering addresses by when they were first added
+// to the peerstore. Addresses it doesn't know about go last.
+func (ps *orderedPeerstore) rank(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	ps.mu.Lock()
+	order := ps.order[p]
+	idx := make([]int, len(addrs))
+	for i, a := range addrs {
+		n, ok := order[string(a.Bytes())]
+		if !ok {
+			n = ps.next
+		}
+		idx[i] = n
+	}
+	ps.mu.Unlock()
+
+	ranked := make([]ma.Multiaddr, len(addrs))
+	copy(ranked, addrs)
+	sort.Stable(byIndex{ranked, idx})
+	return ranked
+}
+
+type byIndex struct {
+	addrs []ma.Multiaddr
+	idx   []int
+}
+
+func (b byIndex) Len() int           { return len(b.addrs) }
+func (b byIndex) Less(i, j int) bool { return b.idx[i] < b.idx[j] }
+func (b byIndex) Swap(i, j int) {
+	b.addrs[i], b.addrs[j] = b.addrs[j], b.addrs[i]
+	b.idx[i], b.idx[j] = b.idx[j], b.idx[i]
+}
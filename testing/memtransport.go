@@ -0,0 +1,409 @@
+package testing
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+
+	swarm "github.com/libp2p/go-libp2p-swarm"
+)
+
+// P_MEMORY is the multiaddr protocol code of in-memory addresses
+// (/memory/<id>), as used by later multiaddr releases.
+const P_MEMORY = 0x0309
+
+func init() {
+	// Newer multiaddr releases know about /memory already.
+	if ma.ProtocolWithCode(P_MEMORY).Code != 0 {
+		return
+	}
+	err := ma.AddProtocol(ma.Protocol{
+		Name:       "memory",
+		Code:       P_MEMORY,
+		VCode:      ma.CodeToVarint(P_MEMORY),
+		Size:       64,
+		Transcoder: ma.NewTranscoderFromFunctions(memoryStB, memoryBtS, memoryValidate),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func memoryStB(s string) ([]byte, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse memory addr: %s", err)
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b, nil
+}
+
+func memoryBtS(b []byte) (string, error) {
+	if err := memoryValidate(b); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(binary.BigEndian.Uint64(b), 10), nil
+}
+
+func memoryValidate(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("invalid length for memory addr: %d", len(b))
+	}
+	return nil
+}
+
+var errMemNoListener = errors.New("nothing listening on memory address")
+
+// memNetwork routes in-memory dials to listeners, process-wide. It also
+// tracks open connections by their endpoints so they can be dropped.
+var memNetwork = struct {
+	sync.Mutex
+	nextID    uint64
+	listeners map[uint64]*memListener
+	conns     map[memConnKey]*memConn
+}{
+	listeners: make(map[uint64]*memListener),
+	conns:     make(map[memConnKey]*memConn),
+}
+
+type memConnKey struct {
+	laddr, raddr memAddr
+}
+
+// memAddr is the net.Addr of an in-memory endpoint.
+type memAddr uint64
+
+func (a memAddr) Network() string { return "memory" }
+func (a memAddr) String() string  { return strconv.FormatUint(uint64(a), 10) }
+
+func (a memAddr) multiaddr() ma.Multiaddr {
+	return ma.StringCast("/memory/" + a.String())
+}
+
+func memAddrID(a ma.Multiaddr) (uint64, error) {
+	v, err := a.ValueForProtocol(P_MEMORY)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// MemTransport is a transport connecting swarms in the same process through
+// in-memory pipes, listening on and dialing /memory/<id> addresses. Listening
+// on /memory/0 picks an unused id.
+type MemTransport struct {
+	upgrader *tptu.Upgrader
+}
+
+var _ transport.Transport = (*MemTransport)(nil)
+
+// NewMemTransport constructs an in-memory transport upgrading its connections
+// with the given upgrader.
+func NewMemTransport(upgrader *tptu.Upgrader) *MemTransport {
+	return &MemTransport{upgrader: upgrader}
+}
+
+// Dial implements transport.Transport.
+func (t *MemTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	return t.dial(ctx, raddr, p, 0)
+}
+
+// dial dials from the given local address, or from a fresh one if it's 0.
+func (t *MemTransport) dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID, local memAddr) (transport.CapableConn, error) {
+	id, err := memAddrID(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	memNetwork.Lock()
+	l := memNetwork.listeners[id]
+	if local == 0 {
+		memNetwork.nextID++
+		local = memAddr(memNetwork.nextID)
+	}
+	memNetwork.Unlock()
+	if l == nil {
+		return nil, errMemNoListener
+	}
+
+	c1, c2 := net.Pipe()
+	ours := newMemConn(c1, local, memAddr(id))
+	theirs := newMemConn(c2, memAddr(id), local)
+	select {
+	case l.incoming <- theirs:
+	case <-l.closed:
+		ours.Close()
+		theirs.Close()
+		return nil, errMemNoListener
+	case <-ctx.Done():
+		ours.Close()
+		theirs.Close()
+		return nil, ctx.Err()
+	}
+	return t.upgrader.UpgradeOutbound(ctx, t, ours, p)
+}
+
+// CanDial implements transport.Transport.
+func (t *MemTransport) CanDial(addr ma.Multiaddr) bool {
+	_, err := memAddrID(addr)
+	return err == nil
+}
+
+// Listen implements transport.Transport.
+func (t *MemTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	id, err := memAddrID(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	memNetwork.Lock()
+	defer memNetwork.Unlock()
+	if id == 0 {
+		memNetwork.nextID++
+		id = memNetwork.nextID
+	}
+	if _, ok := memNetwork.listeners[id]; ok {
+		return nil, fmt.Errorf("memory address %d already in use", id)
+	}
+	l := &memListener{
+		addr:     memAddr(id),
+		incoming: make(chan *memConn),
+		pausing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	memNetwork.listeners[id] = l
+	return newUpgradingListener(t, l), nil
+}
+
+// Protocols implements transport.Transport.
+func (t *MemTransport) Protocols() []int {
+	return []int{P_MEMORY}
+}
+
+// Proxy implements transport.Transport.
+func (t *MemTransport) Proxy() bool {
+	return false
+}
+
+// memListener is the raw listener behind a MemTransport listener. Dials
+// block until accepted, so they don't complete while it's paused.
+type memListener struct {
+	addr     memAddr
+	incoming chan *memConn
+
+	mu      sync.Mutex
+	paused  chan struct{} // closed on resume, nil when not paused
+	pausing chan struct{} // closed on pause
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ manet.Listener = (*memListener)(nil)
+
+func (l *memListener) Accept() (manet.Conn, error) {
+	for {
+		l.mu.Lock()
+		paused, pausing := l.paused, l.pausing
+		l.mu.Unlock()
+		if paused != nil {
+			select {
+			case <-paused:
+				continue
+			case <-l.closed:
+				return nil, errors.New("listener closed")
+			}
+		}
+		select {
+		case c := <-l.incoming:
+			return c, nil
+		case <-pausing:
+		case <-l.closed:
+			return nil, errors.New("listener closed")
+		}
+	}
+}
+
+func (l *memListener) pause() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paused == nil {
+		l.paused = make(chan struct{})
+		close(l.pausing)
+	}
+}
+
+func (l *memListener) resume() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paused != nil {
+		close(l.paused)
+		l.paused = nil
+		l.pausing = make(chan struct{})
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		memNetwork.Lock()
+		delete(memNetwork.listeners, uint64(l.addr))
+		memNetwork.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr          { return l.addr }
+func (l *memListener) Multiaddr() ma.Multiaddr { return l.addr.multiaddr() }
+
+// upgradingListener upgrades the connections accepted by a memListener, like
+// the upgrader's listener but counting the upgrades that failed (see
+// swarm.UpgradeStatsListener) and able to stop accepting (see
+// swarm.PausableListener).
+type upgradingListener struct {
+	// accessed atomically; keep first for 64-bit alignment.
+	upgraded, failed uint64
+
+	t        *MemTransport
+	raw      *memListener
+	incoming chan transport.CapableConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var (
+	_ swarm.UpgradeStatsListener = (*upgradingListener)(nil)
+	_ swarm.PausableListener     = (*upgradingListener)(nil)
+)
+
+func newUpgradingListener(t *MemTransport, raw *memListener) *upgradingListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &upgradingListener{
+		t:        t,
+		raw:      raw,
+		incoming: make(chan transport.CapableConn),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go l.handleIncoming()
+	return l
+}
+
+func (l *upgradingListener) handleIncoming() {
+	for {
+		c, err := l.raw.Accept()
+		if err != nil {
+			return
+		}
+		go l.upgrade(c)
+	}
+}
+
+func (l *upgradingListener) upgrade(c manet.Conn) {
+	ctx, cancel := context.WithTimeout(l.ctx, transport.AcceptTimeout)
+	defer cancel()
+	conn, err := l.t.upgrader.UpgradeInbound(ctx, l.t, c)
+	if err != nil {
+		atomic.AddUint64(&l.failed, 1)
+		c.Close()
+		return
+	}
+	atomic.AddUint64(&l.upgraded, 1)
+	select {
+	case l.incoming <- conn:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+func (l *upgradingListener) Accept() (transport.CapableConn, error) {
+	select {
+	case c := <-l.incoming:
+		return c, nil
+	case <-l.ctx.Done():
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *upgradingListener) Close() error {
+	l.cancel()
+	return l.raw.Close()
+}
+
+func (l *upgradingListener) Pause()  { l.raw.pause() }
+func (l *upgradingListener) Resume() { l.raw.resume() }
+
+func (l *upgradingListener) UpgradeStats() (upgraded, failed uint64) {
+	return atomic.LoadUint64(&l.upgraded), atomic.LoadUint64(&l.failed)
+}
+
+func (l *upgradingListener) Addr() net.Addr          { return l.raw.Addr() }
+func (l *upgradingListener) Multiaddr() ma.Multiaddr { return l.raw.Multiaddr() }
+
+// memConn is one end of an in-memory pipe.
+type memConn struct {
+	net.Conn
+	laddr, raddr memAddr
+}
+
+var _ manet.Conn = (*memConn)(nil)
+
+func newMemConn(c net.Conn, laddr, raddr memAddr) *memConn {
+	mc := &memConn{Conn: c, laddr: laddr, raddr: raddr}
+	memNetwork.Lock()
+	memNetwork.conns[memConnKey{laddr, raddr}] = mc
+	memNetwork.Unlock()
+	return mc
+}
+
+func (c *memConn) Close() error {
+	memNetwork.Lock()
+	if memNetwork.conns[memConnKey{c.laddr, c.raddr}] == c {
+		delete(memNetwork.conns, memConnKey{c.laddr, c.raddr})
+	}
+	memNetwork.Unlock()
+	return c.Conn.Close()
+}
+
+// DropConn abruptly severs the in-memory pipe under the given connection,
+// simulating a network failure: neither side's security or multiplexer layer
+// gets to say goodbye, both just see the pipe break. It only works for
+// connections of a MemTransport or MockTransport.
+func DropConn(c network.Conn) error {
+	laddr, err := memAddrID(c.LocalMultiaddr())
+	if err != nil {
+		return fmt.Errorf("not an in-memory connection: %s", err)
+	}
+	raddr, err := memAddrID(c.RemoteMultiaddr())
+	if err != nil {
+		return fmt.Errorf("not an in-memory connection: %s", err)
+	}
+
+	memNetwork.Lock()
+	mc := memNetwork.conns[memConnKey{memAddr(laddr), memAddr(raddr)}]
+	memNetwork.Unlock()
+	if mc == nil {
+		return errors.New("no such in-memory connection")
+	}
+	return mc.Close()
+}
+
+func (c *memConn) LocalAddr() net.Addr           { return c.laddr }
+func (c *memConn) RemoteAddr() net.Addr          { return c.raddr }
+func (c *memConn) LocalMultiaddr() ma.Multiaddr  { return c.laddr.multiaddr() }
+func (c *memConn) RemoteMultiaddr() ma.Multiaddr { return c.raddr.multiaddr() }
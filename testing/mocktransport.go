@@ -0,0 +1,157 @@
+package testing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+
+	swarm "github.com/libp2p/go-libp2p-swarm"
+)
+
+// ErrMockDialFailed is returned by MockTransport dials failed on purpose (see
+// MockTransport.FailNextDials).
+var ErrMockDialFailed = errors.New("mock dial failed")
+
+// MockTransport is an in-memory transport (see MemTransport) whose dialing
+// behavior can be controlled by tests. Install it with OptTransport; GenSwarm
+// sets up its connection upgrader and listens on a /memory address.
+type MockTransport struct {
+	// DialLatency delays every dial, before it fails or connects.
+	DialLatency time.Duration
+	// FdConsuming makes the swarm count the transport's dials against its
+	// limit on fd consuming dials (see swarm.FdCostlyTransport).
+	FdConsuming bool
+	// Reuseport makes the transport's connections report that they share
+	// their local address (see swarm.ReuseportConn).
+	Reuseport bool
+	// ReuseListenPort makes the transport dial from its listen address when
+	// asked to (see swarm.ListenPortReuser).
+	ReuseListenPort bool
+
+	mem *MemTransport
+
+	mu       sync.Mutex
+	failNext int
+	dials    int
+	listen   memAddr
+}
+
+var (
+	_ swarm.FdCostlyTransport = (*MockTransport)(nil)
+	_ swarm.ListenPortReuser  = (*MockTransport)(nil)
+)
+
+// NewMockTransport constructs a mock transport connecting and accepting
+// without delay.
+func NewMockTransport() *MockTransport {
+	return &MockTransport{}
+}
+
+// FailNextDials makes the next n dials fail with ErrMockDialFailed.
+func (t *MockTransport) FailNextDials(n int) {
+	t.mu.Lock()
+	t.failNext = n
+	t.mu.Unlock()
+}
+
+// Dials returns the number of dials attempted so far.
+func (t *MockTransport) Dials() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dials
+}
+
+// Dial implements transport.Transport.
+func (t *MockTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	t.mu.Lock()
+	t.dials++
+	fail := t.failNext > 0
+	if fail {
+		t.failNext--
+	}
+	t.mu.Unlock()
+
+	if t.DialLatency > 0 {
+		timer := time.NewTimer(t.DialLatency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	if fail {
+		return nil, ErrMockDialFailed
+	}
+
+	var local memAddr
+	if t.ReuseListenPort && swarm.GetReuseListenPort(ctx) {
+		t.mu.Lock()
+		local = t.listen
+		t.mu.Unlock()
+		if local == 0 {
+			return nil, errors.New("mock transport isn't listening")
+		}
+	}
+	c, err := t.mem.dial(ctx, raddr, p, local)
+	if err != nil || !t.Reuseport {
+		return c, err
+	}
+	return &reuseportConn{CapableConn: c}, nil
+}
+
+// CanDial implements transport.Transport.
+func (t *MockTransport) CanDial(addr ma.Multiaddr) bool {
+	return t.mem.CanDial(addr)
+}
+
+// Listen implements transport.Transport.
+func (t *MockTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	l, err := t.mem.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+	id, err := memAddrID(l.Multiaddr())
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	t.mu.Lock()
+	if t.listen == 0 {
+		t.listen = memAddr(id)
+	}
+	t.mu.Unlock()
+	return l, nil
+}
+
+// Protocols implements transport.Transport.
+func (t *MockTransport) Protocols() []int {
+	return []int{P_MEMORY}
+}
+
+// Proxy implements transport.Transport.
+func (t *MockTransport) Proxy() bool {
+	return false
+}
+
+// IsFdCostly implements swarm.FdCostlyTransport.
+func (t *MockTransport) IsFdCostly() bool {
+	return t.FdConsuming
+}
+
+// ReusesListenPort implements swarm.ListenPortReuser.
+func (t *MockTransport) ReusesListenPort() bool {
+	return t.ReuseListenPort
+}
+
+type reuseportConn struct {
+	transport.CapableConn
+}
+
+func (c *reuseportConn) Reuseport() bool { return true }
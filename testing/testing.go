@@ -2,11 +2,18 @@ package testing
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/sec"
+	"github.com/libp2p/go-libp2p-core/transport"
 	"github.com/libp2p/go-libp2p-testing/net"
 	"github.com/libp2p/go-tcp-transport"
 
@@ -17,6 +24,7 @@ import (
 	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
 	yamux "github.com/libp2p/go-libp2p-yamux"
 	msmux "github.com/libp2p/go-stream-muxer-multistream"
+	ma "github.com/multiformats/go-multiaddr"
 
 	swarm "github.com/libp2p/go-libp2p-swarm"
 )
@@ -24,8 +32,28 @@ import (
 type config struct {
 	disableReuseport bool
 	dialOnly         bool
+	connectionGater  swarm.ConnectionGater
+	maxConnsPerPeer  int
+	dialTimeout      time.Duration
+	transports       []transport.Transport
+	security         []securityOpt
+	muxers           []muxerOpt
+	dialOrder        bool
 }
 
+type securityOpt struct {
+	id  string
+	new SecurityConstructor
+}
+
+type muxerOpt struct {
+	id  string
+	tpt mux.Multiplexer
+}
+
+// SecurityConstructor constructs a security transport for the given identity.
+type SecurityConstructor func(id peer.ID, pk crypto.PrivKey) (sec.SecureTransport, error)
+
 // Option is an option that can be passed when constructing a test swarm.
 type Option func(*testing.T, *config)
 
@@ -39,29 +67,187 @@ var OptDialOnly Option = func(_ *testing.T, c *config) {
 	c.dialOnly = true
 }
 
-// GenUpgrader creates a new connection upgrader for use with this swarm.
-func GenUpgrader(n *swarm.Swarm) *tptu.Upgrader {
+// OptDeterministicDialOrder makes the test swarm dial a peer's addresses one
+// at a time, strictly in the order they were added to the peerstore, so
+// tests can assert the exact sequence of dial attempts. It installs an address
+// ranker (see swarm.WithAddrRanker), limits dials to one per peer at a time
+// and disables happy eyeballs staggering, backoff jitter and the preference
+// for transports of existing connections.
+var OptDeterministicDialOrder Option = func(_ *testing.T, c *config) {
+	c.dialOrder = true
+}
+
+// OptConnGater configures the given connection gater on the test swarm.
+func OptConnGater(cg swarm.ConnectionGater) Option {
+	return func(_ *testing.T, c *config) {
+		c.connectionGater = cg
+	}
+}
+
+// OptMaxConns limits the number of connections to any single peer on the
+// test swarm (see swarm.WithMaxConnsPerPeer).
+func OptMaxConns(n int) Option {
+	return func(_ *testing.T, c *config) {
+		c.maxConnsPerPeer = n
+	}
+}
+
+// OptDialTimeout sets the per address dial timeout of the test swarm (see
+// swarm.WithDialTimeout).
+func OptDialTimeout(d time.Duration) Option {
+	return func(_ *testing.T, c *config) {
+		c.dialTimeout = d
+	}
+}
+
+// OptTransports installs the given transports on the test swarm instead of
+// the default TCP transport. The swarm listens on its default TCP address
+// and on a /memory address, if one of them can listen on it.
+func OptTransports(ts ...transport.Transport) Option {
+	return func(_ *testing.T, c *config) {
+		c.transports = append(c.transports, ts...)
+	}
+}
+
+// OptTransport installs the given transport on the test swarm, like
+// OptTransports. It's mostly useful with a MockTransport.
+func OptTransport(t transport.Transport) Option {
+	return OptTransports(t)
+}
+
+// OptSecurity adds a security transport to the test swarm's upgrader, in
+// order of preference, replacing the default (secio).
+func OptSecurity(id string, c SecurityConstructor) Option {
+	return func(_ *testing.T, cfg *config) {
+		cfg.security = append(cfg.security, securityOpt{id: id, new: c})
+	}
+}
+
+// OptMuxer adds a stream multiplexer to the test swarm's upgrader, in order
+// of preference, replacing the default (yamux).
+func OptMuxer(id string, m mux.Multiplexer) Option {
+	return func(_ *testing.T, cfg *config) {
+		cfg.muxers = append(cfg.muxers, muxerOpt{id: id, tpt: m})
+	}
+}
+
+// GenUpgrader creates a new connection upgrader for use with this swarm. It
+// uses secio and yamux, unless other security transports or multiplexers are
+// given with OptSecurity and OptMuxer; other options are ignored.
+func GenUpgrader(n *swarm.Swarm, opts ...Option) *tptu.Upgrader {
+	var cfg config
+	for _, o := range opts {
+		o(nil, &cfg)
+	}
+	u, err := genUpgrader(n, &cfg)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func genUpgrader(n *swarm.Swarm, cfg *config) (*tptu.Upgrader, error) {
 	id := n.LocalPeer()
 	pk := n.Peerstore().PrivKey(id)
 	secMuxer := new(csms.SSMuxer)
-	secMuxer.AddTransport(secio.ID, &secio.Transport{
-		LocalID:    id,
-		PrivateKey: pk,
-	})
+	if len(cfg.security) == 0 {
+		secMuxer.AddTransport(secio.ID, &secio.Transport{
+			LocalID:    id,
+			PrivateKey: pk,
+		})
+	}
+	for _, s := range cfg.security {
+		st, err := s.new(id, pk)
+		if err != nil {
+			return nil, err
+		}
+		secMuxer.AddTransport(s.id, st)
+	}
 
 	stMuxer := msmux.NewBlankTransport()
-	stMuxer.AddTransport("/yamux/1.0.0", yamux.DefaultTransport)
+	if len(cfg.muxers) == 0 {
+		stMuxer.AddTransport("/yamux/1.0.0", yamux.DefaultTransport)
+	}
+	for _, m := range cfg.muxers {
+		stMuxer.AddTransport(m.id, m.tpt)
+	}
 
 	return &tptu.Upgrader{
 		Secure:  secMuxer,
 		Muxer:   stMuxer,
 		Filters: n.Filters,
-	}
-
+	}, nil
 }
 
 // GenSwarm generates a new test swarm.
 func GenSwarm(t *testing.T, ctx context.Context, opts ...Option) *swarm.Swarm {
+	cfg, p, s := genBareSwarm(t, ctx, opts)
+
+	upgrader, err := genUpgrader(s, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.transports) == 0 {
+		tcpTransport := tcp.NewTCPTransport(upgrader)
+		tcpTransport.DisableReuseport = cfg.disableReuseport
+		cfg.transports = append(cfg.transports, tcpTransport)
+	}
+	for _, tpt := range cfg.transports {
+		if mt, ok := tpt.(*MockTransport); ok && mt.mem == nil {
+			mt.mem = NewMemTransport(upgrader)
+		}
+		if err := s.AddTransport(tpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !cfg.dialOnly {
+		var laddrs []ma.Multiaddr
+		for _, a := range []ma.Multiaddr{p.Addr, ma.StringCast("/memory/0")} {
+			if s.TransportForListening(a) != nil {
+				laddrs = append(laddrs, a)
+			}
+		}
+		if len(laddrs) > 0 {
+			if err := s.Listen(laddrs...); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s.Peerstore().AddAddrs(p.ID, s.ListenAddresses(), peerstore.PermanentAddrTTL)
+	}
+
+	return s
+}
+
+// GenSwarmMem generates a new test swarm using an in-memory transport (see
+// MemTransport) instead of TCP. It's faster than GenSwarm and doesn't depend
+// on the network stack. OptDisableReuseport and OptTransports don't apply.
+func GenSwarmMem(t *testing.T, ctx context.Context, opts ...Option) *swarm.Swarm {
+	cfg, p, s := genBareSwarm(t, ctx, opts)
+
+	upgrader, err := genUpgrader(s, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddTransport(NewMemTransport(upgrader)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !cfg.dialOnly {
+		if err := s.Listen(ma.StringCast("/memory/0")); err != nil {
+			t.Fatal(err)
+		}
+
+		s.Peerstore().AddAddrs(p.ID, s.ListenAddresses(), peerstore.PermanentAddrTTL)
+	}
+
+	return s
+}
+
+// genBareSwarm generates a swarm without transports, returning the applied
+// options and the swarm's identity.
+func genBareSwarm(t *testing.T, ctx context.Context, opts []Option) (config, tnet.PeerNetParams, *swarm.Swarm) {
 	var cfg config
 	for _, o := range opts {
 		o(t, &cfg)
@@ -69,28 +255,80 @@ func GenSwarm(t *testing.T, ctx context.Context, opts ...Option) *swarm.Swarm {
 
 	p := tnet.RandPeerNetParamsOrFatal(t)
 
-	ps := pstoremem.NewPeerstore()
+	var ps peerstore.Peerstore = pstoremem.NewPeerstore()
 	ps.AddPubKey(p.ID, p.PubKey)
 	ps.AddPrivKey(p.ID, p.PrivKey)
-	s := swarm.NewSwarm(ctx, p.ID, ps, metrics.NewBandwidthCounter())
+	var swarmOpts []swarm.Option
+	if cfg.dialOrder {
+		ops := newOrderedPeerstore(ps)
+		ps = ops
+		swarmOpts = append(swarmOpts,
+			swarm.WithAddrRanker(ops.rank),
+			swarm.WithDialLimits(0, 1),
+			swarm.WithDefaultHappyEyeballsDelay(0),
+			swarm.WithBackoffJitter(false),
+			swarm.WithReuseConnTransport(false),
+		)
+	}
+	if cfg.connectionGater != nil {
+		swarmOpts = append(swarmOpts, swarm.WithConnectionGater(cfg.connectionGater))
+	}
+	if cfg.maxConnsPerPeer > 0 {
+		swarmOpts = append(swarmOpts, swarm.WithMaxConnsPerPeer(cfg.maxConnsPerPeer))
+	}
+	if cfg.dialTimeout > 0 {
+		swarmOpts = append(swarmOpts, swarm.WithDialTimeout(cfg.dialTimeout))
+	}
+	s, err := swarm.NewSwarm(ctx, p.ID, ps, metrics.NewBandwidthCounter(), swarmOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
 	s.Process().AddChild(goprocess.WithTeardown(ps.Close))
+	return cfg, p, s
+}
 
-	tcpTransport := tcp.NewTCPTransport(GenUpgrader(s))
-	tcpTransport.DisableReuseport = cfg.disableReuseport
+// ConnectSwarms connects swarm a to swarm b, failing the test unless both
+// sides get the Connected notification within a few seconds.
+func ConnectSwarms(t *testing.T, a, b *swarm.Swarm) {
+	var stops []func()
+	defer func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}()
+	connected := func(s, other *swarm.Swarm) <-chan struct{} {
+		ch := make(chan struct{})
+		var once sync.Once
+		n := &network.NotifyBundle{
+			ConnectedF: func(_ network.Network, c network.Conn) {
+				if c.RemotePeer() == other.LocalPeer() {
+					once.Do(func() { close(ch) })
+				}
+			},
+		}
+		s.Notify(n)
+		stops = append(stops, func() { s.StopNotify(n) })
+		if s.Connectedness(other.LocalPeer()) == network.Connected {
+			once.Do(func() { close(ch) })
+		}
+		return ch
+	}
+	aConnected := connected(a, b)
+	bConnected := connected(b, a)
 
-	if err := s.AddTransport(tcpTransport); err != nil {
+	DivulgeAddresses(b, a)
+	if _, err := a.DialPeer(context.Background(), b.LocalPeer()); err != nil {
 		t.Fatal(err)
 	}
 
-	if !cfg.dialOnly {
-		if err := s.Listen(p.Addr); err != nil {
-			t.Fatal(err)
+	timeout := time.After(5 * time.Second)
+	for _, ch := range []<-chan struct{}{aConnected, bConnected} {
+		select {
+		case <-ch:
+		case <-timeout:
+			t.Fatal("timed out waiting for the swarms to connect")
 		}
-
-		s.Peerstore().AddAddrs(p.ID, s.ListenAddresses(), peerstore.PermanentAddrTTL)
 	}
-
-	return s
 }
 
 // DivulgeAddresses adds swarm a's addresses to swarm b's peerstore.
@@ -99,3 +337,48 @@ func DivulgeAddresses(a, b network.Network) {
 	addrs := a.Peerstore().Addrs(id)
 	b.Peerstore().AddAddrs(id, addrs, peerstore.PermanentAddrTTL)
 }
+
+// MockConnectionGater is a connection gater whose decisions are made by
+// swappable functions. It allows everything by default.
+type MockConnectionGater struct {
+	PeerDial func(p peer.ID) bool
+	Dial     func(p peer.ID, addr ma.Multiaddr) bool
+	// Upgraded vets upgraded connections. If nil, they're all allowed.
+	Upgraded func(c network.Conn) swarm.GateResult
+}
+
+var _ swarm.UpgradedConnGater = (*MockConnectionGater)(nil)
+
+// DefaultMockConnectionGater returns a mock connection gater allowing
+// everything.
+func DefaultMockConnectionGater() *MockConnectionGater {
+	m := &MockConnectionGater{}
+	m.PeerDial = func(p peer.ID) bool {
+		return true
+	}
+	m.Dial = func(p peer.ID, addr ma.Multiaddr) bool {
+		return true
+	}
+	m.Upgraded = func(c network.Conn) swarm.GateResult {
+		return swarm.GateResult{Allow: true}
+	}
+	return m
+}
+
+// InterceptPeerDial implements swarm.ConnectionGater.
+func (m *MockConnectionGater) InterceptPeerDial(p peer.ID) bool {
+	return m.PeerDial(p)
+}
+
+// InterceptAddrDial implements swarm.ConnectionGater.
+func (m *MockConnectionGater) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	return m.Dial(p, addr)
+}
+
+// InterceptUpgraded implements swarm.UpgradedConnGater.
+func (m *MockConnectionGater) InterceptUpgraded(c network.Conn) swarm.GateResult {
+	if m.Upgraded == nil {
+		return swarm.GateResult{Allow: true}
+	}
+	return m.Upgraded(c)
+}
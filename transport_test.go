@@ -2,13 +2,41 @@ package swarm_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/sec"
+	testutil "github.com/libp2p/go-libp2p-core/test"
 	"github.com/libp2p/go-libp2p-core/transport"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+	"github.com/libp2p/go-tcp-transport"
 	ma "github.com/multiformats/go-multiaddr"
+
+	csms "github.com/libp2p/go-conn-security-multistream"
+	mplex "github.com/libp2p/go-libp2p-mplex"
+	secio "github.com/libp2p/go-libp2p-secio"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	yamux "github.com/libp2p/go-libp2p-yamux"
+	msmux "github.com/libp2p/go-stream-muxer-multistream"
+
+	. "github.com/libp2p/go-libp2p-swarm"
 )
 
 type dummyTransport struct {
@@ -45,3 +73,1165 @@ func TestUselessTransport(t *testing.T) {
 		t.Fatal("adding a transport that supports no protocols should have failed")
 	}
 }
+
+// wrapConnTransport wraps the TCP transport, passing the connections it dials
+// through wrap.
+type wrapConnTransport struct {
+	*tcp.TcpTransport
+	wrap func(transport.CapableConn) transport.CapableConn
+}
+
+func (t *wrapConnTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	c, err := t.TcpTransport.Dial(ctx, raddr, p)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(c), nil
+}
+
+// makeWrapConnSwarm constructs a dial only swarm with the given options whose
+// dialed connections are passed through wrap.
+func makeWrapConnSwarm(ctx context.Context, t *testing.T, wrap func(transport.CapableConn) transport.CapableConn, opts ...Option) *Swarm {
+	s := makeBareSwarm(ctx, t, opts...)
+	tpt := &wrapConnTransport{
+		TcpTransport: tcp.NewTCPTransport(swarmt.GenUpgrader(s)),
+		wrap:         wrap,
+	}
+	if err := s.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+type noDelayConn struct {
+	transport.CapableConn
+	noDelay chan bool
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+	c.noDelay <- noDelay
+	return nil
+}
+
+// reuseportConn pretends to share its local socket with other connections.
+type reuseportConn struct {
+	transport.CapableConn
+	laddr ma.Multiaddr
+}
+
+func (c *reuseportConn) LocalMultiaddr() ma.Multiaddr { return c.laddr }
+func (c *reuseportConn) Reuseport() bool              { return true }
+
+func TestReuseportStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shared := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+	var dials int32
+	s1 := makeWrapConnSwarm(ctx, t, func(c transport.CapableConn) transport.CapableConn {
+		// The first two dials share a socket, the third doesn't use reuseport.
+		if atomic.AddInt32(&dials, 1) > 2 {
+			return c
+		}
+		return &reuseportConn{CapableConn: c, laddr: shared}
+	})
+	defer s1.Close()
+
+	if stats := s1.ReuseportStats(); len(stats) != 0 {
+		t.Fatalf("expected no stats without connections, got %v", stats)
+	}
+
+	for i := 0; i < 3; i++ {
+		s := swarmt.GenSwarm(t, ctx)
+		defer s.Close()
+		swarmt.DivulgeAddresses(s, s1)
+		if _, err := s1.DialPeer(ctx, s.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := s1.ReuseportStats()
+	if len(stats) != 1 || stats[shared.String()] != 2 {
+		t.Fatalf("expected two connections sharing %s, got %v", shared, stats)
+	}
+}
+
+func TestLowLatencyStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conns := make(chan *noDelayConn, 1)
+	s1 := makeWrapConnSwarm(ctx, t, func(c transport.CapableConn) transport.CapableConn {
+		ndc := &noDelayConn{CapableConn: c, noDelay: make(chan bool, 1)}
+		conns <- ndc
+		return ndc
+	})
+	s2 := swarmt.GenSwarm(t, ctx)
+	s2.SetStreamHandler(EchoStreamHandler)
+	swarmt.DivulgeAddresses(s2, s1)
+
+	str, err := s1.NewStream(WithLowLatency(ctx), s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+
+	c := <-conns
+	select {
+	case noDelay := <-c.noDelay:
+		if !noDelay {
+			t.Fatal("expected no delay to be enabled")
+		}
+	default:
+		t.Fatal("low latency hint was not propagated to the transport conn")
+	}
+	if !str.Conn().(*Conn).LowLatency() {
+		t.Fatal("expected conn to be marked as low latency")
+	}
+}
+
+// lingerConn records the linger timeout set on it, and whether it was set
+// before the conn was closed.
+type lingerConn struct {
+	transport.CapableConn
+
+	mu     sync.Mutex
+	linger *time.Duration
+	closed bool
+	early  bool
+}
+
+func (c *lingerConn) SetLinger(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.linger = &d
+	c.early = !c.closed
+	return nil
+}
+
+func (c *lingerConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.CapableConn.Close()
+}
+
+func TestConnLinger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conns := make(chan *lingerConn, 2)
+	s1 := makeWrapConnSwarm(ctx, t, func(c transport.CapableConn) transport.CapableConn {
+		lc := &lingerConn{CapableConn: c}
+		conns <- lc
+		return lc
+	}, WithDefaultConnLinger(time.Second))
+	defer s1.Close()
+
+	for _, tc := range []struct {
+		hint bool
+		want time.Duration
+	}{
+		{hint: true, want: 0},
+		{hint: false, want: time.Second},
+	} {
+		s2 := swarmt.GenSwarm(t, ctx)
+		defer s2.Close()
+		swarmt.DivulgeAddresses(s2, s1)
+
+		dctx := ctx
+		if tc.hint {
+			dctx = WithConnLinger(ctx, 0)
+		}
+		c, err := s1.DialPeer(dctx, s2.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc := <-conns
+		lc.mu.Lock()
+		if lc.linger != nil {
+			t.Fatalf("hint=%t: linger set before close", tc.hint)
+		}
+		lc.mu.Unlock()
+
+		c.Close()
+		lc.mu.Lock()
+		switch {
+		case lc.linger == nil:
+			t.Fatalf("hint=%t: linger was not delivered to the transport conn", tc.hint)
+		case *lc.linger != tc.want:
+			t.Fatalf("hint=%t: expected linger %s, got %s", tc.hint, tc.want, *lc.linger)
+		case !lc.early:
+			t.Fatalf("hint=%t: linger set after close", tc.hint)
+		}
+		lc.mu.Unlock()
+	}
+}
+
+type transientConn struct {
+	transport.CapableConn
+}
+
+func (c *transientConn) IsTransient() bool {
+	return true
+}
+
+func TestTransientConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	relayed := makeWrapConnSwarm(ctx, t, func(c transport.CapableConn) transport.CapableConn {
+		return &transientConn{c}
+	})
+	direct := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	target := swarmt.GenSwarm(t, ctx)
+	swarmt.DivulgeAddresses(target, relayed)
+	swarmt.DivulgeAddresses(target, direct)
+
+	rc, err := relayed.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := direct.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rc.(*Conn).IsTransient() {
+		t.Error("expected relayed conn to be transient")
+	}
+	if dc.(*Conn).IsTransient() {
+		t.Error("expected direct conn not to be transient")
+	}
+}
+
+// faultyMuxConn is a conn whose muxer fails with the error sent on fail, as if
+// the remote side had sent a malformed frame.
+type faultyMuxConn struct {
+	transport.CapableConn
+	fail chan error
+}
+
+type acceptResult struct {
+	str mux.MuxedStream
+	err error
+}
+
+func (c *faultyMuxConn) AcceptStream() (mux.MuxedStream, error) {
+	ch := make(chan acceptResult, 1)
+	go func() {
+		str, err := c.CapableConn.AcceptStream()
+		ch <- acceptResult{str, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.str, r.err
+	case err := <-c.fail:
+		c.CapableConn.Close()
+		return nil, err
+	}
+}
+
+// cleanMuxerError is a muxer error that isn't a protocol error.
+type cleanMuxerError struct{}
+
+func (cleanMuxerError) Error() string       { return "going away" }
+func (cleanMuxerError) ProtocolError() bool { return false }
+
+func TestMuxerErrorHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type muxerError struct {
+		c   network.Conn
+		err error
+	}
+	reported := make(chan muxerError, 3)
+	conns := make(chan *faultyMuxConn, 3)
+	s1 := makeWrapConnSwarm(ctx, t, func(c transport.CapableConn) transport.CapableConn {
+		fc := &faultyMuxConn{CapableConn: c, fail: make(chan error, 1)}
+		conns <- fc
+		return fc
+	}, WithMuxerErrorHandler(func(c network.Conn, err error) {
+		reported <- muxerError{c, err}
+	}))
+	defer s1.Close()
+
+	dial := func() (network.Conn, *faultyMuxConn, *Swarm) {
+		t.Helper()
+		s2 := swarmt.GenSwarm(t, ctx)
+		swarmt.DivulgeAddresses(s2, s1)
+		c, err := s1.DialPeer(ctx, s2.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, <-conns, s2
+	}
+	waitClosed := func(s2 *Swarm) {
+		t.Helper()
+		for i := 0; s1.Connectedness(s2.LocalPeer()) == network.Connected; i++ {
+			if i > 500 {
+				t.Fatal("expected the conn to be closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A malformed frame is reported, with the conn.
+	malformed := errors.New("invalid protocol version")
+	c, fc, s2 := dial()
+	defer s2.Close()
+	fc.fail <- malformed
+	select {
+	case r := <-reported:
+		if r.c != c || r.err != malformed {
+			t.Fatalf("expected the malformed frame error on %s, got %v on %s", c, r.err, r.c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the muxer error to be reported")
+	}
+	waitClosed(s2)
+
+	// Errors that say they aren't protocol errors aren't reported.
+	_, fc, s2 = dial()
+	defer s2.Close()
+	fc.fail <- cleanMuxerError{}
+	waitClosed(s2)
+
+	// Neither is the remote side closing the conn.
+	_, _, s2 = dial()
+	s2.Close()
+	waitClosed(s2)
+
+	select {
+	case r := <-reported:
+		t.Fatalf("unexpected muxer error %v", r.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type stateConn struct {
+	transport.CapableConn
+}
+
+func (c *stateConn) ConnState() ConnectionState {
+	return ConnectionState{Security: secio.ID, StreamMultiplexer: "/yamux/1.0.0"}
+}
+
+func TestConnState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reporting := makeWrapConnSwarm(ctx, t, func(c transport.CapableConn) transport.CapableConn {
+		return &stateConn{c}
+	})
+	plain := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	target := swarmt.GenSwarm(t, ctx)
+	swarmt.DivulgeAddresses(target, reporting)
+	swarmt.DivulgeAddresses(target, plain)
+
+	rc, err := reporting.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := plain.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := rc.(*Conn).ConnState()
+	if state.Security != secio.ID || state.StreamMultiplexer != "/yamux/1.0.0" {
+		t.Errorf("unexpected reported conn state: %+v", state)
+	}
+	if state.Transport != "tcp" {
+		t.Errorf("expected transport tcp, got %q", state.Transport)
+	}
+	state = pc.(*Conn).ConnState()
+	if state.Security != "" || state.Transport != "tcp" {
+		t.Errorf("unexpected derived conn state: %+v", state)
+	}
+
+	for _, c := range []network.Conn{rc, pc} {
+		id, err := peer.IDFromPublicKey(c.RemotePublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != target.LocalPeer() {
+			t.Errorf("remote public key belongs to %s, expected %s", id, target.LocalPeer())
+		}
+	}
+}
+
+// altSecioID is secio registered under a second protocol ID so that two
+// security protocols are available for negotiation.
+const altSecioID = "/secio-alt/1.0.0"
+
+// prefSecMuxer is a security muxer honoring the swarm's security preference
+// on outbound connections.
+type prefSecMuxer struct {
+	order      []string
+	tpts       map[string]sec.SecureTransport
+	negotiated chan string
+}
+
+// recordingSecTransport reports its protocol ID when securing an outbound
+// connection.
+type recordingSecTransport struct {
+	sec.SecureTransport
+	id         string
+	negotiated chan string
+}
+
+func (t *recordingSecTransport) SecureOutbound(ctx context.Context, conn net.Conn, p peer.ID) (sec.SecureConn, error) {
+	t.negotiated <- t.id
+	return t.SecureTransport.SecureOutbound(ctx, conn, p)
+}
+
+func newPrefSecMuxer(s *Swarm) *prefSecMuxer {
+	id := s.LocalPeer()
+	pk := s.Peerstore().PrivKey(id)
+	m := &prefSecMuxer{
+		order:      []string{secio.ID, altSecioID},
+		tpts:       make(map[string]sec.SecureTransport),
+		negotiated: make(chan string, 1),
+	}
+	for _, proto := range m.order {
+		m.tpts[proto] = &recordingSecTransport{
+			SecureTransport: &secio.Transport{LocalID: id, PrivateKey: pk},
+			id:              proto,
+			negotiated:      m.negotiated,
+		}
+	}
+	return m
+}
+
+func (m *prefSecMuxer) muxer(order []string) *csms.SSMuxer {
+	sm := new(csms.SSMuxer)
+	for _, proto := range order {
+		sm.AddTransport(proto, m.tpts[proto])
+	}
+	return sm
+}
+
+func (m *prefSecMuxer) SecureInbound(ctx context.Context, insecure net.Conn) (sec.SecureConn, error) {
+	return m.muxer(m.order).SecureInbound(ctx, insecure)
+}
+
+func (m *prefSecMuxer) SecureOutbound(ctx context.Context, conn net.Conn, p peer.ID) (sec.SecureConn, error) {
+	var order []string
+	seen := make(map[string]bool)
+	for _, proto := range GetSecurityPreference(ctx) {
+		order = append(order, string(proto))
+		seen[string(proto)] = true
+	}
+	for _, proto := range m.order {
+		if !seen[proto] {
+			order = append(order, proto)
+		}
+	}
+	return m.muxer(order).SecureOutbound(ctx, conn, p)
+}
+
+func genPrefSecSwarm(ctx context.Context, t *testing.T) (*Swarm, *prefSecMuxer) {
+	s := makeBareSwarm(ctx, t)
+	secMuxer := newPrefSecMuxer(s)
+	stMuxer := msmux.NewBlankTransport()
+	stMuxer.AddTransport("/yamux/1.0.0", yamux.DefaultTransport)
+	upgrader := &tptu.Upgrader{
+		Secure:  secMuxer,
+		Muxer:   stMuxer,
+		Filters: s.Filters,
+	}
+	if err := s.AddTransport(tcp.NewTCPTransport(upgrader)); err != nil {
+		t.Fatal(err)
+	}
+	return s, secMuxer
+}
+
+func TestSecurityPreference(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1, secMuxer := genPrefSecSwarm(ctx, t)
+	s2, _ := genPrefSecSwarm(ctx, t)
+	if err := s2.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	s1.SetSecurityPreference([]protocol.ID{altSecioID})
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if proto := <-secMuxer.negotiated; proto != altSecioID {
+		t.Fatalf("expected %s to be negotiated, got %s", altSecioID, proto)
+	}
+}
+
+// ticketSecTransport is a security transport pretending to support session
+// resumption: it records the ticket presented when securing outbound
+// connections and reports a new one once secured.
+type ticketSecTransport struct {
+	sec.SecureTransport
+	presented chan []byte
+	issued    uint32
+}
+
+func (t *ticketSecTransport) SecureOutbound(ctx context.Context, conn net.Conn, p peer.ID) (sec.SecureConn, error) {
+	t.presented <- GetResumptionTicket(ctx)
+	sc, err := t.SecureTransport.SecureOutbound(ctx, conn, p)
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddUint32(&t.issued, 1)
+	ReportResumptionTicket(ctx, []byte(fmt.Sprintf("ticket-%d", n)))
+	return sc, nil
+}
+
+func TestResumptionTicket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tpt := &ticketSecTransport{presented: make(chan []byte, 1)}
+	s1 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly, swarmt.OptSecurity(secio.ID, func(id peer.ID, pk crypto.PrivKey) (sec.SecureTransport, error) {
+		tpt.SecureTransport = &secio.Transport{LocalID: id, PrivateKey: pk}
+		return tpt, nil
+	}))
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	dial := func(ctx context.Context, expected string) {
+		t.Helper()
+		if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+		if ticket := <-tpt.presented; string(ticket) != expected {
+			t.Fatalf("expected ticket %q to be presented, got %q", expected, ticket)
+		}
+		if err := s1.ClosePeer(s2.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No ticket yet, then the one received on the previous connection.
+	dial(ctx, "")
+	if ticket := s1.ResumptionTicket(s2.LocalPeer()); string(ticket) != "ticket-1" {
+		t.Fatalf("expected the new ticket to be stored, got %q", ticket)
+	}
+	dial(ctx, "ticket-1")
+
+	// The context's ticket takes precedence.
+	dial(WithResumptionTicket(ctx, []byte("explicit")), "explicit")
+	if ticket := s1.ResumptionTicket(s2.LocalPeer()); string(ticket) != "ticket-3" {
+		t.Fatalf("expected the new ticket to be stored, got %q", ticket)
+	}
+
+	s1.ForgetResumptionTicket(s2.LocalPeer())
+	dial(ctx, "")
+}
+
+const altYamuxID = "/yamux-alt/1.0.0"
+
+// recordingMuxer reports its protocol ID when multiplexing an outbound
+// connection.
+type recordingMuxer struct {
+	mux.Multiplexer
+	id         string
+	negotiated chan string
+}
+
+func (m *recordingMuxer) NewConn(c net.Conn, isServer bool) (mux.MuxedConn, error) {
+	if !isServer {
+		m.negotiated <- m.id
+	}
+	return m.Multiplexer.NewConn(c, isServer)
+}
+
+// prefMuxTransport is a TCP transport offering the stream multiplexers in the
+// order hinted with WithPreferredMuxer when dialing.
+type prefMuxTransport struct {
+	*tcp.TcpTransport
+
+	swarm      *Swarm
+	order      []string
+	muxers     map[string]mux.Multiplexer
+	negotiated chan string
+}
+
+func newPrefMuxTransport(s *Swarm) *prefMuxTransport {
+	t := &prefMuxTransport{
+		swarm:      s,
+		order:      []string{"/yamux/1.0.0", altYamuxID},
+		muxers:     make(map[string]mux.Multiplexer),
+		negotiated: make(chan string, 1),
+	}
+	for _, proto := range t.order {
+		t.muxers[proto] = &recordingMuxer{
+			Multiplexer: yamux.DefaultTransport,
+			id:          proto,
+			negotiated:  t.negotiated,
+		}
+	}
+	t.TcpTransport = tcp.NewTCPTransport(t.upgrader(t.order))
+	return t
+}
+
+func (t *prefMuxTransport) upgrader(order []string) *tptu.Upgrader {
+	upgrader := swarmt.GenUpgrader(t.swarm)
+	stMuxer := msmux.NewBlankTransport()
+	for _, proto := range order {
+		stMuxer.AddTransport(proto, t.muxers[proto])
+	}
+	upgrader.Muxer = stMuxer
+	return upgrader
+}
+
+func (t *prefMuxTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	preferred, ok := GetPreferredMuxer(ctx)
+	if !ok {
+		return t.TcpTransport.Dial(ctx, raddr, p)
+	}
+	order := []string{string(preferred)}
+	for _, proto := range t.order {
+		if proto != string(preferred) {
+			order = append(order, proto)
+		}
+	}
+	return tcp.NewTCPTransport(t.upgrader(order)).Dial(ctx, raddr, p)
+}
+
+func TestPreferredMuxer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeBareSwarm(ctx, t)
+	defer s1.Close()
+	tpt := newPrefMuxTransport(s1)
+	if err := s1.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	s2 := makeBareSwarm(ctx, t)
+	defer s2.Close()
+	if err := s2.AddTransport(newPrefMuxTransport(s2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+
+	if _, err := s1.DialPeer(WithPreferredMuxer(ctx, altYamuxID), s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if proto := <-tpt.negotiated; proto != altYamuxID {
+		t.Fatalf("expected %s to be negotiated, got %s", altYamuxID, proto)
+	}
+}
+
+// failingMuxer fails to set up outbound connections.
+type failingMuxer struct {
+	mux.Multiplexer
+}
+
+func (m failingMuxer) NewConn(c net.Conn, isServer bool) (mux.MuxedConn, error) {
+	if !isServer {
+		return nil, errors.New("muxer unavailable")
+	}
+	return m.Multiplexer.NewConn(c, isServer)
+}
+
+// muxerListingTransport is a prefMuxTransport reporting its muxers.
+type muxerListingTransport struct {
+	*prefMuxTransport
+}
+
+func (t muxerListingTransport) Muxers() []protocol.ID {
+	var muxers []protocol.ID
+	for _, proto := range t.order {
+		muxers = append(muxers, protocol.ID(proto))
+	}
+	return muxers
+}
+
+func TestMuxerFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s2 := makeBareSwarm(ctx, t)
+	defer s2.Close()
+	if err := s2.AddTransport(newPrefMuxTransport(s2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := func(opts ...Option) (*Swarm, *prefMuxTransport) {
+		s := makeBareSwarm(ctx, t, opts...)
+		tpt := newPrefMuxTransport(s)
+		tpt.muxers["/yamux/1.0.0"] = failingMuxer{yamux.DefaultTransport}
+		tpt.TcpTransport = tcp.NewTCPTransport(tpt.upgrader(tpt.order))
+		if err := s.AddTransport(muxerListingTransport{tpt}); err != nil {
+			t.Fatal(err)
+		}
+		s.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+		return s, tpt
+	}
+
+	s1, _ := dialer()
+	defer s1.Close()
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err == nil {
+		t.Fatal("expected the dial to fail without fallback")
+	}
+
+	s3, tpt := dialer(WithMuxerFallback())
+	defer s3.Close()
+	c, err := s3.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := <-tpt.negotiated; proto != altYamuxID {
+		t.Fatalf("expected %s to be negotiated, got %s", altYamuxID, proto)
+	}
+	if _, err := c.NewStream(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordingTransport fails every dial, recording the dialed addresses.
+type recordingTransport struct {
+	dummyTransport
+	dialed func(ma.Multiaddr)
+}
+
+func (rt *recordingTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	rt.dialed(raddr)
+	return nil, fmt.Errorf("can't dial %s", raddr)
+}
+
+func (rt *recordingTransport) CanDial(addr ma.Multiaddr) bool {
+	return true
+}
+
+func TestDialReusesConnTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var dialed []string
+	record := func(name string) {
+		mu.Lock()
+		dialed = append(dialed, name)
+		mu.Unlock()
+	}
+
+	// Rank UDP ahead of TCP, and start dials one at a time so that the
+	// order they're attempted in is observable.
+	ranker := func(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+		var udp, rest []ma.Multiaddr
+		for _, a := range addrs {
+			if _, err := a.ValueForProtocol(ma.P_UDP); err == nil {
+				udp = append(udp, a)
+			} else {
+				rest = append(rest, a)
+			}
+		}
+		return append(udp, rest...)
+	}
+	s1 := makeBareSwarm(ctx, t, WithAddrRanker(ranker), WithDialRateLimit(10, 1))
+	defer s1.Close()
+	tcpTpt := &wrapConnTransport{
+		TcpTransport: tcp.NewTCPTransport(swarmt.GenUpgrader(s1)),
+		wrap: func(c transport.CapableConn) transport.CapableConn {
+			record("tcp")
+			return c
+		},
+	}
+	udpTpt := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}},
+		dialed:         func(ma.Multiaddr) { record("udp") },
+	}
+	for _, tpt := range []transport.Transport{tcpTpt, udpTpt} {
+		if err := s1.AddTransport(tpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s2 := swarmt.GenSwarm(t, ctx)
+	defer s2.Close()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddr(s2.LocalPeer(), ma.StringCast("/ip4/127.0.0.1/udp/1234"), peerstore.PermanentAddrTTL)
+
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(dialed) == 0 || dialed[0] != "udp" {
+		t.Fatalf("expected the first dial to try udp first, got %v", dialed)
+	}
+	dialed = nil
+	mu.Unlock()
+
+	report := s1.DialPeerBestEffort(WithAdditionalConn(ctx), s2.LocalPeer())
+	if report.Conn == nil {
+		t.Fatalf("expected an additional conn: %v", report.Err)
+	}
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 2 {
+		t.Fatalf("expected 2 conns, got %d", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 2 || dialed[0] != "tcp" {
+		t.Fatalf("expected the additional dial to try tcp first, got %v", dialed)
+	}
+}
+
+// trafficClassTransport is a TCP transport recording the traffic classes it's
+// asked to dial with.
+type trafficClassTransport struct {
+	*tcp.TcpTransport
+	classes chan int
+}
+
+func (t *trafficClassTransport) DialWithTrafficClass(ctx context.Context, raddr ma.Multiaddr, p peer.ID, tc int) (transport.CapableConn, error) {
+	t.classes <- tc
+	return t.TcpTransport.Dial(ctx, raddr, p)
+}
+
+func TestConnTrafficClass(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeBareSwarm(ctx, t)
+	defer s1.Close()
+	tpt := &trafficClassTransport{
+		TcpTransport: tcp.NewTCPTransport(swarmt.GenUpgrader(s1)),
+		classes:      make(chan int, 1),
+	}
+	if err := s1.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	plain := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer plain.Close()
+	target := swarmt.GenSwarm(t, ctx)
+	defer target.Close()
+	swarmt.DivulgeAddresses(target, s1)
+	swarmt.DivulgeAddresses(target, plain)
+
+	const class = 0x2e // EF
+	c, err := s1.DialPeer(WithConnTrafficClass(ctx, class), target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tc := <-tpt.classes:
+		if tc != class {
+			t.Fatalf("expected the transport to receive class %d, got %d", class, tc)
+		}
+	default:
+		t.Fatal("expected the transport to be asked for a traffic class")
+	}
+	if tc, ok := c.(*Conn).TrafficClass(); !ok || tc != class {
+		t.Fatalf("expected conn traffic class %d, got %d (%t)", class, tc, ok)
+	}
+
+	// Transports that can't set a traffic class ignore it.
+	pc, err := plain.DialPeer(WithConnTrafficClass(ctx, class), target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pc.(*Conn).TrafficClass(); ok {
+		t.Fatal("expected no traffic class on a conn dialed by an unsupporting transport")
+	}
+}
+
+func TestWithTransports(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tcpTpt := tcp.NewTCPTransport(nil)
+	udpTpt := &recordingTransport{dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}}}
+	s := makeBareSwarm(ctx, t, WithTransports(tcpTpt, udpTpt))
+	defer s.Close()
+
+	for tpt, addr := range map[transport.Transport]ma.Multiaddr{
+		tcpTpt: ma.StringCast("/ip4/1.2.3.4/tcp/1234"),
+		udpTpt: ma.StringCast("/ip4/1.2.3.4/udp/1234"),
+	} {
+		if got := s.TransportForDialing(addr); got != tpt {
+			t.Errorf("expected %T for %s, got %T", tpt, addr, got)
+		} else if !got.CanDial(addr) {
+			t.Errorf("expected %T to be able to dial %s", tpt, addr)
+		}
+	}
+
+	// A transport that can't be added fails construction.
+	p := tnet.RandPeerNetParamsOrFatal(t)
+	ps := pstoremem.NewPeerstore()
+	defer ps.Close()
+	if _, err := NewSwarm(ctx, p.ID, ps, metrics.NewBandwidthCounter(), WithTransports(tcpTpt, new(dummyTransport))); err == nil {
+		t.Fatal("expected construction with a transport supporting no protocols to fail")
+	}
+}
+
+func TestGenSwarmSecurityAndMuxer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newSecio := func(id peer.ID, pk crypto.PrivKey) (sec.SecureTransport, error) {
+		return &secio.Transport{LocalID: id, PrivateKey: pk}, nil
+	}
+	negotiated := make(chan string, 1)
+	opts := []swarmt.Option{
+		swarmt.OptSecurity(secio.ID, newSecio),
+		swarmt.OptMuxer("/mplex/6.7.0", &recordingMuxer{
+			Multiplexer: mplex.DefaultTransport,
+			id:          "/mplex/6.7.0",
+			negotiated:  negotiated,
+		}),
+	}
+	s1 := swarmt.GenSwarm(t, ctx, opts...)
+	defer s1.Close()
+	s2 := swarmt.GenSwarm(t, ctx, opts...)
+	defer s2.Close()
+	s2.SetStreamHandler(EchoStreamHandler)
+	swarmt.DivulgeAddresses(s2, s1)
+
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+	if proto := <-negotiated; proto != "/mplex/6.7.0" {
+		t.Fatalf("expected mplex to be negotiated, got %s", proto)
+	}
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(str, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A swarm with the default stack (yamux) has no muxer in common.
+	s3 := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s3.Close()
+	swarmt.DivulgeAddresses(s2, s3)
+	if _, err := s3.DialPeer(ctx, s2.LocalPeer()); err == nil {
+		t.Fatal("expected dialing without a common muxer to fail")
+	}
+}
+
+func TestDeterministicDialOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var dialed []ma.Multiaddr
+	tpt := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}},
+		dialed: func(a ma.Multiaddr) {
+			mu.Lock()
+			dialed = append(dialed, a)
+			mu.Unlock()
+		},
+	}
+	s := swarmt.GenSwarm(t, ctx, swarmt.OptTransports(tpt), swarmt.OptDialOnly, swarmt.OptDeterministicDialOrder)
+	defer s.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	var addrs []ma.Multiaddr
+	for _, port := range []int{7, 3, 9, 1, 5, 8} {
+		addrs = append(addrs, ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/udp/%d", port)))
+	}
+	s.Peerstore().AddAddrs(p, addrs[:3], peerstore.PermanentAddrTTL)
+	for _, a := range addrs[3:] {
+		s.Peerstore().AddAddr(p, a, peerstore.PermanentAddrTTL)
+	}
+
+	if _, err := s.DialPeer(ctx, p); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != len(addrs) {
+		t.Fatalf("expected %d dials, got %v", len(addrs), dialed)
+	}
+	for i := range addrs {
+		if !dialed[i].Equal(addrs[i]) {
+			t.Fatalf("expected dials in order %v, got %v", addrs, dialed)
+		}
+	}
+}
+
+func TestRemoveTransportGraceful(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeBareSwarm(ctx, t)
+	defer s1.Close()
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s1))
+	if err := s1.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	s2 := swarmt.GenSwarm(t, ctx)
+	defer s2.Close()
+	s2.SetStreamHandler(func(s network.Stream) {
+		io.Copy(ioutil.Discard, s)
+		s.Close()
+	})
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := str.Conn()
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- s1.RemoveTransportGraceful(ctx, tpt)
+	}()
+
+	// New streams are refused while the open one is allowed to finish.
+	for i := 0; ; i++ {
+		s, err := c.NewStream()
+		if err == ErrConnDraining {
+			break
+		} else if err == nil {
+			// Removal hasn't started yet.
+			s.Reset()
+		}
+		if i > 100 {
+			t.Fatal("conn never started draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-removed:
+		t.Fatalf("removal returned with a stream still open: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 1 {
+		t.Fatal("conn closed with a stream still open")
+	}
+	if s1.TransportForDialing(s2.ListenAddresses()[0]) != nil {
+		t.Fatal("expected the transport to be unregistered")
+	}
+	for i := 0; len(s1.ListenAddresses()) != 0; i++ {
+		if i > 100 {
+			t.Fatal("expected the transport's listener to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	str.Close()
+	if _, err := ioutil.ReadAll(str); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("removal never finished")
+	}
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 0 {
+		t.Fatal("expected the drained conn to be closed")
+	}
+
+	if err := s1.RemoveTransport(tpt); err != ErrTransportNotRegistered {
+		t.Fatalf("expected ErrTransportNotRegistered, got %v", err)
+	}
+}
+
+func TestRemoveTransportAcquiredConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := makeBareSwarm(ctx, t)
+	defer s1.Close()
+	tpt := tcp.NewTCPTransport(swarmt.GenUpgrader(s1))
+	if err := s1.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	s2 := swarmt.GenSwarm(t, ctx)
+	defer s2.Close()
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), peerstore.PermanentAddrTTL)
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := c.(*Conn).Acquire()
+	defer release()
+
+	// Removal doesn't wait for the acquired conn to be released.
+	removed := make(chan error, 1)
+	go func() { removed <- s1.RemoveTransport(tpt) }()
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("removal waited for the acquired conn to be released")
+	}
+
+	release()
+	for i := 0; len(s1.ConnsToPeer(s2.LocalPeer())) != 0; i++ {
+		if i > 100 {
+			t.Fatal("expected the conn to be closed once released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFallbackTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := makeDialOnlySwarmWithOpts(ctx, t)
+	defer s.Close()
+	dialed := make(chan ma.Multiaddr, 1)
+	fallback := &recordingTransport{
+		dummyTransport: dummyTransport{protocols: []int{ma.P_UDP}},
+		dialed:         func(a ma.Multiaddr) { dialed <- a },
+	}
+	s.SetFallbackTransport(fallback)
+
+	udp := ma.StringCast("/ip4/1.2.3.4/udp/1")
+	tcpAddr := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	if s.TransportForDialing(udp) != fallback {
+		t.Fatal("expected the fallback to dial an address no transport handles")
+	}
+	if tpt := s.TransportForDialing(tcpAddr); tpt == nil || tpt == fallback {
+		t.Fatalf("expected the registered transport to dial tcp, got %T", tpt)
+	}
+
+	p := tnet.RandPeerNetParamsOrFatal(t).ID
+	s.Peerstore().AddAddr(p, udp, peerstore.PermanentAddrTTL)
+	if _, err := s.DialPeer(ctx, p); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	select {
+	case a := <-dialed:
+		if !a.Equal(udp) {
+			t.Fatalf("expected the fallback to dial %s, got %s", udp, a)
+		}
+	default:
+		t.Fatal("expected the fallback to be dialed")
+	}
+
+	s.SetFallbackTransport(nil)
+	if tpt := s.TransportForDialing(udp); tpt != nil {
+		t.Fatalf("expected no transport once the fallback is removed, got %T", tpt)
+	}
+}
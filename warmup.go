@@ -0,0 +1,84 @@
+package swarm
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// WarmupRetryInterval is how long Warmup waits between rounds of dials to the
+// peers it couldn't connect to yet.
+var WarmupRetryInterval = 5 * time.Second
+
+// Warmer connects to a set of peers in the background, see Swarm.Warmup.
+type Warmer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Stop stops dialing and waits for the dial in progress, if any, to be
+// abandoned.
+func (w *Warmer) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+// Done returns a channel closed once the swarm is connected to all the peers,
+// or when the warmer was stopped.
+func (w *Warmer) Done() <-chan struct{} {
+	return w.done
+}
+
+// Warmup connects to the given peers in the background, retrying every
+// WarmupRetryInterval until the swarm is connected to all of them, the context
+// is done or the returned Warmer is stopped.
+//
+// Warmup dials with low priority: one peer at a time (that peer's addresses
+// are dialed as usual, up to the per peer dial limit), and without bypassing
+// dial backoff, so addresses that failed aren't dialed again before their
+// backoff expires.
+// Peers that get connected some other way aren't dialed.
+func (s *Swarm) Warmup(ctx context.Context, peers []peer.ID) *Warmer {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Warmer{cancel: cancel, done: make(chan struct{})}
+	pending := append([]peer.ID(nil), peers...)
+
+	go func() {
+		defer close(w.done)
+		defer cancel()
+
+		for {
+			remaining := pending[:0]
+			for _, p := range pending {
+				if ctx.Err() != nil || s.ctx.Err() != nil {
+					return
+				}
+				if s.Connectedness(p) == network.Connected {
+					continue
+				}
+				if _, err := s.DialPeer(ctx, p); err != nil {
+					log.Debugf("warmup dial to %s failed: %s", p, err)
+					remaining = append(remaining, p)
+				}
+			}
+			pending = remaining
+			if len(pending) == 0 {
+				return
+			}
+
+			t := time.NewTimer(WarmupRetryInterval)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-s.ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+	}()
+	return w
+}